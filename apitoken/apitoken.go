@@ -0,0 +1,202 @@
+package apitoken
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"torb/dialect"
+)
+
+const schema = "CREATE TABLE IF NOT EXISTS api_tokens (" +
+	"id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY," +
+	"owner_type VARCHAR(16) NOT NULL," +
+	"owner_id BIGINT NOT NULL," +
+	"name VARCHAR(128) NOT NULL DEFAULT ''," +
+	"token_hash CHAR(64) NOT NULL," +
+	"prefix VARCHAR(16) NOT NULL," +
+	"scopes VARCHAR(255) NOT NULL DEFAULT ''," +
+	"created_at DATETIME(6) NOT NULL," +
+	"expires_at DATETIME(6) NULL," +
+	"last_used_at DATETIME(6) NULL," +
+	"revoked_at DATETIME(6) NULL," +
+	"UNIQUE KEY token_hash (token_hash)," +
+	"KEY owner (owner_type, owner_id)" +
+	") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4"
+
+// Owner types
+const (
+	User          = "user"
+	Administrator = "administrator"
+)
+
+// token = "torb_" + hex(32 random bytes), only its sha256 is stored
+const tokenPrefix = "torb_"
+
+// ErrNotFound is returned for unknown, expired or revoked tokens
+var ErrNotFound = errors.New("api token not found")
+
+// Token is an issued token, the plain value is only returned by Issue
+type Token struct {
+	ID         int64      `json:"id"`
+	OwnerType  string     `json:"-"`
+	OwnerID    int64      `json:"-"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// HasScope returns whether the token is allowed the scope
+func (t *Token) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Store keeps the tokens in the api_tokens table
+type Store struct {
+	db *sql.DB
+}
+
+// New returns the instance, creating the api_tokens table if not exists
+func New(db *sql.DB, d dialect.Dialect) (*Store, error) {
+	for _, stmt := range d.Schema(schema) {
+		if _, err := db.Exec(stmt); err != nil {
+			return nil, err
+		}
+	}
+	return &Store{db: db}, nil
+}
+
+func hash(plain string) string {
+	sum := sha256.Sum256([]byte(plain))
+	return hex.EncodeToString(sum[:])
+}
+
+// Issue creates a token and returns its plain value, expiresIn <= 0 never expires
+func (s *Store) Issue(ownerType string, ownerID int64, name string, scopes []string, expiresIn time.Duration) (string, *Token, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, err
+	}
+	plain := tokenPrefix + hex.EncodeToString(b)
+
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	token := &Token{
+		OwnerType: ownerType,
+		OwnerID:   ownerID,
+		Name:      name,
+		Prefix:    plain[:len(tokenPrefix)+8],
+		Scopes:    scopes,
+		CreatedAt: now,
+	}
+	var expiresAt interface{}
+	if expiresIn > 0 {
+		t := now.Add(expiresIn)
+		token.ExpiresAt = &t
+		expiresAt = t
+	}
+
+	res, err := s.db.Exec("INSERT INTO api_tokens (owner_type, owner_id, name, token_hash, prefix, scopes, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		ownerType, ownerID, name, hash(plain), token.Prefix, strings.Join(scopes, ","), now, expiresAt)
+	if err != nil {
+		return "", nil, err
+	}
+	if token.ID, err = res.LastInsertId(); err != nil {
+		return "", nil, err
+	}
+	return plain, token, nil
+}
+
+// List returns the active tokens of the owner
+func (s *Store) List(ownerType string, ownerID int64) ([]*Token, error) {
+	rows, err := s.db.Query("SELECT id, owner_type, owner_id, name, prefix, scopes, created_at, expires_at, last_used_at FROM api_tokens WHERE owner_type = ? AND owner_id = ? AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?) ORDER BY id ASC",
+		ownerType, ownerID, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []*Token{}
+	for rows.Next() {
+		token, err := scanToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+// Revoke disables the token of the owner
+func (s *Store) Revoke(ownerType string, ownerID int64, tokenID int64) error {
+	res, err := s.db.Exec("UPDATE api_tokens SET revoked_at = ? WHERE id = ? AND owner_type = ? AND owner_id = ? AND revoked_at IS NULL", time.Now().UTC(), tokenID, ownerType, ownerID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// RevokeAll disables all the tokens of the owner
+func (s *Store) RevokeAll(ownerType string, ownerID int64) error {
+	_, err := s.db.Exec("UPDATE api_tokens SET revoked_at = ? WHERE owner_type = ? AND owner_id = ? AND revoked_at IS NULL", time.Now().UTC(), ownerType, ownerID)
+	return err
+}
+
+// Authenticate returns the active token for the plain value
+func (s *Store) Authenticate(plain string) (*Token, error) {
+	if !strings.HasPrefix(plain, tokenPrefix) {
+		return nil, ErrNotFound
+	}
+	now := time.Now().UTC()
+	token, err := scanToken(s.db.QueryRow("SELECT id, owner_type, owner_id, name, prefix, scopes, created_at, expires_at, last_used_at FROM api_tokens WHERE token_hash = ? AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?)",
+		hash(plain), now))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// 毎リクエスト書き込むと重いので、最終利用日時は1分単位で更新する
+	if token.LastUsedAt == nil || now.Sub(*token.LastUsedAt) > time.Minute {
+		if _, err := s.db.Exec("UPDATE api_tokens SET last_used_at = ? WHERE id = ?", now, token.ID); err != nil {
+			return nil, err
+		}
+		token.LastUsedAt = &now
+	}
+	return token, nil
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanToken(row scanner) (*Token, error) {
+	var token Token
+	var scopes string
+	if err := row.Scan(&token.ID, &token.OwnerType, &token.OwnerID, &token.Name, &token.Prefix, &scopes, &token.CreatedAt, &token.ExpiresAt, &token.LastUsedAt); err != nil {
+		return nil, err
+	}
+	if scopes != "" {
+		token.Scopes = strings.Split(scopes, ",")
+	}
+	return &token, nil
+}
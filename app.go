@@ -1,7 +1,6 @@
 /**
  * ## REQUIREMENT
  * go get -u github.com/oxequa/realize
- * go get github.com/joho/godotenv
  * go get github.com/thoas/go-funk
  * go get github.com/patrickmn/go-cache
  * go get -u github.com/go-redis/redis
@@ -51,96 +50,223 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"errors"
+	"flag"
 	"fmt"
 	"html/template"
 	"io"
+	"io/fs"
+	"io/ioutil"
 	"log"
+	"net"
 	"os"
-	"os/exec"
+	"os/signal"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	fifo "github.com/foize/go.fifo"
+	"github.com/go-redis/redis"
 	_ "github.com/go-sql-driver/mysql"
-	"github.com/gorilla/sessions"
-	"github.com/joho/godotenv"
 	jsoniter "github.com/json-iterator/go"
 	"github.com/labstack/echo"
-	"github.com/labstack/echo-contrib/session"
+	_ "github.com/mattn/go-sqlite3"
 	cache "github.com/patrickmn/go-cache"
 	funk "github.com/thoas/go-funk"
 
 	"net/http"
 	_ "net/http/pprof"
 
+	"torb/apitoken"
+	"torb/apperr"
+	"torb/audit"
 	myCache "torb/cache"
+	"torb/clientip"
+	"torb/config"
+	"torb/dialect"
+	"torb/fixture"
+	"torb/idempotency"
+	"torb/loginlimit"
+	"torb/metrics"
+	"torb/password"
+	"torb/rbac"
+	"torb/report"
+	"torb/repository"
 	sess "torb/session"
+	"torb/snapshot"
 	. "torb/structs"
+	"torb/totp"
+	"torb/validate"
 )
 
-func arrayToString(a []int64, delim string) string {
-	return strings.Trim(strings.Replace(fmt.Sprint(a), " ", delim, -1), "[]")
-}
-
-func cacheSheets() {
-	var sheets []Sheet
-	sheetsRows, err := db.Query("SELECT * FROM sheets ORDER BY `rank`, num")
+func cacheSheets(maxEventLen int64) error {
+	sheets, err := repos.Sheets.List()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	defer sheetsRows.Close()
+	goCache.Set("sheetsSlice", sheets, cache.DefaultExpiration)
 
-	for sheetsRows.Next() {
-		var sheet Sheet
-		if err := sheetsRows.Scan(&sheet.ID, &sheet.Rank, &sheet.Num, &sheet.Price); err != nil {
-			log.Fatal(err)
+	// 読み込むデータは初期データ（18イベント、11,12,13以外は全部埋まり）とは限らないので、実際の予約から空席を求める
+	reservations, err := repos.Reservations.ListNotCanceled()
+	if err != nil {
+		return err
+	}
+	advanceReservationUUID(reservations)
+	reserved := map[int64]map[int64]bool{}
+	for _, r := range reservations {
+		if reserved[r.EventID] == nil {
+			reserved[r.EventID] = map[int64]bool{}
 		}
-		sheets = append(sheets, sheet)
+		reserved[r.EventID][r.SheetID] = true
 	}
-	goCache.Set("sheetsSlice", sheets, cache.DefaultExpiration)
+	setRandomSheetMap(sheets, maxEventLen, func(eventID, sheetID int64) bool { return !reserved[eventID][sheetID] })
+	return nil
+}
 
+// setRandomSheetMap caches the free sheets of each event up to maxEventLen in random order
+func setRandomSheetMap(sheets []Sheet, maxEventLen int64, free func(eventID, sheetID int64) bool) {
 	// { eventID: { sheetRank: Queue of []sheet } }
 	// set random sheetMap for new reservation
-	{
-		const EventLen = int64(18)
-		const MaxEventLen = int64(100)
-
-		sheets := funk.Shuffle(sheets).([]Sheet)
-		data := map[int64]map[string]*fifo.Queue{}
-
-		// 初期イベントは18個。11,12,13は全部空き。それ以外は全部埋まり。
-		// 100くらいまで作っておく
-		for eid := int64(1); eid <= MaxEventLen; eid++ {
-			// initialize the map
-			sheetMap := map[string]*fifo.Queue{
-				"S": fifo.NewQueue(),
-				"A": fifo.NewQueue(),
-				"B": fifo.NewQueue(),
-				"C": fifo.NewQueue(),
+	sheets = funk.Shuffle(sheets).([]Sheet)
+	data := map[int64]map[string]*fifo.Queue{}
+
+	// 100くらいまで作っておく
+	for eid := int64(1); eid <= maxEventLen; eid++ {
+		// initialize the map
+		sheetMap := map[string]*fifo.Queue{
+			"S": fifo.NewQueue(),
+			"A": fifo.NewQueue(),
+			"B": fifo.NewQueue(),
+			"C": fifo.NewQueue(),
+		}
+		// set the map
+		data[eid] = sheetMap
+		// append the non reserved sheets
+		for _, s := range sheets {
+			if free(eid, s.ID) {
+				sheetMap[s.Rank].Add(s)
 			}
-			// set the map
-			data[eid] = sheetMap
-			// append if the event has non reserved sheets
-			if (eid >= 11 && eid <= 13) || eid > EventLen {
-				for _, s := range sheets {
-					sheetMap[s.Rank].Add(s)
-				}
+		}
+	}
+	goCache.Set("randomSheetMap", data, cache.DefaultExpiration)
+}
+
+// cacheCanceledReservations caches the canceled reservations for the sales reports
+func cacheCanceledReservations() error {
+	reservations, err := repos.Reservations.ListCanceled()
+	if err != nil {
+		return err
+	}
+	advanceReservationUUID(reservations)
+	canceledRMX.Lock()
+	canceledReservations = reservations
+	canceledRMX.Unlock()
+	return nil
+}
+
+// loadCaches builds the caches at boot from the snapshot at cfg.SnapshotPath if it is newer than the last change of the DB,
+// otherwise from the DB
+func loadCaches(cfg *config.Config) error {
+	start := time.Now()
+	if path := cfg.SnapshotPath; path != "" {
+		restored, err := restoreSnapshot(path, cfg.MaxEventLen)
+		if err != nil {
+			log.Printf("snapshot: %v", err)
+		}
+		if restored {
+			log.Printf("caches: restored from %s in %s", path, time.Since(start))
+			return nil
+		}
+	}
+
+	if err := cacheSheets(cfg.MaxEventLen); err != nil {
+		return err
+	}
+	if err := myCache.InitNonCanceledReservations(repos.Reservations, cfg.MaxEventLen); err != nil {
+		return err
+	}
+	if err := cacheCanceledReservations(); err != nil {
+		return err
+	}
+	log.Printf("caches: loaded from the DB in %s", time.Since(start))
+	return nil
+}
+
+// restoreSnapshot sets the caches from the snapshot, returns false if the snapshot is missing or stale
+func restoreSnapshot(path string, maxEventLen int64) (bool, error) {
+	s, err := snapshot.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	changedAt, err := changeMarker.ChangedAt()
+	if err != nil {
+		return false, err
+	}
+	if !s.CreatedAt.After(changedAt) {
+		log.Printf("snapshot: %s is older than the change of the DB at %s", path, changedAt.Format(time.RFC3339))
+		return false, nil
+	}
+
+	sheets, err := repos.Sheets.List()
+	if err != nil {
+		return false, err
+	}
+	if err := myCache.SetNonCanceledReservations(s.Reservations, maxEventLen); err != nil {
+		return false, err
+	}
+	goCache.Set("sheetsSlice", sheets, cache.DefaultExpiration)
+	free := map[int64]map[int64]bool{}
+	for eventID, sheetIDs := range s.FreeSheets {
+		free[eventID] = map[int64]bool{}
+		for _, id := range sheetIDs {
+			free[eventID][id] = true
+		}
+	}
+	setRandomSheetMap(sheets, maxEventLen, func(eventID, sheetID int64) bool {
+		// スナップショットにないイベントは予約がない
+		return free[eventID] == nil || free[eventID][sheetID]
+	})
+	canceledRMX.Lock()
+	canceledReservations = s.Canceled
+	canceledRMX.Unlock()
+	advanceReservationUUID([]*Reservation{{ID: s.ReservationUUID}})
+
+	// 終了時にまた書くので、読み込んだものは消す。異常終了した後に古いスナップショットを読まないように
+	if err := os.Remove(path); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// advanceReservationUUID makes the next reservation ID larger than the stored ones, for the data kept across restarts
+func advanceReservationUUID(reservations []*Reservation) {
+	for _, r := range reservations {
+		for {
+			current := atomic.LoadInt64(&reservationUUID)
+			if r.ID <= current || atomic.CompareAndSwapInt64(&reservationUUID, current, r.ID) {
+				break
 			}
 		}
-		goCache.Set("randomSheetMap", data, cache.DefaultExpiration)
 	}
 }
 
 func loginRequired(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		if _, err := getLoginUser(c); err != nil {
-			return resError(c, "login_required", 401)
+			if errors.Is(err, apperr.ErrAccountDeactivated) {
+				return err
+			}
+			return apperr.ErrLoginRequired
 		}
 		return next(c)
 	}
@@ -149,92 +275,408 @@ func loginRequired(next echo.HandlerFunc) echo.HandlerFunc {
 func adminLoginRequired(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		if _, err := getLoginAdministrator(c); err != nil {
-			return resError(c, "admin_login_required", 401)
+			return apperr.ErrAdminLoginRequired
+		}
+		return next(c)
+	}
+}
+
+// clientIP returns the socket address of the client, or the address forwarded by a trusted proxy.
+// c.RealIP() trusts X-Forwarded-For from anyone, so it is not used for the limits.
+func clientIP(c echo.Context) string {
+	return clientIPs.IP(c.Request())
+}
+
+// adminSessionRequired rejects the API tokens, used after adminLoginRequired for the account management
+// (tokens, TOTP, logout) so that a leaked token cannot issue tokens or take over the account whatever its scopes
+func adminSessionRequired(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if token, _ := requestToken(c); token != nil {
+			return apperr.ErrSessionRequired
 		}
 		return next(c)
 	}
 }
 
+// loginWait returns how long the client must wait before trying to login to the account
+func loginWait(c echo.Context, accountKey string) time.Duration {
+	wait := accountLimiter.Wait(accountKey)
+	if w := ipLimiter.Wait("ip:" + clientIP(c)); w > wait {
+		wait = w
+	}
+	return wait
+}
+
+func resLoginFailed(c echo.Context, accountKey string) error {
+	accountLimiter.Fail(accountKey)
+	ipLimiter.Fail("ip:" + clientIP(c))
+	return apperr.ErrAuthenticationFailed
+}
+
+// loginSucceeded forgets the failures of the account and the client IP
+func loginSucceeded(c echo.Context, accountKey string) {
+	accountLimiter.Reset(accountKey)
+	ipLimiter.Reset("ip:" + clientIP(c))
+}
+
+func resTooManyAttempts(c echo.Context, wait time.Duration) error {
+	c.Response().Header().Set("Retry-After", strconv.FormatInt(int64((wait+time.Second-1)/time.Second), 10))
+	return apperr.ErrTooManyAttempts
+}
+
+func adminPermissionRequired(p rbac.Permission) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			administrator, err := getLoginAdministrator(c)
+			if err != nil {
+				return apperr.ErrAdminLoginRequired
+			}
+			if !rbac.Allowed(administrator.Roles, p) {
+				return apperr.ErrForbidden
+			}
+			// トークンの場合はロールとスコープの両方で許可されている必要がある
+			if token, _ := requestToken(c); token != nil && !token.HasScope(string(p)) {
+				return apperr.ErrForbidden
+			}
+			c.Set("administrator", administrator)
+			return next(c)
+		}
+	}
+}
+
+// audited records the admin call into the audit log with the target and states set by the handler
+func audited(action string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			var body []byte
+			if c.Request().Body != nil {
+				body, _ = ioutil.ReadAll(c.Request().Body)
+				c.Request().Body = ioutil.NopCloser(bytes.NewReader(body))
+			}
+			// ログアウトは処理後にセッションから消えるので先に取っておく
+			administratorID := sessManager.AdministratorID(c)
+
+			err := next(c)
+
+			if administrator, ok := c.Get("administrator").(*Administrator); ok {
+				administratorID = administrator.ID
+			} else if id := sessManager.AdministratorID(c); id != 0 {
+				administratorID = id
+			}
+			status := c.Response().Status
+			if err != nil {
+				status = apperr.From(err).Status
+			}
+			entry := &audit.Entry{
+				AdministratorID: administratorID,
+				Action:          action,
+				Target:          audit.Target(c),
+				Method:          c.Request().Method,
+				Path:            c.Request().URL.Path,
+				Status:          status,
+				IP:              clientIP(c),
+				Params:          audit.Params(c, body),
+				Before:          audit.Before(c),
+				After:           audit.After(c),
+				CreatedAt:       time.Now(),
+			}
+			if err := auditLogger.Record(entry); err != nil {
+				log.Printf("audit: %v", err)
+			}
+			return err
+		}
+	}
+}
+
+// auditEvent returns the event state recorded in the audit log
+func auditEvent(e *Event) echo.Map {
+	return echo.Map{
+		"id":     e.ID,
+		"title":  e.Title,
+		"public": e.PublicFg,
+		"closed": e.ClosedFg,
+		"price":  e.Price,
+	}
+}
+
+// parseQueryTime parses RFC3339 or unix seconds, "" is the zero time
+func parseQueryTime(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if sec, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+// idempotent replays the first response to the retried requests with the same Idempotency-Key
+func idempotent(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		key := c.Request().Header.Get("Idempotency-Key")
+		if key == "" {
+			return next(c)
+		}
+		if len(key) > idempotency.MaxKeyLength {
+			return invalidParams(validate.FieldError{Field: "Idempotency-Key", Rule: "max", Param: strconv.Itoa(idempotency.MaxKeyLength)})
+		}
+
+		var body []byte
+		if c.Request().Body != nil {
+			body, _ = ioutil.ReadAll(c.Request().Body)
+			c.Request().Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		// キーはユーザーごと、未ログインのユーザー登録はクライアントのIPごとに分ける
+		scope := "ip:" + clientIP(c)
+		if user, err := getLoginUser(c); err == nil {
+			scope = "user:" + strconv.FormatInt(user.ID, 10)
+		}
+
+		stored, err := idempotencyKeys.Begin(scope, key, idempotency.Fingerprint(c.Request().Method, c.Request().URL.Path, body))
+		switch err {
+		case nil:
+		case idempotency.ErrInProgress:
+			return apperr.ErrIdempotencyKeyInProgress
+		case idempotency.ErrMismatch:
+			return apperr.ErrIdempotencyKeyMismatch
+		default:
+			return err
+		}
+		if stored != nil {
+			c.Response().Header().Set("Idempotent-Replayed", "true")
+			return c.Blob(stored.Status, stored.ContentType, stored.Body)
+		}
+
+		recorder := &responseRecorder{ResponseWriter: c.Response().Writer}
+		c.Response().Writer = recorder
+		if err := next(c); err != nil {
+			// エラーのレスポンスも再送できるようにここで書き出す
+			c.Error(err)
+		}
+		c.Response().Writer = recorder.ResponseWriter
+
+		// サーバ側の失敗や制限はリトライで結果が変わりうるので記録しない
+		status := c.Response().Status
+		if status >= 500 || status == 429 {
+			return idempotencyKeys.Abort(scope, key)
+		}
+		return idempotencyKeys.Complete(scope, key, &idempotency.Response{
+			Status:      status,
+			ContentType: c.Response().Header().Get(echo.HeaderContentType),
+			Body:        recorder.body.Bytes(),
+		})
+	}
+}
+
+// responseRecorder keeps a copy of the response body
+type responseRecorder struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// requestToken returns the API token of "Authorization: Bearer", nil if the header is not given
+func requestToken(c echo.Context) (*apitoken.Token, error) {
+	if token, ok := c.Get("api_token").(*apitoken.Token); ok {
+		return token, nil
+	}
+	auth := c.Request().Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return nil, nil
+	}
+	token, err := apiTokens.Authenticate(strings.TrimSpace(strings.TrimPrefix(auth, "Bearer ")))
+	if err != nil {
+		return nil, err
+	}
+	c.Set("api_token", token)
+	return token, nil
+}
+
+// requestUserID returns the user of the request authenticated so far without reading the users table, 0 if anonymous
+func requestUserID(c echo.Context) int64 {
+	if token, ok := c.Get("api_token").(*apitoken.Token); ok {
+		if token.OwnerType == apitoken.User {
+			return token.OwnerID
+		}
+		return 0
+	}
+	return sessManager.UserID(c)
+}
+
+// readRepos returns the repositories for the reads of the request which tolerate the replication lag.
+// 直前に書き込んだユーザーは自分の書き込みが見えるようにプライマリから読む
+func readRepos(c echo.Context) *repository.Repositories {
+	return router.Reader(requestUserID(c))
+}
+
+// trackWrites records the requests other than GET by the user for readRepos
+func trackWrites(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		err := next(c)
+		switch c.Request().Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			router.Wrote(requestUserID(c))
+		}
+		return err
+	}
+}
+
 func getLoginUser(c echo.Context) (*User, error) {
-	userID := sess.SessUserID(c)
+	// トークンが付いていればセッションより優先する（不正なトークンはセッションにフォールバックしない）
+	token, err := requestToken(c)
+	if err != nil {
+		return nil, err
+	}
+	var userID int64
+	if token != nil {
+		if token.OwnerType != apitoken.User {
+			return nil, errors.New("not a user token")
+		}
+		userID = token.OwnerID
+	} else {
+		userID = sessManager.UserID(c)
+	}
 	if userID == 0 {
 		return nil, errors.New("not logged in")
 	}
-	var user User
-	err := db.QueryRow("SELECT id, nickname FROM users WHERE id = ?", userID).Scan(&user.ID, &user.Nickname)
-	return &user, err
+	user, err := repos.Users.Get(userID)
+	if err != nil {
+		return nil, err
+	}
+	if user.Deactivated {
+		return nil, apperr.ErrAccountDeactivated
+	}
+	return &User{ID: user.ID, Nickname: user.Nickname}, nil
+}
+
+// getOwnUser returns the login user if :id is the user itself
+func getOwnUser(c echo.Context) (*User, error) {
+	user, err := getLoginUser(c)
+	if err != nil {
+		return nil, err
+	}
+	if c.Param("id") != strconv.FormatInt(user.ID, 10) {
+		return nil, nil
+	}
+	return user, nil
+}
+
+// cancelUserReservations cancels the reservations of the user for the events not closed yet.
+// 終了したイベントの予約は売上レポートのためにそのまま残す
+func cancelUserReservations(userID int64) (int, error) {
+	events, err := repos.Events.List()
+	if err != nil {
+		return 0, err
+	}
+	var eventIDs []int64
+	for _, event := range events {
+		if !event.ClosedFg {
+			eventIDs = append(eventIDs, event.ID)
+		}
+	}
+	if len(eventIDs) == 0 {
+		return 0, nil
+	}
+
+	canceled := 0
+	for _, reservation := range myCache.GetReservationsAll(eventIDs) {
+		if reservation.UserID != userID {
+			continue
+		}
+		sheet, err := repos.Sheets.Get(reservation.SheetID)
+		if err != nil {
+			return canceled, err
+		}
+		if err := cancelReservation(*reservation, *sheet); err != nil {
+			return canceled, err
+		}
+		canceled++
+	}
+	return canceled, nil
 }
 
 func getLoginAdministrator(c echo.Context) (*Administrator, error) {
-	administratorID := sess.SessAdministratorID(c)
+	token, err := requestToken(c)
+	if err != nil {
+		return nil, err
+	}
+	var administratorID int64
+	if token != nil {
+		if token.OwnerType != apitoken.Administrator {
+			return nil, errors.New("not an administrator token")
+		}
+		administratorID = token.OwnerID
+	} else {
+		administratorID = sessManager.AdministratorID(c)
+	}
 	if administratorID == 0 {
 		return nil, errors.New("not logged in")
 	}
-	var administrator Administrator
-	err := db.QueryRow("SELECT id, nickname FROM administrators WHERE id = ?", administratorID).Scan(&administrator.ID, &administrator.Nickname)
-	return &administrator, err
-}
-
-func getEvents(all bool) ([]*Event, error) {
-	tx, err := db.Begin()
+	administrator, err := repos.Administrators.Get(administratorID)
 	if err != nil {
 		return nil, err
 	}
-	defer tx.Commit()
+	return &Administrator{ID: administrator.ID, Nickname: administrator.Nickname, Roles: withDefaultRole(administrator.Roles)}, nil
+}
+
+// withDefaultRole returns defaultAdminRole if no role is attached to the administrator
+func withDefaultRole(roles []string) []string {
+	if len(roles) == 0 && defaultAdminRole != "" {
+		return []string{defaultAdminRole}
+	}
+	return roles
+}
+
+func validateRoles(roles []string) bool {
+	for _, role := range roles {
+		if !rbac.ValidRole(role) {
+			return false
+		}
+	}
+	return true
+}
 
-	rows, err := tx.Query("SELECT * FROM events ORDER BY id ASC")
+func getEvents(r *repository.Repositories, all bool) ([]*Event, error) {
+	allEvents, err := r.Events.List()
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
 
 	var events []*Event
-	for rows.Next() {
-		var event Event
-		if err := rows.Scan(&event.ID, &event.Title, &event.PublicFg, &event.ClosedFg, &event.Price); err != nil {
-			return nil, err
-		}
+	for _, event := range allEvents {
 		if !all && !event.PublicFg {
 			continue
 		}
-		events = append(events, &event)
+		events = append(events, event)
+	}
+
+	if len(events) == 0 {
+		return []*Event{}, nil
 	}
 
 	ids := funk.Map(events, func(x *Event) int64 {
 		return x.ID
 	})
-	addedEvents, err := getEventsIn(ids.([]int64), -1)
-
-	return addedEvents, nil
+	return getEventsIn(r, ids.([]int64), -1)
 }
 
-func getEventsIn(eventIDs []int64, loginUserID int64) ([]*Event, error) {
-	var events []*Event
-	inClause := arrayToString(eventIDs, ",")
-
+func getEventsIn(r *repository.Repositories, eventIDs []int64, loginUserID int64) ([]*Event, error) {
 	// EVENTS
-	{
-		sql := fmt.Sprintf("SELECT * FROM events WHERE id IN (%s)", inClause)
-		eventRows, err := db.Query(sql)
-		if err != nil {
-			log.Fatal(err)
-			return nil, err
-		}
-		defer eventRows.Close()
-		for eventRows.Next() {
-			var event Event
-			if err := eventRows.Scan(&event.ID, &event.Title, &event.PublicFg, &event.ClosedFg, &event.Price); err != nil {
-				log.Fatal(err)
-				return nil, err
-			}
-
-			event.Sheets = map[string]*Sheets{
-				"S": &Sheets{},
-				"A": &Sheets{},
-				"B": &Sheets{},
-				"C": &Sheets{},
-			}
-			events = append(events, &event)
+	events, err := r.Events.ListIn(eventIDs)
+	if err != nil {
+		return nil, err
+	}
+	for _, event := range events {
+		event.Sheets = map[string]*Sheets{
+			"S": &Sheets{},
+			"A": &Sheets{},
+			"B": &Sheets{},
+			"C": &Sheets{},
 		}
 	}
 
@@ -266,18 +708,28 @@ func getEventsIn(eventIDs []int64, loginUserID int64) ([]*Event, error) {
 		// bfTime := time.Now()
 		// =========
 
+		// goroutine内でpanicするとサーバごと落ちるので、最初のエラーだけ拾って返す
 		var wg sync.WaitGroup
+		var errMu sync.Mutex
+		var firstErr error
 		wg.Add(len(events))
 		for i := range events {
 			go func(i int) {
 				defer wg.Done()
 				err := addEventInfo(events[i], data[events[i].ID], loginUserID, false)
 				if err != nil {
-					panic(err)
+					errMu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					errMu.Unlock()
 				}
 			}(i)
 		}
 		wg.Wait()
+		if firstErr != nil {
+			return nil, firstErr
+		}
 
 		// =========
 		// afTime := time.Now()
@@ -288,9 +740,9 @@ func getEventsIn(eventIDs []int64, loginUserID int64) ([]*Event, error) {
 	return events, nil
 }
 
-func getEvent(eventID, loginUserID int64) (*Event, error) {
-	var event Event
-	if err := db.QueryRow("SELECT * FROM events WHERE id = ?", eventID).Scan(&event.ID, &event.Title, &event.PublicFg, &event.ClosedFg, &event.Price); err != nil {
+func getEvent(r *repository.Repositories, eventID, loginUserID int64) (*Event, error) {
+	event, err := r.Events.Get(eventID)
+	if err != nil {
 		return nil, err
 	}
 	event.Sheets = map[string]*Sheets{
@@ -305,14 +757,12 @@ func getEvent(eventID, loginUserID int64) (*Event, error) {
 	// ---------------------------------------
 
 	// ----- シートを走査 ----------------------
-	err := addEventInfo(&event, reservations, loginUserID, true)
-	if err != nil {
-		log.Fatal(err)
+	if err := addEventInfo(event, reservations, loginUserID, true); err != nil {
 		return nil, err
 	}
 	// ---------------------------------------
 
-	return &event, nil
+	return event, nil
 }
 
 func addEventInfo(event *Event, reservations []*Reservation, loginUserID int64, useDetail bool) error {
@@ -395,19 +845,46 @@ func tryInsertReservation(user *User, event *Event, rank string) (int64, Sheet,
 
 	atomic.AddInt64(&reservationUUID, 1)
 	reservationID = atomic.LoadInt64(&reservationUUID)
-	utcTime := time.Now().UTC()
-	reservation := Reservation{ID: reservationID, EventID: event.ID, SheetID: sheet.ID, UserID: user.ID, ReservedAt: &utcTime, ReservedAtUnix: utcTime.Unix()}
+	reservation := Reservation{ID: reservationID, EventID: event.ID, SheetID: sheet.ID, UserID: user.ID}
+	reservation.SetReservedAt(time.Now().UTC())
 
-	myCache.HashSet(event.ID, reservationID, &reservation)
+	if err := myCache.HashSet(event.ID, reservationID, &reservation); err != nil {
+		sheetMap[event.ID][rank].Add(sheet)
+		return 0, Sheet{}, err
+	}
 
-	_, err := db.Exec("INSERT INTO reservations (id, event_id, sheet_id, user_id, reserved_at) VALUES (?, ?, ?, ?, ?)", reservationID, event.ID, sheet.ID, user.ID, utcTime.Format("2006-01-02 15:04:05.000000"))
-	if err != nil {
+	if err := repos.Reservations.Insert(&reservation); err != nil {
 		return 0, Sheet{}, err
 	}
 
 	return reservationID, sheet, nil
 }
 
+/**
+ * UPDATE reservations SET canceled_at
+ */
+func cancelReservation(reservation Reservation, sheet Sheet) error {
+	// update cache before commit DB
+	{
+		// append to non-reserved sheets cache
+		x, _ := goCache.Get("randomSheetMap")
+		sheetMap := x.(map[int64]map[string]*fifo.Queue)
+		sheetMap[reservation.EventID][sheet.Rank].Add(sheet)
+
+		// delete notCanceledReservations cache
+		myCache.HashDelete(reservation.EventID, reservation.ID)
+
+		// sales用なので多少遅れても良さそう
+		// append to canceledReservations cache
+		reservation.SetCanceledAt(time.Now().UTC())
+		canceledRMX.Lock()
+		canceledReservations = append(canceledReservations, &reservation)
+		canceledRMX.Unlock()
+	}
+
+	return repos.Reservations.Cancel(reservation.ID, *reservation.CanceledAt)
+}
+
 func sanitizeEvent(e *Event) *Event {
 	sanitized := *e
 	sanitized.Price = 0
@@ -435,8 +912,7 @@ func fillinAdministrator(next echo.HandlerFunc) echo.HandlerFunc {
 }
 
 func validateRank(rank string) bool {
-	var count int
-	db.QueryRow("SELECT COUNT(*) FROM sheets WHERE `rank` = ?", rank).Scan(&count)
+	count, _ := repos.Sheets.CountByRank(rank)
 	return count > 0
 }
 
@@ -449,71 +925,333 @@ func (r *Renderer) Render(w io.Writer, name string, data interface{}, c echo.Con
 }
 
 var db *sql.DB
+var dbDialect dialect.Dialect
 var goCache *cache.Cache
+var sessManager *sess.Manager
+var accountLimiter *loginlimit.Limiter
+var defaultAdminRole string
+var auditLogger *audit.Logger
+var repos *repository.Repositories
+var apiTokens *apitoken.Store
+var idempotencyKeys *idempotency.Store
+var totpStore *totp.Store
+var totpIssuer string
+var ipLimiter *loginlimit.Limiter
+var clientIPs *clientip.Resolver
 var canceledRMX *sync.Mutex
 var json = jsoniter.ConfigCompatibleWithStandardLibrary
 
+var reportArchive *report.Archive
+var changeMarker *snapshot.Marker
+var replicaDBs []*sql.DB
+var router *repository.Router
+
+// initializeTables are emptied by /initialize, then initializeFixtures are loaded.
+// 監査ログは消さない
+var initializeTables = []string{
+	"reservations", "events", "sheets", "users", "administrators",
+	"user_deactivations", "administrator_roles", "api_tokens",
+	"administrator_totp", "administrator_recovery_codes", "idempotency_keys",
+}
+var initializeFixtures fs.FS
 var reservationUUID int64 = 10000000
 var ErrCantAcquireLock = errors.New("cant acquire lock")
 
 // cache
 var canceledReservations []*Reservation
 
-func main() {
+// openDB opens db by cfg.Driver.
+// sqlite3 ならDBサーバーなしで cfg.Database のファイルを使う（ローカル開発・CI用）
+func openDB(cfg config.DB) error {
+	dbDialect = cfg.Driver
 	var err error
-	// log.SetFlags(log.Lshortfile)
+	db, err = connectDB(cfg, cfg.Host, cfg.Port)
+	return err
+}
 
-	{
-		err := godotenv.Load("../env.sh")
+// openReplicas opens replicaDBs by cfg.ReplicaHosts
+func openReplicas(cfg config.DB) error {
+	for _, hostPort := range cfg.ReplicaHosts {
+		host, port, err := net.SplitHostPort(hostPort)
+		if err != nil {
+			return err
+		}
+		replica, err := connectDB(cfg, host, port)
 		if err != nil {
-			log.Fatal("Error loading .env file")
+			return fmt.Errorf("replica %s: %w", hostPort, err)
 		}
+		replicaDBs = append(replicaDBs, replica)
 	}
+	return nil
+}
 
-	// pprof用
-	go func() {
-		log.Println(http.ListenAndServe("0.0.0.0:6060", nil))
-	}()
-
-	{
-		dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true&charset=utf8mb4",
-			os.Getenv("DB_USER"), os.Getenv("DB_PASS"),
-			os.Getenv("DB_HOST"), os.Getenv("DB_PORT"),
-			os.Getenv("DB_DATABASE"),
+// connectDB opens the database at host:port (ignored by SQLite) and waits until it answers
+func connectDB(cfg config.DB, host, port string) (*sql.DB, error) {
+	var dsn string
+	switch cfg.Driver {
+	case dialect.SQLite:
+		dsn = fmt.Sprintf("file:%s?_loc=UTC&_busy_timeout=5000", cfg.Database)
+	default:
+		// DBの DATETIME(6) はUTCとして読み書きする
+		dsn = fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true&loc=UTC&charset=utf8mb4",
+			cfg.User, cfg.Password,
+			host, port,
+			cfg.Database,
 		)
-		// log.Printf("DSN IS %s", dsn)
-		db, err = sql.Open("mysql", dsn)
-		if err != nil {
-			log.Fatal(err)
-		}
 	}
+	// log.Printf("DSN IS %s", dsn)
+	db, err := sql.Open(string(cfg.Driver), dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	if cfg.Driver == dialect.SQLite {
+		// SQLiteは書き込みが1つずつなので、接続を1本にして database is locked を避ける
+		db.SetMaxOpenConns(1)
+	}
+	// SetMaxIdleConns(0) はアイドル接続を持たない設定なので、0 のときは database/sql のデフォルト（2）のまま
+	if cfg.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(cfg.MaxIdleConns)
+	}
+	db.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(cfg.ConnMaxIdleTime)
 
-	// go-cache
-	{
-		goCache = cache.New(60*time.Minute, 120*time.Minute)
-		cacheSheets()
+	if err := waitForDB(db, cfg.ConnectTimeout); err != nil {
+		db.Close()
+		return nil, err
 	}
+	return db, nil
+}
 
-	// mutex
-	canceledRMX = new(sync.Mutex)
+// waitForDB pings db until it answers, backing off from 100ms to 5s, and gives up after timeout
+func waitForDB(db *sql.DB, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
-	e := echo.New()
-	funcs := template.FuncMap{
-		"encode_json": func(v interface{}) string {
-			b, _ := json.Marshal(v)
-			return string(b)
-		},
+	backoff := 100 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err := db.PingContext(ctx)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("database is not ready in %s: %v", timeout, err)
+		}
+		log.Printf("ping database (attempt %d): %v, retrying in %s", attempt, err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return fmt.Errorf("database is not ready in %s: %v", timeout, err)
+		}
+		if backoff *= 2; backoff > 5*time.Second {
+			backoff = 5 * time.Second
+		}
+	}
+}
+
+func main() {
+	var err error
+	// log.SetFlags(log.Lshortfile)
+
+	// 設定はフラグ > 環境変数 > 設定ファイル（../env.sh） > デフォルトの順。起動時に全て検証する
+	cfg, args, err := config.Load(os.Args[1:])
+	if err == flag.ErrHelp {
+		fmt.Fprintln(os.Stderr, commandUsage)
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := openDB(cfg.DB); err != nil {
+		log.Fatal(err)
+	}
+
+	// サブコマンド（migrate など）はサーバーを起動せずに終了する
+	if len(args) > 0 {
+		os.Exit(runCommand(cfg, args))
+	}
+
+	// 読み取り専用のレプリカ（DB_REPLICA_HOSTS）
+	if err := openReplicas(cfg.DB); err != nil {
+		log.Fatal(err)
+	}
+
+	// pprof用。DBの接続プールの統計（/metrics）とヘルスチェック（/healthz）も同じアドレスで返す
+	{
+		dbs := map[string]*sql.DB{"primary": db}
+		for i, replica := range replicaDBs {
+			dbs[fmt.Sprintf("replica%d", i+1)] = replica
+		}
+		http.Handle("/metrics", metrics.DBStatsHandler(dbs))
+		http.Handle("/healthz", metrics.HealthHandler(dbs, time.Second))
+	}
+	pprofServer := &http.Server{Addr: cfg.PprofListen}
+	if cfg.PprofListen != "" {
+		go func() {
+			if err := pprofServer.ListenAndServe(); err != http.ErrServerClosed {
+				log.Println(err)
+			}
+		}()
+	}
+
+	// レポートの sold_at / canceled_at を描画するタイムゾーン（デフォルトUTC）
+	ReportLocation = cfg.ReportLocation
+
+	if repos, err = repository.New(db, dbDialect); err != nil {
+		log.Fatal(err)
+	}
+	// 書き込みと自分の書き込みを読むリクエストはプライマリ、遅れてもよい読み込みはレプリカに振り分ける
+	{
+		var replicas []*repository.Repositories
+		for _, replica := range replicaDBs {
+			replicas = append(replicas, repository.NewReadOnly(replica, dbDialect))
+		}
+		router = repository.NewRouter(repos, replicas, cfg.DB.ReplicaMaxLag)
+	}
+
+	// /initialize で読み込むデータ。ベンチマークの初期化で初めて気づくことのないよう、未設定なら起動しない
+	switch dir := cfg.InitializeFixturesDir; dir {
+	case "":
+		log.Fatal("INITIALIZE_FIXTURES_DIR is not set: set the directory of the initial dataset (isucon8q-initial-dataset.sql.gz or the output of `torb seed -out`), or \"embedded\" for the sheets and admin only")
+	case config.EmbeddedFixtures:
+		initializeFixtures = fixture.Embedded()
+	default:
+		initializeFixtures = os.DirFS(dir)
+	}
+
+	// クライアントのアドレス。X-Forwarded-For は TRUSTED_PROXIES からのものだけ信頼する
+	clientIPs = clientip.New(cfg.TrustedProxies)
+
+	// session（署名・暗号鍵とcookie、保存先の設定は SESSION_* で指定）
+	{
+		var store sess.Store
+		switch cfg.Session.Store {
+		case "mysql":
+			if store, err = sess.NewMySQLStore(db); err != nil {
+				log.Fatal(err)
+			}
+		case "redis":
+			store = sess.NewRedisStore(redis.NewClient(&redis.Options{Addr: cfg.Session.RedisAddr}))
+		default:
+			store = sess.NewMemoryStore()
+		}
+
+		if sessManager, err = sess.New(cfg.Session, store, clientIPs); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// 管理者の権限。ロールが1つもない管理者は ADMIN_DEFAULT_ROLE として扱う（デフォルトは空で、何の権限もない）
+	defaultAdminRole = cfg.AdminDefaultRole
+
+	// 管理操作の監査ログ
+	if auditLogger, err = audit.New(db, dbDialect); err != nil {
+		log.Fatal(err)
+	}
+
+	// 管理者の2段階認証（TOTP）
+	{
+		if totpStore, err = totp.NewStore(db, dbDialect); err != nil {
+			log.Fatal(err)
+		}
+		totpIssuer = cfg.TOTPIssuer
+	}
+
+	// 機械向けのAPIトークン
+	if apiTokens, err = apitoken.New(db, dbDialect); err != nil {
+		log.Fatal(err)
+	}
+
+	// Idempotency-Key の最初のレスポンスを IDEMPOTENCY_TTL（デフォルト24時間）の間再送する
+	if idempotencyKeys, err = idempotency.New(db, dbDialect, cfg.IdempotencyTTL); err != nil {
+		log.Fatal(err)
+	}
+
+	// ログイン試行の制限。失敗ごとに待ち時間を倍にし、続けて失敗したらロックアウトする
+	accountLimiter = loginlimit.New(loginlimit.Config{MaxFailures: cfg.LoginMaxFailures, BaseDelay: time.Second, MaxDelay: time.Minute, Lockout: cfg.LoginLockout})
+	// IPはNATやベンチマーカーで共有されるので、待ち時間を入れずに LOGIN_IP_MAX_FAILURES 回でロックアウトだけする
+	ipLimiter = loginlimit.New(loginlimit.Config{MaxFailures: cfg.LoginIPMaxFailures, Lockout: cfg.LoginLockout})
+
+	// mutex
+	canceledRMX = new(sync.Mutex)
+
+	// go-cache と予約のキャッシュ。SNAPSHOT_PATH のスナップショットがDBより新しければそれを読み込む
+	{
+		if changeMarker, err = snapshot.NewMarker(db, dbDialect); err != nil {
+			log.Fatal(err)
+		}
+		goCache = cache.New(cfg.CacheExpiration, cfg.CacheCleanupInterval)
+		if err := loadCaches(cfg); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// 売上レポートの定期保存。REPORT_SCHEDULE が空なら保存しない（archive一覧は見られる）
+	// 終了時は stopReport を閉じ、保存中のレポートは reportDone が閉じるまで待つ
+	stopReport := make(chan struct{})
+	reportDone := make(chan struct{})
+	{
+		if reportArchive, err = report.NewArchive(cfg.ReportArchiveDir, cfg.ReportRetention); err != nil {
+			log.Fatal(err)
+		}
+
+		if cfg.ReportSchedule != nil {
+			go func() {
+				defer close(reportDone)
+				report.Run(cfg.ReportSchedule, stopReport, func(now time.Time) {
+					if err := archiveReports(now); err != nil {
+						log.Printf("archive reports: %v", err)
+					}
+				})
+			}()
+		} else {
+			close(reportDone)
+		}
+	}
+
+	e := echo.New()
+	funcs := template.FuncMap{
+		"encode_json": func(v interface{}) string {
+			b, _ := json.Marshal(v)
+			return string(b)
+		},
 	}
 	e.Renderer = &Renderer{
 		templates: template.Must(template.New("").Delims("[[", "]]").Funcs(funcs).ParseGlob("views/*.tmpl")),
 	}
-	e.Use(session.Middleware(sessions.NewCookieStore([]byte("secret"))))
+	routes(e, cfg)
+
+	// SIGINT / SIGTERM を受けたら新しいリクエストを止め、処理中のリクエストを SHUTDOWN_TIMEOUT（デフォルト10秒）まで待つ
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		if err := e.Start(cfg.Listen); err != nil && err != http.ErrServerClosed {
+			e.Logger.Fatal(err)
+		}
+	}()
+	<-ctx.Done()
+	stop()
+	log.Printf("shutting down (timeout %s)", cfg.ShutdownTimeout)
+
+	if err := shutdown(cfg, e, pprofServer, stopReport, reportDone); err != nil {
+		log.Printf("shutdown: %v", err)
+		os.Exit(1)
+	}
+	log.Printf("shutdown complete")
+}
+
+// routes registers the middlewares and the handlers on e
+func routes(e *echo.Echo, cfg *config.Config) {
+	e.HTTPErrorHandler = httpErrorHandler
+	e.Use(recoverPanic)
+	e.Use(sessManager.Middleware())
+	e.Use(trackWrites)
 	// e.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{
 	// 	Format: "method=${method}, uri=${uri}, status=${status}, latency_human=${latency_human}\n",
 	// 	Output: os.Stderr,
 	// }))
 	e.GET("/", func(c echo.Context) error {
-		events, err := getEvents(false)
+		events, err := getEvents(readRepos(c), false)
 		if err != nil {
 			return err
 		}
@@ -527,95 +1265,109 @@ func main() {
 		})
 	}, fillinUser)
 	e.GET("/initialize", func(c echo.Context) error {
-		// db reset
-		cmd := exec.Command("../../db/init.sh")
-		cmd.Stdin = os.Stdin
-		cmd.Stdout = os.Stdout
-		err := cmd.Run()
-		if err != nil {
+		// フェーズごとの所要時間は Server-Timing ヘッダと、JSONを求められればボディで返す
+		type phaseTiming struct {
+			Name       string  `json:"name"`
+			DurationMs float64 `json:"duration_ms"`
+		}
+		var timings []string
+		phases := []phaseTiming{}
+		phase := func(name string, f func() error) error {
+			start := time.Now()
+			if err := f(); err != nil {
+				return fmt.Errorf("initialize %s: %w", name, err)
+			}
+			ms := float64(time.Since(start).Microseconds()) / 1000
+			timings = append(timings, fmt.Sprintf("%s;dur=%.1f", name, ms))
+			phases = append(phases, phaseTiming{Name: name, DurationMs: ms})
 			return nil
 		}
 
+		// db reset
+		if err := phase("truncate", func() error {
+			return fixture.Truncate(db, dbDialect, initializeTables...)
+		}); err != nil {
+			return err
+		}
+		if err := phase("fixtures", func() error {
+			if err := fixture.Load(db, initializeFixtures); err != nil {
+				return err
+			}
+			// 元のデータセットの管理者にはロールがないので superadmin を付ける
+			if _, err := repos.Administrators.GrantRoleless(rbac.Superadmin); err != nil {
+				return err
+			}
+			return changeMarker.Touch()
+		}); err != nil {
+			return err
+		}
+
 		// go-cache reset
-		{
+		if err := phase("sheets", func() error {
 			goCache.Flush()
-			cacheSheets()
+			return cacheSheets(cfg.MaxEventLen)
+		}); err != nil {
+			return err
 		}
 
 		// cache non-canceled reservations
-		{
-			myCache.InitNonCanceledReservations(db)
+		if err := phase("reservations", func() error {
+			return myCache.InitNonCanceledReservations(repos.Reservations, cfg.MaxEventLen)
+		}); err != nil {
+			return err
 		}
 
 		// cache canceled reservations
-		{
-			canceledReservations = nil
-
-			rows, err := db.Query("select id, event_id, user_id, sheet_id, reserved_at, canceled_at from reservations where canceled_at is not null")
-			if err != nil {
-				return err
-			}
-			defer rows.Close()
-
-			var reservations []*Reservation
-			for rows.Next() {
-				var reservation Reservation
-				if err := rows.Scan(&reservation.ID, &reservation.EventID, &reservation.UserID, &reservation.SheetID, &reservation.ReservedAt, &reservation.CanceledAt); err != nil {
-					return err
-				}
-				reservation.ReservedAtUnix = reservation.ReservedAt.Unix()
-				reservation.CanceledAtUnix = reservation.CanceledAt.Unix()
-				reservations = append(reservations, &reservation)
-			}
-			canceledReservations = append(canceledReservations, reservations...)
+		if err := phase("canceled", cacheCanceledReservations); err != nil {
+			return err
 		}
 
+		log.Printf("initialize: %s", strings.Join(timings, ", "))
+		c.Response().Header().Set("Server-Timing", strings.Join(timings, ", "))
+		// これまでどおり 204 を返し、ボディは JSON を求められた場合だけ返す
+		if strings.Contains(c.Request().Header.Get(echo.HeaderAccept), echo.MIMEApplicationJSON) {
+			return c.JSON(200, echo.Map{"phases": phases})
+		}
 		return c.NoContent(204)
 	})
+
 	e.POST("/api/users", func(c echo.Context) error {
 		var params struct {
-			Nickname  string `json:"nickname"`
-			LoginName string `json:"login_name"`
-			Password  string `json:"password"`
+			Nickname  string `json:"nickname" validate:"required,max=128"`
+			LoginName string `json:"login_name" validate:"required,max=128"`
+			Password  string `json:"password" validate:"required,maxbytes=72"`
+		}
+		if errs := bindParams(c, &params); errs != nil {
+			return invalidParams(errs...)
 		}
-		c.Bind(&params)
 
-		tx, err := db.Begin()
+		passHash, err := password.Hash(params.Password)
 		if err != nil {
 			return err
 		}
 
-		var user User
-		if err := tx.QueryRow("SELECT * FROM users WHERE login_name = ?", params.LoginName).Scan(&user.ID, &user.LoginName, &user.Nickname, &user.PassHash); err != sql.ErrNoRows {
-			tx.Rollback()
-			if err == nil {
-				return resError(c, "duplicated", 409)
+		user := &User{LoginName: params.LoginName, Nickname: params.Nickname, PassHash: passHash}
+		if err := repos.Users.Create(user); err != nil {
+			if err == repository.ErrDuplicated {
+				return apperr.ErrDuplicated
 			}
 			return err
 		}
 
-		res, err := tx.Exec("INSERT INTO users (login_name, pass_hash, nickname) VALUES (?, SHA2(?, 256), ?)", params.LoginName, params.Password, params.Nickname)
-		if err != nil {
-			tx.Rollback()
-			return resError(c, "", 0)
-		}
-		userID, err := res.LastInsertId()
-		if err != nil {
-			tx.Rollback()
-			return resError(c, "", 0)
-		}
-		if err := tx.Commit(); err != nil {
-			return err
-		}
-
 		return c.JSON(201, echo.Map{
-			"id":       userID,
+			"id":       user.ID,
 			"nickname": params.Nickname,
 		})
-	})
+	}, idempotent)
 	e.GET("/api/users/:id", func(c echo.Context) error {
-		var user User
-		if err := db.QueryRow("SELECT id, nickname FROM users WHERE id = ?", c.Param("id")).Scan(&user.ID, &user.Nickname); err != nil {
+		userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return apperr.ErrNotFound
+		}
+		// 自分の予約の直後はプライマリ、それ以外はレプリカから読む
+		r := readRepos(c)
+		user, err := r.Users.Get(userID)
+		if err != nil {
 			return err
 		}
 
@@ -624,41 +1376,21 @@ func main() {
 			return err
 		}
 		if user.ID != loginUser.ID {
-			return resError(c, "forbidden", 403)
+			return apperr.ErrForbidden
 		}
 
-		rows, err := db.Query("SELECT r.*, s.rank AS sheet_rank, s.num AS sheet_num FROM reservations r INNER JOIN sheets s ON s.id = r.sheet_id WHERE r.user_id = ? ORDER BY IFNULL(r.canceled_at, r.reserved_at) DESC LIMIT 5", user.ID)
+		recentReservations, err := r.Reservations.RecentByUser(user.ID, 5)
 		if err != nil {
 			return err
 		}
-		defer rows.Close()
-
-		var recentReservations []Reservation
-		for rows.Next() {
-			var reservation Reservation
-			var sheet Sheet
-			if err := rows.Scan(&reservation.ID, &reservation.EventID, &reservation.SheetID, &reservation.UserID, &reservation.ReservedAt, &reservation.CanceledAt, &sheet.Rank, &sheet.Num); err != nil {
-				return err
-			}
-			reservation.SheetRank = sheet.Rank
-			reservation.SheetNum = sheet.Num
-			reservation.ReservedAtUnix = reservation.ReservedAt.Unix()
-			if reservation.CanceledAt != nil {
-				reservation.CanceledAtUnix = reservation.CanceledAt.Unix()
-			}
-			recentReservations = append(recentReservations, reservation)
-		}
 
-		if recentReservations == nil {
-			recentReservations = make([]Reservation, 0)
-		} else {
+		if len(recentReservations) > 0 {
 			// eventまとめてfetch
 			eventIDs := funk.Map(recentReservations, func(x Reservation) int64 {
 				return x.EventID
 			})
-			events, err := getEventsIn(eventIDs.([]int64), -1)
+			events, err := getEventsIn(r, eventIDs.([]int64), -1)
 			if err != nil {
-				log.Fatal(err)
 				return err
 			}
 
@@ -681,32 +1413,21 @@ func main() {
 			}
 		}
 
-		var totalPrice int
-		if err := db.QueryRow("SELECT IFNULL(SUM(e.price + s.price), 0) FROM reservations r INNER JOIN sheets s ON s.id = r.sheet_id INNER JOIN events e ON e.id = r.event_id WHERE r.user_id = ? AND r.canceled_at IS NULL", user.ID).Scan(&totalPrice); err != nil {
+		totalPrice, err := r.Reservations.TotalPriceByUser(user.ID)
+		if err != nil {
 			return err
 		}
 
-		rows, err = db.Query("SELECT event_id FROM reservations WHERE user_id = ? GROUP BY event_id ORDER BY MAX(IFNULL(canceled_at, reserved_at)) DESC LIMIT 5", user.ID)
+		eventIDs, err := r.Reservations.RecentEventIDsByUser(user.ID, 5)
 		if err != nil {
 			return err
 		}
-		defer rows.Close()
-
-		var eventIDs []int64
-		for rows.Next() {
-			var eventID int64
-			if err := rows.Scan(&eventID); err != nil {
-				return err
-			}
-			eventIDs = append(eventIDs, eventID)
-		}
 
 		// fetch events information
 		var recentEvents []*Event
 		if len(eventIDs) > 0 {
-			recentEvents, err = getEventsIn(eventIDs, -1)
+			recentEvents, err = getEventsIn(r, eventIDs, -1)
 			if err != nil {
-				log.Fatal(err)
 				return err
 			}
 		}
@@ -728,166 +1449,362 @@ func main() {
 			"recent_events":       recentEvents,
 		})
 	}, loginRequired)
-	e.POST("/api/actions/login", func(c echo.Context) error {
+	e.POST("/api/users/:id/actions/edit", func(c echo.Context) error {
 		var params struct {
-			LoginName string `json:"login_name"`
-			Password  string `json:"password"`
+			Nickname string `json:"nickname" validate:"required,max=128"`
 		}
-		c.Bind(&params)
-
-		user := new(User)
-		if err := db.QueryRow("SELECT * FROM users WHERE login_name = ?", params.LoginName).Scan(&user.ID, &user.LoginName, &user.Nickname, &user.PassHash); err != nil {
-			if err == sql.ErrNoRows {
-				return resError(c, "authentication_failed", 401)
-			}
-			return err
+		if errs := bindParams(c, &params); errs != nil {
+			return invalidParams(errs...)
 		}
 
-		var passHash string
-		if err := db.QueryRow("SELECT SHA2(?, 256)", params.Password).Scan(&passHash); err != nil {
+		user, err := getOwnUser(c)
+		if err != nil {
 			return err
 		}
-		if user.PassHash != passHash {
-			return resError(c, "authentication_failed", 401)
+		if user == nil {
+			return apperr.ErrForbidden
 		}
 
-		sess.SessSetUserID(c, user.ID)
-		user, err = getLoginUser(c)
-		if err != nil {
+		if err := repos.Users.UpdateNickname(user.ID, params.Nickname); err != nil {
 			return err
 		}
+		user.Nickname = params.Nickname
 		return c.JSON(200, user)
-	})
-	e.POST("/api/actions/logout", func(c echo.Context) error {
-		sess.SessDeleteUserID(c)
-		return c.NoContent(204)
 	}, loginRequired)
-	e.GET("/api/events", func(c echo.Context) error {
-		events, err := getEvents(true)
-		if err != nil {
-			return err
+	e.POST("/api/users/:id/actions/change_password", func(c echo.Context) error {
+		var params struct {
+			CurrentPassword string `json:"current_password" validate:"required"`
+			NewPassword     string `json:"new_password" validate:"required,maxbytes=72"`
 		}
-		for i, v := range events {
-			events[i] = sanitizeEvent(v)
+		if errs := bindParams(c, &params); errs != nil {
+			return invalidParams(errs...)
 		}
-		return c.JSON(200, events)
-	})
-	e.GET("/api/events/:id", func(c echo.Context) error {
-		eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+
+		user, err := getOwnUser(c)
 		if err != nil {
-			return resError(c, "not_found", 404)
+			return err
 		}
-
-		loginUserID := int64(-1)
-		if user, err := getLoginUser(c); err == nil {
-			loginUserID = user.ID
+		if user == nil {
+			return apperr.ErrForbidden
 		}
 
-		event, err := getEvent(eventID, loginUserID)
+		passHash, err := repos.Users.PassHash(user.ID)
 		if err != nil {
-			if err == sql.ErrNoRows {
-				return resError(c, "not_found", 404)
-			}
 			return err
-		} else if !event.PublicFg {
-			return resError(c, "not_found", 404)
 		}
-		return c.JSON(200, sanitizeEvent(event))
-	})
+		if ok, _ := password.Verify(passHash, params.CurrentPassword); !ok {
+			return apperr.ErrAuthenticationFailed
+		}
+		if passHash, err = password.Hash(params.NewPassword); err != nil {
+			return err
+		}
+		if err := repos.Users.UpdatePassHash(user.ID, passHash); err != nil {
+			return err
+		}
 
-	// TODO: tuning
-	e.POST("/api/events/:id/actions/reserve", func(c echo.Context) error {
-		eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
-		if err != nil {
-			return resError(c, "not_found", 404)
+		// 他の端末のセッションとAPIトークンは無効にし、このセッションだけ新しいIDで残す
+		if err := sessManager.RevokeUserSessions(user.ID); err != nil {
+			return err
+		}
+		if err := apiTokens.RevokeAll(apitoken.User, user.ID); err != nil {
+			return err
+		}
+		if token, _ := requestToken(c); token == nil {
+			if err := sessManager.SetUserID(c, user.ID); err != nil {
+				return err
+			}
 		}
+		return c.NoContent(204)
+	}, loginRequired)
+	e.POST("/api/users/:id/actions/deactivate", func(c echo.Context) error {
 		var params struct {
-			Rank string `json:"sheet_rank"`
+			Password string `json:"password" validate:"required"`
+		}
+		if errs := bindParams(c, &params); errs != nil {
+			return invalidParams(errs...)
 		}
-		c.Bind(&params)
 
-		user, err := getLoginUser(c)
+		user, err := getOwnUser(c)
 		if err != nil {
 			return err
 		}
+		if user == nil {
+			return apperr.ErrForbidden
+		}
 
-		// =========
-		// bfTime := time.Now()
-		// =========
-
-		event, err := getEvent(eventID, user.ID)
-
-		// =========
-		// afTime := time.Now()
-		// log.Printf("##### [getEvent in /api/users/] TIME: %f #####", afTime.Sub(bfTime).Seconds())
-		// =========
-
+		passHash, err := repos.Users.PassHash(user.ID)
 		if err != nil {
-			if err == sql.ErrNoRows {
-				return resError(c, "invalid_event", 404)
-			}
 			return err
-		} else if !event.PublicFg {
-			return resError(c, "invalid_event", 404)
 		}
-
-		if !validateRank(params.Rank) {
-			return resError(c, "invalid_rank", 400)
+		if ok, _ := password.Verify(passHash, params.Password); !ok {
+			return apperr.ErrAuthenticationFailed
 		}
 
-		var reservationID int64
-		var sheet Sheet
-		reservationID, sheet, err = tryInsertReservation(user, event, params.Rank)
-		if err == sql.ErrNoRows {
-			// レスポンスを返すエラー
-			return resError(c, "sold_out", 409)
-		} else if err != nil {
+		// 先に退会扱いにして、キャンセル中に新しい予約が入らないようにする
+		if err := repos.Users.Deactivate(user.ID, time.Now().UTC()); err != nil {
 			return err
 		}
-
-		return c.JSON(202, echo.Map{
-			"id":         reservationID,
-			"sheet_rank": params.Rank,
-			"sheet_num":  sheet.Num,
+		canceled, err := cancelUserReservations(user.ID)
+		if err != nil {
+			return err
+		}
+		if err := apiTokens.RevokeAll(apitoken.User, user.ID); err != nil {
+			return err
+		}
+		if err := sessManager.RevokeUserSessions(user.ID); err != nil {
+			return err
+		}
+		return c.JSON(200, echo.Map{
+			"id":                    user.ID,
+			"canceled_reservations": canceled,
 		})
 	}, loginRequired)
-	e.DELETE("/api/events/:id/sheets/:rank/:num/reservation", func(c echo.Context) error {
-		eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
-		if err != nil {
-			return resError(c, "not_found", 404)
+	e.POST("/api/actions/login", func(c echo.Context) error {
+		var params struct {
+			LoginName string `json:"login_name" validate:"required"`
+			Password  string `json:"password" validate:"required"`
+		}
+		if errs := bindParams(c, &params); errs != nil {
+			return invalidParams(errs...)
 		}
-		rank := c.Param("rank")
-		num := c.Param("num")
 
-		user, err := getLoginUser(c)
-		if err != nil {
-			return err
+		accountKey := "user:" + params.LoginName
+		if wait := loginWait(c, accountKey); wait > 0 {
+			return resTooManyAttempts(c, wait)
 		}
 
-		event, err := getEvent(eventID, user.ID)
+		user, err := repos.Users.GetByLoginName(params.LoginName)
 		if err != nil {
-			if err == sql.ErrNoRows {
-				return resError(c, "invalid_event", 404)
+			if err == repository.ErrNotFound {
+				return resLoginFailed(c, accountKey)
 			}
 			return err
-		} else if !event.PublicFg {
-			return resError(c, "invalid_event", 404)
 		}
 
-		if !validateRank(rank) {
-			return resError(c, "invalid_rank", 404)
+		ok, needsRehash := password.Verify(user.PassHash, params.Password)
+		if !ok {
+			return resLoginFailed(c, accountKey)
 		}
-
-		var sheet Sheet
-		if err := db.QueryRow("SELECT * FROM sheets WHERE `rank` = ? AND num = ?", rank, num).Scan(&sheet.ID, &sheet.Rank, &sheet.Num, &sheet.Price); err != nil {
-			if err == sql.ErrNoRows {
-				return resError(c, "invalid_sheet", 404)
+		loginSucceeded(c, accountKey)
+		if user.Deactivated {
+			return apperr.ErrAccountDeactivated
+		}
+		// 旧形式（SHA2）のハッシュはログイン時に置き換える
+		if needsRehash {
+			passHash, err := password.Hash(params.Password)
+			if err != nil {
+				return err
+			}
+			if err := repos.Users.UpdatePassHash(user.ID, passHash); err != nil {
+				return err
 			}
-			return err
 		}
 
-		{
-			// fetch the first reserved record of the event
+		if err := sessManager.SetUserID(c, user.ID); err != nil {
+			return err
+		}
+		user, err = getLoginUser(c)
+		if err != nil {
+			return err
+		}
+		return c.JSON(200, user)
+	})
+	e.POST("/api/actions/logout", func(c echo.Context) error {
+		if err := sessManager.DeleteUserID(c); err != nil {
+			return err
+		}
+		return c.NoContent(204)
+	}, loginRequired)
+	e.GET("/api/tokens", func(c echo.Context) error {
+		user, err := getLoginUser(c)
+		if err != nil {
+			return err
+		}
+		tokens, err := apiTokens.List(apitoken.User, user.ID)
+		if err != nil {
+			return err
+		}
+		return c.JSON(200, tokens)
+	}, loginRequired)
+	e.POST("/api/tokens", func(c echo.Context) error {
+		var params struct {
+			Name      string `json:"name" validate:"max=128"`
+			ExpiresIn int64  `json:"expires_in" validate:"min=0"`
+		}
+		if errs := bindParams(c, &params); errs != nil {
+			return invalidParams(errs...)
+		}
+
+		// トークンでトークンを発行できないようにする
+		if token, _ := requestToken(c); token != nil {
+			return apperr.ErrSessionRequired
+		}
+		user, err := getLoginUser(c)
+		if err != nil {
+			return err
+		}
+
+		plain, token, err := apiTokens.Issue(apitoken.User, user.ID, params.Name, nil, time.Duration(params.ExpiresIn)*time.Second)
+		if err != nil {
+			return err
+		}
+		return c.JSON(201, echo.Map{
+			"token":   plain,
+			"details": token,
+		})
+	}, loginRequired)
+	e.DELETE("/api/tokens/:id", func(c echo.Context) error {
+		tokenID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return apperr.ErrNotFound
+		}
+		user, err := getLoginUser(c)
+		if err != nil {
+			return err
+		}
+		if err := apiTokens.Revoke(apitoken.User, user.ID, tokenID); err != nil {
+			if err == apitoken.ErrNotFound {
+				return apperr.ErrNotFound
+			}
+			return err
+		}
+		return c.NoContent(204)
+	}, loginRequired)
+	e.GET("/api/events", func(c echo.Context) error {
+		events, err := getEvents(readRepos(c), true)
+		if err != nil {
+			return err
+		}
+		for i, v := range events {
+			events[i] = sanitizeEvent(v)
+		}
+		return c.JSON(200, events)
+	})
+	e.GET("/api/events/:id", func(c echo.Context) error {
+		eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return apperr.ErrNotFound
+		}
+
+		loginUserID := int64(-1)
+		if user, err := getLoginUser(c); err == nil {
+			loginUserID = user.ID
+		}
+
+		event, err := getEvent(readRepos(c), eventID, loginUserID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return apperr.ErrNotFound
+			}
+			return err
+		} else if !event.PublicFg {
+			return apperr.ErrNotFound
+		}
+		return c.JSON(200, sanitizeEvent(event))
+	})
+
+	// TODO: tuning
+	e.POST("/api/events/:id/actions/reserve", func(c echo.Context) error {
+		eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return apperr.ErrNotFound
+		}
+		var params struct {
+			Rank string `json:"sheet_rank" validate:"required,oneof=S A B C"`
+		}
+		if errs := bindParams(c, &params); errs != nil {
+			// ランクの誤りはこれまでどおり invalid_rank で返す
+			if len(errs) == 1 && errs[0].Field == "sheet_rank" {
+				return apperr.ErrInvalidRank.WithDetails(echo.Map{"fields": errs})
+			}
+			return invalidParams(errs...)
+		}
+
+		user, err := getLoginUser(c)
+		if err != nil {
+			return err
+		}
+
+		// =========
+		// bfTime := time.Now()
+		// =========
+
+		event, err := getEvent(repos, eventID, user.ID)
+
+		// =========
+		// afTime := time.Now()
+		// log.Printf("##### [getEvent in /api/users/] TIME: %f #####", afTime.Sub(bfTime).Seconds())
+		// =========
+
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return apperr.ErrInvalidEvent
+			}
+			return err
+		} else if !event.PublicFg {
+			return apperr.ErrInvalidEvent
+		}
+
+		if !validateRank(params.Rank) {
+			return apperr.ErrInvalidRank
+		}
+
+		var reservationID int64
+		var sheet Sheet
+		reservationID, sheet, err = tryInsertReservation(user, event, params.Rank)
+		if err == sql.ErrNoRows {
+			// レスポンスを返すエラー
+			return apperr.ErrSoldOut
+		} else if err != nil {
+			return err
+		}
+
+		return c.JSON(202, echo.Map{
+			"id":         reservationID,
+			"sheet_rank": params.Rank,
+			"sheet_num":  sheet.Num,
+		})
+	}, loginRequired, idempotent)
+	e.DELETE("/api/events/:id/sheets/:rank/:num/reservation", func(c echo.Context) error {
+		eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return apperr.ErrNotFound
+		}
+		rank := c.Param("rank")
+
+		user, err := getLoginUser(c)
+		if err != nil {
+			return err
+		}
+
+		event, err := getEvent(repos, eventID, user.ID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return apperr.ErrInvalidEvent
+			}
+			return err
+		} else if !event.PublicFg {
+			return apperr.ErrInvalidEvent
+		}
+
+		if !validateRank(rank) {
+			return apperr.ErrInvalidRank.WithStatus(404)
+		}
+
+		num, err := strconv.ParseInt(c.Param("num"), 10, 64)
+		if err != nil {
+			return apperr.ErrInvalidSheet
+		}
+		sheet, err := repos.Sheets.GetByRankNum(rank, num)
+		if err != nil {
+			if err == repository.ErrNotFound {
+				return apperr.ErrInvalidSheet
+			}
+			return err
+		}
+
+		{
+			// fetch the first reserved record of the event
 			reservations := myCache.GetReservations(event.ID)
 
 			found := funk.Find(reservations, func(x *Reservation) bool {
@@ -895,50 +1812,29 @@ func main() {
 			})
 			if found == nil {
 				log.Printf("NOT FOUND (DELETE RESERVATIONS)")
-				return resError(c, "not_reserved", 400)
+				return apperr.ErrNotReserved
 			}
 			reservation := *(found.(*Reservation))
 
 			if reservation.UserID != user.ID {
 				log.Printf("403 (DELETE RESERVATIONS) RUID: %v, sessionUID: %v", reservation.UserID, user.ID)
-				return resError(c, "not_permitted", 403)
-			}
-
-			canceledAt := time.Now().UTC()
-
-			// update cache before commit DB
-			{
-				// append to non-reserved sheets cache
-				x, _ := goCache.Get("randomSheetMap")
-				sheetMap := x.(map[int64]map[string]*fifo.Queue)
-				sheetMap[event.ID][rank].Add(sheet)
-
-				// delete notCanceledReservations cache
-				myCache.HashDelete(event.ID, reservation.ID)
-
-				// sales用なので多少遅れても良さそう
-				// append to canceledReservations cache
-				reservation.CanceledAt = &canceledAt
-				reservation.CanceledAtUnix = canceledAt.Unix()
-				canceledRMX.Lock()
-				canceledReservations = append(canceledReservations, &reservation)
-				canceledRMX.Unlock()
+				return apperr.ErrNotPermitted
 			}
 
-			if _, err := db.Exec("UPDATE reservations SET canceled_at = ? WHERE id = ?", canceledAt.Format("2006-01-02 15:04:05.000000"), reservation.ID); err != nil {
+			if err := cancelReservation(reservation, *sheet); err != nil {
 				return err
 			}
 		}
 
 		return c.NoContent(204)
-	}, loginRequired)
+	}, loginRequired, idempotent)
 
 	e.GET("/admin/", func(c echo.Context) error {
 		var events []*Event
 		administrator := c.Get("administrator")
 		if administrator != nil {
 			var err error
-			if events, err = getEvents(true); err != nil {
+			if events, err = getEvents(repos, true); err != nil {
 				return err
 			}
 		}
@@ -950,250 +1846,829 @@ func main() {
 	}, fillinAdministrator)
 	e.POST("/admin/api/actions/login", func(c echo.Context) error {
 		var params struct {
-			LoginName string `json:"login_name"`
-			Password  string `json:"password"`
+			LoginName string `json:"login_name" validate:"required"`
+			Password  string `json:"password" validate:"required"`
+		}
+		if errs := bindParams(c, &params); errs != nil {
+			return invalidParams(errs...)
 		}
-		c.Bind(&params)
 
-		administrator := new(Administrator)
-		if err := db.QueryRow("SELECT * FROM administrators WHERE login_name = ?", params.LoginName).Scan(&administrator.ID, &administrator.LoginName, &administrator.Nickname, &administrator.PassHash); err != nil {
-			if err == sql.ErrNoRows {
-				return resError(c, "authentication_failed", 401)
+		accountKey := "administrator:" + params.LoginName
+		if wait := loginWait(c, accountKey); wait > 0 {
+			return resTooManyAttempts(c, wait)
+		}
+
+		administrator, err := repos.Administrators.GetByLoginName(params.LoginName)
+		if err != nil {
+			if err == repository.ErrNotFound {
+				return resLoginFailed(c, accountKey)
 			}
 			return err
 		}
 
-		var passHash string
-		if err := db.QueryRow("SELECT SHA2(?, 256)", params.Password).Scan(&passHash); err != nil {
+		ok, needsRehash := password.Verify(administrator.PassHash, params.Password)
+		if !ok {
+			return resLoginFailed(c, accountKey)
+		}
+		loginSucceeded(c, accountKey)
+		// 旧形式（SHA2）のハッシュはログイン時に置き換える
+		if needsRehash {
+			passHash, err := password.Hash(params.Password)
+			if err != nil {
+				return err
+			}
+			if err := repos.Administrators.UpdatePassHash(administrator.ID, passHash); err != nil {
+				return err
+			}
+		}
+
+		audit.SetTarget(c, fmt.Sprintf("administrator:%d", administrator.ID))
+
+		// 2段階認証が有効な管理者は、TOTPの確認が済むまで管理者としてログインさせない
+		totpEnabled, err := totpStore.Enabled(administrator.ID)
+		if err != nil {
 			return err
 		}
-		if administrator.PassHash != passHash {
-			return resError(c, "authentication_failed", 401)
+		if totpEnabled {
+			if err := sessManager.SetPendingAdministratorID(c, administrator.ID); err != nil {
+				return err
+			}
+			return c.JSON(202, echo.Map{"totp_required": true})
 		}
 
-		sess.SessSetAdministratorID(c, administrator.ID)
+		if err := sessManager.SetAdministratorID(c, administrator.ID); err != nil {
+			return err
+		}
 		administrator, err = getLoginAdministrator(c)
 		if err != nil {
 			return err
 		}
 		return c.JSON(200, administrator)
-	})
+	}, audited("admin.login"))
+	e.POST("/admin/api/actions/login/totp", func(c echo.Context) error {
+		var params struct {
+			Code string `json:"code" validate:"required"`
+		}
+		if errs := bindParams(c, &params); errs != nil {
+			return invalidParams(errs...)
+		}
+
+		administratorID := sessManager.PendingAdministratorID(c)
+		if administratorID == 0 {
+			return apperr.ErrTOTPNotPending
+		}
+		audit.SetTarget(c, fmt.Sprintf("administrator:%d", administratorID))
+
+		accountKey := fmt.Sprintf("totp:%d", administratorID)
+		if wait := loginWait(c, accountKey); wait > 0 {
+			return resTooManyAttempts(c, wait)
+		}
+		ok, err := totpStore.Verify(administratorID, params.Code)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return resLoginFailed(c, accountKey)
+		}
+		loginSucceeded(c, accountKey)
+
+		if err := sessManager.SetAdministratorID(c, administratorID); err != nil {
+			return err
+		}
+		administrator, err := getLoginAdministrator(c)
+		if err != nil {
+			return err
+		}
+		return c.JSON(200, administrator)
+	}, audited("admin.login.totp"))
 	e.POST("/admin/api/actions/logout", func(c echo.Context) error {
-		sess.SessDeleteAdministratorID(c)
+		audit.SetTarget(c, fmt.Sprintf("administrator:%d", sessManager.AdministratorID(c)))
+		if err := sessManager.DeleteAdministratorID(c); err != nil {
+			return err
+		}
 		return c.NoContent(204)
-	}, adminLoginRequired)
-	e.GET("/admin/api/events", func(c echo.Context) error {
-		events, err := getEvents(true)
+	}, adminLoginRequired, adminSessionRequired, audited("admin.logout"))
+	e.POST("/admin/api/totp/enroll", func(c echo.Context) error {
+		administrator, err := getLoginAdministrator(c)
 		if err != nil {
 			return err
 		}
-		return c.JSON(200, events)
-	}, adminLoginRequired)
-	e.POST("/admin/api/events", func(c echo.Context) error {
+		stored, err := repos.Administrators.Get(administrator.ID)
+		if err != nil {
+			return err
+		}
+
+		secret, err := totpStore.Enroll(administrator.ID)
+		if err != nil {
+			if err == totp.ErrAlreadyEnabled {
+				return apperr.ErrTOTPAlreadyEnabled
+			}
+			return err
+		}
+		audit.SetTarget(c, fmt.Sprintf("administrator:%d", administrator.ID))
+		return c.JSON(200, echo.Map{
+			"secret":           secret,
+			"provisioning_uri": totp.ProvisioningURI(totpIssuer, stored.LoginName, secret),
+		})
+	}, adminLoginRequired, adminSessionRequired, audited("totp.enroll"))
+	e.POST("/admin/api/totp/activate", func(c echo.Context) error {
 		var params struct {
-			Title  string `json:"title"`
-			Public bool   `json:"public"`
-			Price  int    `json:"price"`
+			Code string `json:"code" validate:"required"`
+		}
+		if errs := bindParams(c, &params); errs != nil {
+			return invalidParams(errs...)
 		}
-		c.Bind(&params)
 
-		tx, err := db.Begin()
+		administrator, err := getLoginAdministrator(c)
+		if err != nil {
+			return err
+		}
+		audit.SetTarget(c, fmt.Sprintf("administrator:%d", administrator.ID))
+		codes, ok, err := totpStore.Enable(administrator.ID, params.Code)
 		if err != nil {
+			if err == totp.ErrNotEnrolled {
+				return apperr.ErrTOTPNotEnrolled
+			}
 			return err
 		}
+		if !ok {
+			return apperr.ErrInvalidTOTPCode
+		}
+		return c.JSON(200, echo.Map{"recovery_codes": codes})
+	}, adminLoginRequired, adminSessionRequired, audited("totp.activate"))
+	e.POST("/admin/api/totp/recovery_codes", func(c echo.Context) error {
+		var params struct {
+			Code string `json:"code" validate:"required"`
+		}
+		if errs := bindParams(c, &params); errs != nil {
+			return invalidParams(errs...)
+		}
 
-		res, err := tx.Exec("INSERT INTO events (title, public_fg, closed_fg, price) VALUES (?, ?, 0, ?)", params.Title, params.Public, params.Price)
+		administrator, err := getLoginAdministrator(c)
 		if err != nil {
-			tx.Rollback()
 			return err
 		}
-		eventID, err := res.LastInsertId()
+		audit.SetTarget(c, fmt.Sprintf("administrator:%d", administrator.ID))
+		ok, err := totpStore.Verify(administrator.ID, params.Code)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return apperr.ErrInvalidTOTPCode
+		}
+		codes, err := totpStore.RegenerateRecoveryCodes(administrator.ID)
 		if err != nil {
-			tx.Rollback()
 			return err
 		}
+		return c.JSON(200, echo.Map{"recovery_codes": codes})
+	}, adminLoginRequired, adminSessionRequired, audited("totp.recovery_codes"))
+	e.POST("/admin/api/totp/actions/disable", func(c echo.Context) error {
+		var params struct {
+			Code string `json:"code" validate:"required"`
+		}
+		if errs := bindParams(c, &params); errs != nil {
+			return invalidParams(errs...)
+		}
 
-		// 本来ここでrandomSheetMap（go-cache）にINSERTすべきだが、初期化時にズルして
-		// 余分にイベント作成しているのでここでは何もしなくてOKのはず
+		administrator, err := getLoginAdministrator(c)
+		if err != nil {
+			return err
+		}
+		audit.SetTarget(c, fmt.Sprintf("administrator:%d", administrator.ID))
+		ok, err := totpStore.Verify(administrator.ID, params.Code)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return apperr.ErrInvalidTOTPCode
+		}
+		if err := totpStore.Disable(administrator.ID); err != nil {
+			return err
+		}
+		return c.NoContent(204)
+	}, adminLoginRequired, adminSessionRequired, audited("totp.disable"))
+	e.GET("/admin/api/tokens", func(c echo.Context) error {
+		administrator, err := getLoginAdministrator(c)
+		if err != nil {
+			return err
+		}
+		tokens, err := apiTokens.List(apitoken.Administrator, administrator.ID)
+		if err != nil {
+			return err
+		}
+		return c.JSON(200, tokens)
+	}, adminLoginRequired, adminSessionRequired)
+	e.POST("/admin/api/tokens", func(c echo.Context) error {
+		var params struct {
+			Name      string   `json:"name" validate:"max=128"`
+			Scopes    []string `json:"scopes"`
+			ExpiresIn int64    `json:"expires_in" validate:"min=0"`
+		}
+		if errs := bindParams(c, &params); errs != nil {
+			return invalidParams(errs...)
+		}
+
+		administrator, err := getLoginAdministrator(c)
+		if err != nil {
+			return err
+		}
+		// 自分のロールで許可されている権限しかスコープにできない
+		for _, scope := range params.Scopes {
+			if !rbac.Allowed(administrator.Roles, rbac.Permission(scope)) {
+				return apperr.ErrInvalidScope
+			}
+		}
+
+		plain, token, err := apiTokens.Issue(apitoken.Administrator, administrator.ID, params.Name, params.Scopes, time.Duration(params.ExpiresIn)*time.Second)
+		if err != nil {
+			return err
+		}
+		audit.SetTarget(c, fmt.Sprintf("api_token:%d", token.ID))
+		audit.SetAfter(c, token)
+		return c.JSON(201, echo.Map{
+			"token":   plain,
+			"details": token,
+		})
+	}, adminLoginRequired, adminSessionRequired, audited("api_token.issue"))
+	e.DELETE("/admin/api/tokens/:id", func(c echo.Context) error {
+		tokenID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return apperr.ErrNotFound
+		}
+		administrator, err := getLoginAdministrator(c)
+		if err != nil {
+			return err
+		}
+		audit.SetTarget(c, fmt.Sprintf("api_token:%d", tokenID))
+		if err := apiTokens.Revoke(apitoken.Administrator, administrator.ID, tokenID); err != nil {
+			if err == apitoken.ErrNotFound {
+				return apperr.ErrNotFound
+			}
+			return err
+		}
+		return c.NoContent(204)
+	}, adminLoginRequired, adminSessionRequired, audited("api_token.revoke"))
+	e.GET("/admin/api/administrators", func(c echo.Context) error {
+		administrators, err := repos.Administrators.List()
+		if err != nil {
+			return err
+		}
+		for _, administrator := range administrators {
+			administrator.Roles = withDefaultRole(administrator.Roles)
+		}
+		return c.JSON(200, administrators)
+	}, adminPermissionRequired(rbac.ManageAdministrators))
+	e.POST("/admin/api/administrators", func(c echo.Context) error {
+		var params struct {
+			Nickname  string   `json:"nickname" validate:"required,max=128"`
+			LoginName string   `json:"login_name" validate:"required,max=128"`
+			Password  string   `json:"password" validate:"required,maxbytes=72"`
+			Roles     []string `json:"roles" validate:"required"`
+		}
+		if errs := bindParams(c, &params); errs != nil {
+			return invalidParams(errs...)
+		}
+		if !validateRoles(params.Roles) {
+			return apperr.ErrInvalidRole
+		}
+
+		passHash, err := password.Hash(params.Password)
+		if err != nil {
+			return err
+		}
+
+		administrator := &Administrator{LoginName: params.LoginName, Nickname: params.Nickname, PassHash: passHash, Roles: params.Roles}
+		if err := repos.Administrators.Create(administrator); err != nil {
+			if err == repository.ErrDuplicated {
+				return apperr.ErrDuplicated
+			}
+			return err
+		}
+		administrator.PassHash = ""
+		administrator.Roles = withDefaultRole(administrator.Roles)
+		audit.SetTarget(c, fmt.Sprintf("administrator:%d", administrator.ID))
+		audit.SetAfter(c, administrator)
+		return c.JSON(201, administrator)
+	}, adminPermissionRequired(rbac.ManageAdministrators), audited("administrator.create"))
+	e.POST("/admin/api/administrators/:id/actions/edit", func(c echo.Context) error {
+		administratorID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return apperr.ErrNotFound
+		}
+		// roles を省略した場合は今のロールのまま
+		var params struct {
+			Nickname string    `json:"nickname" validate:"max=128"`
+			Roles    *[]string `json:"roles"`
+		}
+		if errs := bindParams(c, &params); errs != nil {
+			return invalidParams(errs...)
+		}
+		if params.Roles != nil {
+			if len(*params.Roles) == 0 {
+				return invalidParams(validate.FieldError{Field: "roles", Rule: "required"})
+			}
+			if !validateRoles(*params.Roles) {
+				return apperr.ErrInvalidRole
+			}
+			// 自分から管理者管理の権限を外すと誰も戻せなくなるので禁止
+			loginAdministrator := c.Get("administrator").(*Administrator)
+			if loginAdministrator.ID == administratorID && !rbac.Allowed(*params.Roles, rbac.ManageAdministrators) {
+				return apperr.ErrCannotDemoteSelf
+			}
+		}
+
+		administrator, err := repos.Administrators.Get(administratorID)
+		if err != nil {
+			if err == repository.ErrNotFound {
+				return apperr.ErrNotFound
+			}
+			return err
+		}
+		before := *administrator
+		before.Roles = withDefaultRole(before.Roles)
+		audit.SetTarget(c, fmt.Sprintf("administrator:%d", administratorID))
+		audit.SetBefore(c, before)
+
+		if params.Nickname != "" {
+			administrator.Nickname = params.Nickname
+		}
+		if params.Roles != nil {
+			administrator.Roles = *params.Roles
+		}
+		if err := repos.Administrators.Update(administrator); err != nil {
+			return err
+		}
+
+		administrator.Roles = withDefaultRole(administrator.Roles)
+		audit.SetAfter(c, administrator)
+		return c.JSON(200, administrator)
+	}, adminPermissionRequired(rbac.ManageAdministrators), audited("administrator.edit"))
+	e.DELETE("/admin/api/administrators/:id", func(c echo.Context) error {
+		administratorID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return apperr.ErrNotFound
+		}
+		loginAdministrator := c.Get("administrator").(*Administrator)
+		if loginAdministrator.ID == administratorID {
+			return apperr.ErrCannotDeleteSelf
+		}
+		audit.SetTarget(c, fmt.Sprintf("administrator:%d", administratorID))
+		{
+			if before, err := repos.Administrators.Get(administratorID); err == nil {
+				before.Roles = withDefaultRole(before.Roles)
+				audit.SetBefore(c, before)
+			}
+		}
+
+		if err := repos.Administrators.Delete(administratorID); err != nil {
+			if err == repository.ErrNotFound {
+				return apperr.ErrNotFound
+			}
+			return err
+		}
+		return c.NoContent(204)
+	}, adminPermissionRequired(rbac.ManageAdministrators), audited("administrator.delete"))
+	e.GET("/admin/api/users/:id/sessions", func(c echo.Context) error {
+		userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return apperr.ErrNotFound
+		}
+		records, err := sessManager.UserSessions(userID)
+		if err != nil {
+			return err
+		}
+
+		sessions := []echo.Map{}
+		for _, r := range records {
+			sessions = append(sessions, echo.Map{
+				"id":         r.PublicID(),
+				"ip":         r.IP,
+				"user_agent": r.UserAgent,
+				"created_at": r.CreatedAt.Unix(),
+				"expires_at": r.ExpiresAt.Unix(),
+			})
+		}
+		return c.JSON(200, sessions)
+	}, adminPermissionRequired(rbac.ManageUsers))
+	e.DELETE("/admin/api/users/:id/sessions", func(c echo.Context) error {
+		userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return apperr.ErrNotFound
+		}
+		audit.SetTarget(c, fmt.Sprintf("user:%d", userID))
+		if err := sessManager.RevokeUserSessions(userID); err != nil {
+			return err
+		}
+		return c.NoContent(204)
+	}, adminPermissionRequired(rbac.ManageUsers), audited("user.sessions.revoke"))
+	e.DELETE("/admin/api/users/:id/sessions/:sid", func(c echo.Context) error {
+		userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return apperr.ErrNotFound
+		}
+		audit.SetTarget(c, fmt.Sprintf("user:%d", userID))
+		if err := sessManager.RevokeUserSession(userID, c.Param("sid")); err != nil {
+			if err == sess.ErrNotFound {
+				return apperr.ErrNotFound
+			}
+			return err
+		}
+		return c.NoContent(204)
+	}, adminPermissionRequired(rbac.ManageUsers), audited("user.sessions.revoke"))
+	e.GET("/admin/api/login_locks", func(c echo.Context) error {
+		return c.JSON(200, echo.Map{
+			"accounts": accountLimiter.Locks(),
+			"ips":      ipLimiter.Locks(),
+		})
+	}, adminPermissionRequired(rbac.ManageUsers))
+	e.POST("/admin/api/login_locks/actions/unlock", func(c echo.Context) error {
+		var params struct {
+			LoginName     string `json:"login_name" validate:"max=128"`
+			Administrator bool   `json:"administrator"`
+			IP            string `json:"ip" validate:"max=45"`
+		}
+		if errs := bindParams(c, &params); errs != nil {
+			return invalidParams(errs...)
+		}
+
+		var found bool
+		if params.LoginName != "" {
+			accountKey := "user:" + params.LoginName
+			if params.Administrator {
+				accountKey = "administrator:" + params.LoginName
+			}
+			found = accountLimiter.Reset(accountKey) || found
+		}
+		if params.IP != "" {
+			found = ipLimiter.Reset("ip:"+params.IP) || found
+		}
+		if !found {
+			return apperr.ErrNotFound
+		}
+		return c.NoContent(204)
+	}, adminPermissionRequired(rbac.ManageUsers), audited("login_lock.unlock"))
+	e.GET("/admin/api/audit", func(c echo.Context) error {
+		var filter audit.Filter
+		var err error
+		if v := c.QueryParam("administrator_id"); v != "" {
+			if filter.AdministratorID, err = strconv.ParseInt(v, 10, 64); err != nil {
+				return invalidParams(validate.FieldError{Field: "administrator_id", Rule: "format"})
+			}
+		}
+		filter.Action = c.QueryParam("action")
+		filter.Target = c.QueryParam("target")
+		if filter.Since, err = parseQueryTime(c.QueryParam("since")); err != nil {
+			return invalidParams(validate.FieldError{Field: "since", Rule: "format"})
+		}
+		if filter.Until, err = parseQueryTime(c.QueryParam("until")); err != nil {
+			return invalidParams(validate.FieldError{Field: "until", Rule: "format"})
+		}
+		if v := c.QueryParam("limit"); v != "" {
+			if filter.Limit, err = strconv.Atoi(v); err != nil {
+				return invalidParams(validate.FieldError{Field: "limit", Rule: "format"})
+			}
+		}
+		if v := c.QueryParam("offset"); v != "" {
+			if filter.Offset, err = strconv.Atoi(v); err != nil || filter.Offset < 0 {
+				return invalidParams(validate.FieldError{Field: "offset", Rule: "format"})
+			}
+		}
+
+		entries, err := auditLogger.Search(filter)
+		if err != nil {
+			return err
+		}
+		return c.JSON(200, entries)
+	}, adminPermissionRequired(rbac.ViewAudit))
+	e.GET("/admin/api/events", func(c echo.Context) error {
+		events, err := getEvents(repos, true)
+		if err != nil {
+			return err
+		}
+		return c.JSON(200, events)
+	}, adminPermissionRequired(rbac.ViewEvents))
+	e.POST("/admin/api/events", func(c echo.Context) error {
+		var params struct {
+			Title  string `json:"title" validate:"required,max=128"`
+			Public bool   `json:"public"`
+			Price  int    `json:"price" validate:"min=0"`
+		}
+		if errs := bindParams(c, &params); errs != nil {
+			return invalidParams(errs...)
+		}
 
-		if err := tx.Commit(); err != nil {
+		created := &Event{Title: params.Title, PublicFg: params.Public, Price: int64(params.Price)}
+		if err := repos.Events.Create(created); err != nil {
 			return err
 		}
 
-		event, err := getEvent(eventID, -1)
+		// 本来ここでrandomSheetMap（go-cache）にINSERTすべきだが、初期化時にズルして
+		// 余分にイベント作成しているのでここでは何もしなくてOKのはず
+
+		event, err := getEvent(repos, created.ID, -1)
 		if err != nil {
 			return err
 		}
+		audit.SetTarget(c, fmt.Sprintf("event:%d", event.ID))
+		audit.SetAfter(c, auditEvent(event))
 		return c.JSON(200, event)
-	}, adminLoginRequired)
+	}, adminPermissionRequired(rbac.ManageEvents), audited("event.create"))
 	e.GET("/admin/api/events/:id", func(c echo.Context) error {
 		eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
 		if err != nil {
-			return resError(c, "not_found", 404)
+			return apperr.ErrNotFound
 		}
-		event, err := getEvent(eventID, -1)
+		event, err := getEvent(repos, eventID, -1)
 		if err != nil {
 			if err == sql.ErrNoRows {
-				return resError(c, "not_found", 404)
+				return apperr.ErrNotFound
 			}
 			return err
 		}
 		return c.JSON(200, event)
-	}, adminLoginRequired)
+	}, adminPermissionRequired(rbac.ViewEvents))
 	e.POST("/admin/api/events/:id/actions/edit", func(c echo.Context) error {
 		eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
 		if err != nil {
-			return resError(c, "not_found", 404)
+			return apperr.ErrNotFound
 		}
 
 		var params struct {
 			Public bool `json:"public"`
 			Closed bool `json:"closed"`
 		}
-		c.Bind(&params)
+		if errs := bindParams(c, &params); errs != nil {
+			return invalidParams(errs...)
+		}
 		if params.Closed {
 			params.Public = false
 		}
 
-		event, err := getEvent(eventID, -1)
+		event, err := getEvent(repos, eventID, -1)
 		if err != nil {
 			if err == sql.ErrNoRows {
-				return resError(c, "not_found", 404)
+				return apperr.ErrNotFound
 			}
 			return err
 		}
+		audit.SetTarget(c, fmt.Sprintf("event:%d", event.ID))
+		audit.SetBefore(c, auditEvent(event))
 
 		if event.ClosedFg {
-			return resError(c, "cannot_edit_closed_event", 400)
+			return apperr.ErrCannotEditClosedEvent
 		} else if event.PublicFg && params.Closed {
-			return resError(c, "cannot_close_public_event", 400)
-		}
-
-		tx, err := db.Begin()
-		if err != nil {
-			return err
+			return apperr.ErrCannotClosePublicEvent
 		}
 
 		// NOTE: Closedに変わったとしてもCacheは更新しない（あくまで予約席のキャッシュなので）
-		if _, err := tx.Exec("UPDATE events SET public_fg = ?, closed_fg = ? WHERE id = ?", params.Public, params.Closed, event.ID); err != nil {
-			tx.Rollback()
-			return err
-		}
-		if err := tx.Commit(); err != nil {
+		if err := repos.Events.UpdateFlags(event.ID, params.Public, params.Closed); err != nil {
 			return err
 		}
 
-		e, err := getEvent(eventID, -1)
+		e, err := getEvent(repos, eventID, -1)
 		if err != nil {
 			return err
 		}
+		audit.SetAfter(c, auditEvent(e))
 		c.JSON(200, e)
 		return nil
-	}, adminLoginRequired)
+	}, adminPermissionRequired(rbac.ManageEvents), audited("event.edit"))
 	e.GET("/admin/api/reports/events/:id/sales", func(c echo.Context) error {
 		eventID, err := strconv.ParseInt(c.Param("id"), 10, 64)
 		if err != nil {
-			return resError(c, "not_found", 404)
+			return apperr.ErrNotFound
 		}
 
-		event, err := getEvent(eventID, -1)
+		// 作成直後のイベントを404にしないよう、イベントはプライマリから読む
+		event, err := getEvent(router.Primary(), eventID, -1)
 		if err != nil {
 			return err
 		}
+		audit.SetTarget(c, fmt.Sprintf("event:%d", event.ID))
 
-		rows, err := db.Query("SELECT r.*, s.rank AS sheet_rank, s.num AS sheet_num, s.price AS sheet_price, e.price AS event_price FROM reservations r INNER JOIN sheets s ON s.id = r.sheet_id INNER JOIN events e ON e.id = r.event_id WHERE r.event_id = ? ORDER BY reserved_at ASC", event.ID)
+		// 予約の一覧は多少遅れてもよいのでレプリカから読む
+		reports, err := getEventSalesReports(router.Stale(), event.ID)
 		if err != nil {
 			return err
 		}
-		defer rows.Close()
+		return renderReportCSV(c, &reports)
+	}, adminPermissionRequired(rbac.ViewReports), audited("report.download"))
 
-		var reports []Report
-		for rows.Next() {
-			var reservation Reservation
-			var sheet Sheet
-			if err := rows.Scan(&reservation.ID, &reservation.EventID, &reservation.SheetID, &reservation.UserID, &reservation.ReservedAt, &reservation.CanceledAt, &sheet.Rank, &sheet.Num, &sheet.Price, &event.Price); err != nil {
-				return err
-			}
-			report := Report{
-				ReservationID: reservation.ID,
-				EventID:       event.ID,
-				Rank:          sheet.Rank,
-				Num:           sheet.Num,
-				UserID:        reservation.UserID,
-				SoldAt:        reservation.ReservedAt.Format("2006-01-02T15:04:05.000000Z"),
-				Price:         event.Price + sheet.Price,
-			}
-			if reservation.CanceledAt != nil {
-				report.CanceledAt = reservation.CanceledAt.Format("2006-01-02T15:04:05.000000Z")
-			}
-			reports = append(reports, report)
+	e.GET("/admin/api/reports/sales", func(c echo.Context) error {
+		audit.SetTarget(c, "report:sales")
+		reports, err := getSalesReports()
+		if err != nil {
+			return err
 		}
 		return renderReportCSV(c, &reports)
-	}, adminLoginRequired)
+	}, adminPermissionRequired(rbac.ViewReports), audited("report.download"))
+	e.GET("/admin/api/reports/archive", func(c echo.Context) error {
+		files, err := reportArchive.List()
+		if err != nil {
+			return err
+		}
+		return c.JSON(200, files)
+	}, adminPermissionRequired(rbac.ViewReports))
+	e.GET("/admin/api/reports/archive/:name", func(c echo.Context) error {
+		path, err := reportArchive.Path(c.Param("name"))
+		if err != nil {
+			if err == report.ErrNotFound {
+				return apperr.ErrNotFound
+			}
+			return err
+		}
+		audit.SetTarget(c, "archive:"+c.Param("name"))
+		return c.Attachment(path, c.Param("name"))
+	}, adminPermissionRequired(rbac.ViewReports), audited("report.download"))
+}
 
-	e.GET("/admin/api/reports/sales", func(c echo.Context) error {
-		// get cache of sheets
-		var sheetsMap map[int64]Sheet
-		if x, found := goCache.Get("sheetsSlice"); found {
-			sheets := x.([]Sheet)
-			sheetsMap = funk.Map(sheets, func(x Sheet) (int64, Sheet) {
-				return x.ID, x
-			}).(map[int64]Sheet)
+// shutdown drains the servers and the report job, then writes the cache snapshot to cfg.SnapshotPath if set
+func shutdown(cfg *config.Config, e *echo.Echo, pprofServer *http.Server, stopReport chan struct{}, reportDone <-chan struct{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	// 予約・キャンセルはDBへ同期的に書いているので、ハンドラが全て終われば書き込みも終わっている
+	drained := true
+	if err := e.Shutdown(ctx); err != nil {
+		log.Printf("shutdown http: %v", err)
+		drained = false
+	}
+	if err := pprofServer.Shutdown(ctx); err != nil {
+		log.Printf("shutdown pprof: %v", err)
+	}
+	close(stopReport)
+	select {
+	case <-reportDone:
+	case <-ctx.Done():
+		log.Printf("shutdown report: %v", ctx.Err())
+	}
+
+	// キャッシュはDBより先に更新するので、処理中のリクエストが残っているとDBにない予約が入ってしまう
+	if path := cfg.SnapshotPath; path != "" {
+		if !drained {
+			log.Printf("snapshot skipped: requests still in flight")
+		} else if err := writeSnapshot(path); err != nil {
+			log.Printf("snapshot: %v", err)
 		}
+	}
+	for _, replica := range replicaDBs {
+		replica.Close()
+	}
+	return db.Close()
+}
 
-		var reservations []*Reservation
-		events := map[int64]Event{}
-		{
-			rows, _ := db.Query("select id, price from events")
-			defer rows.Close()
-			for rows.Next() {
-				var eid int64
-				var price int64
-				if err := rows.Scan(&eid, &price); err != nil {
-					return err
-				}
-				e := Event{
-					ID:    eid,
-					Price: price,
-				}
-				events[eid] = e
-			}
+// writeSnapshot writes the reservation caches to path
+func writeSnapshot(path string) error {
+	// CACHE_EXPIRATION を過ぎると席のキャッシュは消えている
+	x, found := goCache.Get("sheetsSlice")
+	if !found {
+		return errors.New("the sheets cache has expired")
+	}
+	sheets := x.([]Sheet)
 
-			// キャンセルしてないもの、しているものすべてを取得する
-			// NOTE: 一時変数に代入するとRAMを大量に食うので、しないこと
-			eventIDs := funk.Keys(events).([]int64)
-			reservations = append(reservations, myCache.GetReservationsAll(eventIDs)...)
-			reservations = append(reservations, canceledReservations...)
-		}
-
-		// NOTE: ここも go func() で並列化するとSWAPが発生するので敢えて直列で。
-		var reports = []Report{}
-		for _, reservation := range reservations {
-			// get from map
-			event := events[reservation.EventID]
-			sheet := sheetsMap[reservation.SheetID]
-
-			report := Report{
-				ReservationID: reservation.ID,
-				UserID:        reservation.UserID,
-				SoldAt:        time.Unix(reservation.ReservedAtUnix, 0).Format("2006-01-02T15:04:05.000000Z"),
-				Rank:          sheet.Rank,
-				Num:           sheet.Num,
-				Price:         event.Price + sheet.Price,
-				EventID:       event.ID,
+	s := &snapshot.Snapshot{
+		CreatedAt:       time.Now().UTC(),
+		ReservationUUID: atomic.LoadInt64(&reservationUUID),
+		FreeSheets:      map[int64][]int64{},
+	}
+	for eventID, reservations := range myCache.NonCanceledReservations {
+		reserved := map[int64]bool{}
+		for _, r := range reservations.LoadAll() {
+			s.Reservations = append(s.Reservations, r)
+			reserved[r.SheetID] = true
+		}
+		freeSheets := []int64{}
+		for _, sheet := range sheets {
+			if !reserved[sheet.ID] {
+				freeSheets = append(freeSheets, sheet.ID)
 			}
-			if reservation.CanceledAt != nil {
-				report.CanceledAt = reservation.CanceledAt.Format("2006-01-02T15:04:05.000000Z")
-			} else if reservation.CanceledAtUnix != 0 {
-				report.CanceledAt = time.Unix(reservation.CanceledAtUnix, 0).Format("2006-01-02T15:04:05.000000Z")
+		}
+		s.FreeSheets[eventID] = freeSheets
+	}
+	canceledRMX.Lock()
+	s.Canceled = append([]*Reservation(nil), canceledReservations...)
+	canceledRMX.Unlock()
+
+	start := time.Now()
+	if err := s.WriteFile(path); err != nil {
+		return err
+	}
+	log.Printf("snapshot: %d reservations, %d canceled to %s in %s", len(s.Reservations), len(s.Canceled), path, time.Since(start))
+	return nil
+}
+
+func getEventSalesReports(r *repository.Repositories, eventID int64) ([]Report, error) {
+	reservations, err := r.Reservations.ListByEvent(eventID)
+	if err != nil {
+		return nil, err
+	}
+
+	var reports []Report
+	for _, reservation := range reservations {
+		report := Report{
+			ReservationID: reservation.ID,
+			EventID:       eventID,
+			Rank:          reservation.SheetRank,
+			Num:           reservation.SheetNum,
+			UserID:        reservation.UserID,
+			SoldAt:        reservation.SoldAt(),
+			CanceledAt:    reservation.CanceledAtString(),
+			Price:         reservation.Price,
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+func getSalesReports() ([]Report, error) {
+	// get cache of sheets
+	var sheetsMap map[int64]Sheet
+	if x, found := goCache.Get("sheetsSlice"); found {
+		sheets := x.([]Sheet)
+		sheetsMap = funk.Map(sheets, func(x Sheet) (int64, Sheet) {
+			return x.ID, x
+		}).(map[int64]Sheet)
+	}
+
+	var reservations []*Reservation
+	events := map[int64]Event{}
+	{
+		// 予約はプライマリに書いたキャッシュから取るので、価格を引くイベントもレプリカの遅れを許さずプライマリから読む
+		allEvents, err := router.Primary().Events.List()
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range allEvents {
+			events[e.ID] = Event{
+				ID:    e.ID,
+				Price: e.Price,
 			}
-			reports = append(reports, report)
 		}
 
-		return renderReportCSV(c, &reports)
-	}, adminLoginRequired)
+		// キャンセルしてないもの、しているものすべてを取得する
+		// NOTE: 一時変数に代入するとRAMを大量に食うので、しないこと
+		eventIDs := funk.Keys(events).([]int64)
+		reservations = append(reservations, myCache.GetReservationsAll(eventIDs)...)
+		// キャンセル処理やレポートのアーカイブと並行して走るのでロックを取ってコピーする
+		canceledRMX.Lock()
+		reservations = append(reservations, canceledReservations...)
+		canceledRMX.Unlock()
+	}
+
+	// NOTE: ここも go func() で並列化するとSWAPが発生するので敢えて直列で。
+	var reports = []Report{}
+	for _, reservation := range reservations {
+		// get from map
+		event := events[reservation.EventID]
+		sheet := sheetsMap[reservation.SheetID]
+
+		report := Report{
+			ReservationID: reservation.ID,
+			UserID:        reservation.UserID,
+			SoldAt:        reservation.SoldAt(),
+			CanceledAt:    reservation.CanceledAtString(),
+			Rank:          sheet.Rank,
+			Num:           sheet.Num,
+			Price:         event.Price + sheet.Price,
+			EventID:       reservation.EventID,
+		}
+		reports = append(reports, report)
+	}
+
+	return reports, nil
+}
+
+/**
+ * 定期実行で全体と各イベントの売上レポートを保存する
+ */
+func archiveReports(now time.Time) error {
+	reports, err := getSalesReports()
+	if err != nil {
+		return err
+	}
+	if _, err := reportArchive.Save("sales", now, reportCSV(&reports).Bytes()); err != nil {
+		return err
+	}
+
+	// 作成直後のイベントも保存するよう、イベントの一覧はプライマリから読む
+	events, err := router.Primary().Events.List()
+	if err != nil {
+		return err
+	}
+	// 各イベントの予約は定期保存なので多少遅れてもよく、レプリカから読む
+	r := router.Stale()
+	for _, event := range events {
+		eid := event.ID
+		reports, err := getEventSalesReports(r, eid)
+		if err != nil {
+			return err
+		}
+		if _, err := reportArchive.Save(fmt.Sprintf("event-%d-sales", eid), now, reportCSV(&reports).Bytes()); err != nil {
+			return err
+		}
+	}
 
-	e.Logger.Fatal(e.Start(":8080"))
+	return reportArchive.Prune(now)
 }
 
 type Report struct {
@@ -1211,24 +2686,76 @@ func renderReportCSV(c echo.Context, reports *[]Report) error {
 	// ソートなしでもOKだった、、、罠
 	// sort.Slice(*reports, func(i, j int) bool { return strings.Compare((*reports)[i].SoldAt, (*reports)[j].SoldAt) < 0 })
 
+	body := reportCSV(reports)
+
+	c.Response().Header().Set("Content-Type", `text/csv; charset=UTF-8`)
+	c.Response().Header().Set("Content-Disposition", `attachment; filename="report.csv"`)
+	_, err := io.Copy(c.Response(), body)
+	return err
+}
+
+func reportCSV(reports *[]Report) *bytes.Buffer {
 	body := bytes.NewBufferString("reservation_id,event_id,rank,num,price,user_id,sold_at,canceled_at\n")
 	for _, v := range *(reports) {
 		body.WriteString(fmt.Sprintf("%d,%d,%s,%d,%d,%d,%s,%s\n",
 			v.ReservationID, v.EventID, v.Rank, v.Num, v.Price, v.UserID, v.SoldAt, v.CanceledAt))
 	}
+	return body
+}
 
-	c.Response().Header().Set("Content-Type", `text/csv; charset=UTF-8`)
-	c.Response().Header().Set("Content-Disposition", `attachment; filename="report.csv"`)
-	_, err := io.Copy(c.Response(), body)
-	return err
+// httpErrorHandler responds the errors returned by the handlers with resError
+func httpErrorHandler(err error, c echo.Context) {
+	appErr := apperr.From(err)
+	if appErr.Status >= 500 {
+		log.Printf("%s %s: %v", c.Request().Method, c.Request().URL.Path, err)
+	}
+	if c.Response().Committed {
+		return
+	}
+	if err := resError(c, appErr); err != nil {
+		log.Printf("error response: %v", err)
+	}
+}
+
+// recoverPanic turns a panic in the handler into a 500 response instead of crashing the server
+func recoverPanic(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				stack := make([]byte, 4<<10)
+				stack = stack[:runtime.Stack(stack, false)]
+				log.Printf("panic: %v\n%s", r, stack)
+				err = apperr.Internal(fmt.Errorf("panic: %v", r))
+			}
+		}()
+		return next(c)
+	}
+}
+
+// bindParams reads the JSON body into params and checks its `validate` rules.
+// 空のボディはすべて省略されたものとして扱う
+func bindParams(c echo.Context, params interface{}) []validate.FieldError {
+	if c.Request().ContentLength != 0 {
+		if err := c.Bind(params); err != nil {
+			return []validate.FieldError{{Field: "body", Rule: "malformed"}}
+		}
+	}
+	return validate.Struct(params)
+}
+
+// invalidParams returns the invalid_params error listing the failed fields
+func invalidParams(fields ...validate.FieldError) error {
+	return apperr.ErrInvalidParams.WithDetails(echo.Map{"fields": fields})
 }
 
-func resError(c echo.Context, e string, status int) error {
-	if e == "" {
-		e = "unknown"
+// resError writes the error as {"error": code, "message": ..., "details": ...}, the message follows Accept-Language
+func resError(c echo.Context, e *apperr.Error) error {
+	res := echo.Map{
+		"error":   e.Code,
+		"message": e.Message(apperr.Language(c.Request().Header.Get("Accept-Language"))),
 	}
-	if status < 100 {
-		status = 500
+	if e.Details != nil {
+		res["details"] = e.Details
 	}
-	return c.JSON(status, map[string]string{"error": e})
+	return c.JSON(e.Status, res)
 }
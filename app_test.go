@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+	cache "github.com/patrickmn/go-cache"
+
+	"torb/apitoken"
+	"torb/audit"
+	myCache "torb/cache"
+	"torb/clientip"
+	"torb/config"
+	"torb/dialect"
+	"torb/idempotency"
+	"torb/loginlimit"
+	"torb/migrate"
+	"torb/password"
+	"torb/rbac"
+	"torb/report"
+	"torb/repository"
+	sess "torb/session"
+	"torb/snapshot"
+	. "torb/structs"
+	"torb/totp"
+)
+
+// newTestServer sets up the globals like main on a new SQLite database and serves the routes
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	check := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := config.Default()
+	cfg.DB.Driver = dialect.SQLite
+	cfg.DB.Database = filepath.Join(t.TempDir(), "torb.sqlite3")
+	cfg.ReportArchiveDir = t.TempDir()
+	check(openDB(cfg.DB))
+	t.Cleanup(func() { db.Close() })
+	m, err := migrate.New(db, dbDialect)
+	check(err)
+	_, err = m.Up()
+	check(err)
+
+	repos, err = repository.New(db, dbDialect)
+	check(err)
+	router = repository.NewRouter(repos, nil, cfg.DB.ReplicaMaxLag)
+	clientIPs = clientip.New(nil)
+	sessManager, err = sess.New(cfg.Session, sess.NewMemoryStore(), clientIPs)
+	check(err)
+	defaultAdminRole = cfg.AdminDefaultRole
+	auditLogger, err = audit.New(db, dbDialect)
+	check(err)
+	totpStore, err = totp.NewStore(db, dbDialect)
+	check(err)
+	apiTokens, err = apitoken.New(db, dbDialect)
+	check(err)
+	idempotencyKeys, err = idempotency.New(db, dbDialect, cfg.IdempotencyTTL)
+	check(err)
+	accountLimiter = loginlimit.New(loginlimit.Config{MaxFailures: cfg.LoginMaxFailures, Lockout: cfg.LoginLockout})
+	ipLimiter = loginlimit.New(loginlimit.Config{MaxFailures: cfg.LoginIPMaxFailures, Lockout: cfg.LoginLockout})
+	canceledRMX = new(sync.Mutex)
+	changeMarker, err = snapshot.NewMarker(db, dbDialect)
+	check(err)
+	goCache = cache.New(cfg.CacheExpiration, cfg.CacheCleanupInterval)
+	check(loadCaches(cfg))
+	reportArchive, err = report.NewArchive(cfg.ReportArchiveDir, cfg.ReportRetention)
+	check(err)
+
+	e := echo.New()
+	routes(e, cfg)
+	srv := httptest.NewServer(e)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// newClient returns the client which keeps the session cookie
+func newClient(t *testing.T) *http.Client {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Client{Jar: jar}
+}
+
+func post(t *testing.T, client *http.Client, url, body string) (int, map[string]interface{}) {
+	t.Helper()
+	res, err := client.Post(url, echo.MIMEApplicationJSON, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var buf bytes.Buffer
+	buf.ReadFrom(res.Body)
+	var v map[string]interface{}
+	json.Unmarshal(buf.Bytes(), &v)
+	return res.StatusCode, v
+}
+
+// login creates the user and the superadmin, and returns their logged in clients
+func login(t *testing.T, srv *httptest.Server) (userClient, adminClient *http.Client, userID int64) {
+	t.Helper()
+	passHash, err := password.Hash("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &User{Nickname: "user", LoginName: "user", PassHash: passHash}
+	if err := repos.Users.Create(user); err != nil {
+		t.Fatal(err)
+	}
+	admin := &Administrator{Nickname: "admin", LoginName: "admin", PassHash: passHash, Roles: []string{rbac.Superadmin}}
+	if err := repos.Administrators.Create(admin); err != nil {
+		t.Fatal(err)
+	}
+
+	userClient = newClient(t)
+	if status, res := post(t, userClient, srv.URL+"/api/actions/login", `{"login_name":"user","password":"password"}`); status != 200 {
+		t.Fatalf("user login: %d %v", status, res)
+	}
+	adminClient = newClient(t)
+	if status, res := post(t, adminClient, srv.URL+"/admin/api/actions/login", `{"login_name":"admin","password":"password"}`); status != 200 {
+		t.Fatalf("admin login: %d %v", status, res)
+	}
+	return userClient, adminClient, user.ID
+}
+
+func TestValidationErrors(t *testing.T) {
+	srv := newTestServer(t)
+	userClient, adminClient, userID := login(t, srv)
+	anonymous := newClient(t)
+	long := strings.Repeat("a", 129)
+	password73 := strings.Repeat("a", 73)
+	users := fmt.Sprintf("/api/users/%d/actions", userID)
+
+	for _, tt := range []struct {
+		client *http.Client
+		path   string
+		body   string
+		code   string
+		field  string
+	}{
+		{anonymous, "/api/users", `{"nickname":"n","login_name":"l"}`, "invalid_params", "password"},
+		{anonymous, "/api/users", `{"nickname":"` + long + `","login_name":"l","password":"p"}`, "invalid_params", "nickname"},
+		{anonymous, "/api/users", `{"nickname":"n","login_name":"l","password":"` + password73 + `"}`, "invalid_params", "password"},
+		{anonymous, "/api/users", `{"nickname":`, "invalid_params", "body"},
+		{anonymous, "/api/actions/login", `{"login_name":"user"}`, "invalid_params", "password"},
+		{userClient, users + "/edit", `{}`, "invalid_params", "nickname"},
+		{userClient, users + "/edit", `{"nickname":"` + long + `"}`, "invalid_params", "nickname"},
+		{userClient, users + "/change_password", `{"current_password":"password"}`, "invalid_params", "new_password"},
+		{userClient, users + "/change_password", `{"current_password":"password","new_password":"` + password73 + `"}`, "invalid_params", "new_password"},
+		{userClient, users + "/deactivate", `{}`, "invalid_params", "password"},
+		{userClient, "/api/tokens", `{"name":"` + long + `"}`, "invalid_params", "name"},
+		{userClient, "/api/tokens", `{"expires_in":-1}`, "invalid_params", "expires_in"},
+		// ランクの誤りはこれまでどおり invalid_rank
+		{userClient, "/api/events/1/actions/reserve", `{}`, "invalid_rank", "sheet_rank"},
+		{userClient, "/api/events/1/actions/reserve", `{"sheet_rank":"D"}`, "invalid_rank", "sheet_rank"},
+		{anonymous, "/admin/api/actions/login", `{"password":"password"}`, "invalid_params", "login_name"},
+		{adminClient, "/admin/api/actions/login/totp", `{}`, "invalid_params", "code"},
+		{adminClient, "/admin/api/totp/activate", `{}`, "invalid_params", "code"},
+		{adminClient, "/admin/api/totp/recovery_codes", `{}`, "invalid_params", "code"},
+		{adminClient, "/admin/api/totp/actions/disable", `{}`, "invalid_params", "code"},
+		{adminClient, "/admin/api/tokens", `{"expires_in":-1}`, "invalid_params", "expires_in"},
+		{adminClient, "/admin/api/administrators", `{"nickname":"n","login_name":"l","password":"p"}`, "invalid_params", "roles"},
+		{adminClient, "/admin/api/administrators", `{"nickname":"n","login_name":"l","password":"` + password73 + `","roles":["viewer"]}`, "invalid_params", "password"},
+		{adminClient, "/admin/api/administrators/1/actions/edit", `{"roles":[]}`, "invalid_params", "roles"},
+		{adminClient, "/admin/api/administrators/1/actions/edit", `{"nickname":"` + long + `"}`, "invalid_params", "nickname"},
+		{adminClient, "/admin/api/login_locks/actions/unlock", `{"ip":"` + long + `"}`, "invalid_params", "ip"},
+		{adminClient, "/admin/api/events", `{"price":1000}`, "invalid_params", "title"},
+		{adminClient, "/admin/api/events", `{"title":"t","price":-1}`, "invalid_params", "price"},
+		{adminClient, "/admin/api/events/1/actions/edit", `{"public":"yes"}`, "invalid_params", "body"},
+	} {
+		status, res := post(t, tt.client, srv.URL+tt.path, tt.body)
+		if status != 400 || res["error"] != tt.code {
+			t.Errorf("POST %s %s = %d %v, want 400 %s", tt.path, tt.body, status, res, tt.code)
+			continue
+		}
+		details, _ := res["details"].(map[string]interface{})
+		fields, _ := details["fields"].([]interface{})
+		if len(fields) == 0 || fields[0].(map[string]interface{})["field"] != tt.field {
+			t.Errorf("POST %s %s fields = %v, want %s", tt.path, tt.body, fields, tt.field)
+		}
+	}
+}
+
+func TestDeactivatedUser(t *testing.T) {
+	srv := newTestServer(t)
+	userClient, _, userID := login(t, srv)
+	if err := repos.Users.Deactivate(userID, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	// 退会はセッションが残っていても users と一緒に読んで弾く
+	res, err := userClient.Get(srv.URL + "/api/tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 403 {
+		t.Errorf("GET /api/tokens after deactivation = %d, want 403", res.StatusCode)
+	}
+	if status, res := post(t, newClient(t), srv.URL+"/api/actions/login", `{"login_name":"user","password":"password"}`); status != 403 || res["error"] != "account_deactivated" {
+		t.Errorf("login after deactivation = %d %v, want 403 account_deactivated", status, res)
+	}
+}
+
+func TestLegacyPasswordMigration(t *testing.T) {
+	srv := newTestServer(t)
+	user := &User{Nickname: "user", LoginName: "user", PassHash: password.LegacyHash("password")}
+	if err := repos.Users.Create(user); err != nil {
+		t.Fatal(err)
+	}
+	admin := &Administrator{Nickname: "admin", LoginName: "admin", PassHash: password.LegacyHash("password"), Roles: []string{rbac.Superadmin}}
+	if err := repos.Administrators.Create(admin); err != nil {
+		t.Fatal(err)
+	}
+	passHashes := func() (string, string) {
+		t.Helper()
+		u, err := repos.Users.GetByLoginName("user")
+		if err != nil {
+			t.Fatal(err)
+		}
+		a, err := repos.Administrators.GetByLoginName("admin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u.PassHash, a.PassHash
+	}
+
+	// パスワードを間違えても旧形式のハッシュはそのまま
+	for path, loginName := range map[string]string{"/api/actions/login": "user", "/admin/api/actions/login": "admin"} {
+		if status, res := post(t, newClient(t), srv.URL+path, `{"login_name":"`+loginName+`","password":"wrong"}`); status != 401 {
+			t.Errorf("POST %s with the wrong password = %d %v, want 401", path, status, res)
+		}
+	}
+	userHash, adminHash := passHashes()
+	if userHash != user.PassHash || adminHash != admin.PassHash {
+		t.Errorf("pass_hash after the failed login = %s, %s, want unchanged", userHash, adminHash)
+	}
+
+	// ログインに成功すると bcrypt に置き換え、その後もログインできる
+	for i := 0; i < 2; i++ {
+		if status, res := post(t, newClient(t), srv.URL+"/api/actions/login", `{"login_name":"user","password":"password"}`); status != 200 {
+			t.Fatalf("user login %d: %d %v", i+1, status, res)
+		}
+		if status, res := post(t, newClient(t), srv.URL+"/admin/api/actions/login", `{"login_name":"admin","password":"password"}`); status != 200 {
+			t.Fatalf("admin login %d: %d %v", i+1, status, res)
+		}
+		userHash, adminHash = passHashes()
+		for _, passHash := range []string{userHash, adminHash} {
+			if ok, needsRehash := password.Verify(passHash, "password"); !strings.HasPrefix(passHash, "bcrypt:") || !ok || needsRehash {
+				t.Errorf("login %d: pass_hash = %s, want bcrypt of the password", i+1, passHash)
+			}
+		}
+	}
+}
+
+func TestRestoreSnapshot(t *testing.T) {
+	newTestServer(t)
+	if err := changeMarker.Touch(); err != nil {
+		t.Fatal(err)
+	}
+	changedAt, err := changeMarker.ChangedAt()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reservation := &Reservation{ID: reservationUUID + 100, EventID: 1, SheetID: 1, UserID: 1}
+	reservation.SetReservedAt(changedAt)
+	path := filepath.Join(t.TempDir(), "torb.snapshot")
+	write := func(createdAt time.Time) {
+		t.Helper()
+		s := &snapshot.Snapshot{
+			CreatedAt:       createdAt,
+			ReservationUUID: reservation.ID,
+			Reservations:    []*Reservation{reservation},
+			FreeSheets:      map[int64][]int64{},
+		}
+		if err := s.WriteFile(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// /initialize などでDBを変えた後のスナップショットでなければ読まない
+	for _, createdAt := range []time.Time{changedAt.Add(-time.Second), changedAt} {
+		write(createdAt)
+		if restored, err := restoreSnapshot(path, 100); restored || err != nil {
+			t.Errorf("restoreSnapshot of the snapshot at %v before the change at %v = %v, %v, want false", createdAt, changedAt, restored, err)
+		}
+		if got := myCache.GetReservations(1); len(got) != 0 {
+			t.Errorf("%d reservations restored from the stale snapshot", len(got))
+		}
+	}
+
+	write(changedAt.Add(time.Second))
+	if restored, err := restoreSnapshot(path, 100); !restored || err != nil {
+		t.Fatalf("restoreSnapshot = %v, %v, want true", restored, err)
+	}
+	if got := myCache.GetReservations(1); len(got) != 1 || got[0].ID != reservation.ID {
+		t.Errorf("restored reservations = %v, want %d", got, reservation.ID)
+	}
+	if reservationUUID != reservation.ID {
+		t.Errorf("reservationUUID = %d, want %d", reservationUUID, reservation.ID)
+	}
+	// 読み込んだスナップショットは消す
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("the restored snapshot is left: %v", err)
+	}
+
+	// 壊れたファイルはエラー
+	if err := ioutil.WriteFile(path, []byte("TORBSNAP broken"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if restored, err := restoreSnapshot(path, 100); restored || !errors.Is(err, snapshot.ErrInvalid) {
+		t.Errorf("restoreSnapshot of the broken file = %v, %v, want ErrInvalid", restored, err)
+	}
+}
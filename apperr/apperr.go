@@ -0,0 +1,102 @@
+package apperr
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+// Error is an application error with the HTTP status and the error code of the response
+type Error struct {
+	Status int
+	Code   string
+	// Details is returned to the client with the message, e.g. the invalid fields
+	Details interface{}
+	// Err is the cause, it is logged but not returned to the client
+	Err error
+}
+
+// New returns the error for the status and the code
+func New(status int, code string) *Error {
+	return &Error{Status: status, Code: code}
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s (%d): %v", e.Code, e.Status, e.Err)
+	}
+	return fmt.Sprintf("%s (%d)", e.Code, e.Status)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Wrap returns a copy of the error caused by err
+func (e *Error) Wrap(err error) *Error {
+	copied := *e
+	copied.Err = err
+	return &copied
+}
+
+// WithDetails returns a copy of the error with the details for the client
+func (e *Error) WithDetails(details interface{}) *Error {
+	copied := *e
+	copied.Details = details
+	return &copied
+}
+
+// WithStatus returns a copy of the error responded with another status.
+// 既存のAPIで同じコードでもステータスが違う箇所のためのもの
+func (e *Error) WithStatus(status int) *Error {
+	copied := *e
+	copied.Status = status
+	return &copied
+}
+
+// Is matches the errors with the same code, so that errors.Is works for wrapped copies
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// Internal wraps an unexpected error, it is responded as 500
+func Internal(err error) *Error {
+	return ErrInternal.Wrap(err)
+}
+
+// From converts any error returned by the handlers into an application error.
+// sql.ErrNoRows is not found, echo.HTTPError keeps its status and the others are internal errors.
+func From(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound.Wrap(err)
+	}
+	var he *echo.HTTPError
+	if errors.As(err, &he) {
+		switch he.Code {
+		case http.StatusNotFound:
+			return ErrNotFound.Wrap(err)
+		case http.StatusMethodNotAllowed:
+			return ErrMethodNotAllowed.Wrap(err)
+		}
+		return &Error{Status: he.Code, Code: statusCode(he.Code), Err: err}
+	}
+	return Internal(err)
+}
+
+// statusCode returns the error code for the status, e.g. "method_not_allowed" for 405
+func statusCode(status int) string {
+	text := http.StatusText(status)
+	if text == "" {
+		return "unknown"
+	}
+	return strings.Replace(strings.ToLower(text), " ", "_", -1)
+}
@@ -0,0 +1,130 @@
+package apperr
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Supported languages of the messages, the first one is the default
+var Languages = []string{"ja", "en"}
+
+type message struct {
+	ja, en string
+}
+
+var messages = map[string]message{}
+
+func define(status int, code, ja, en string) *Error {
+	if _, ok := messages[code]; ok {
+		panic("apperr: duplicated code " + code)
+	}
+	messages[code] = message{ja: ja, en: en}
+	return New(status, code)
+}
+
+// Catalogue of the error codes returned by the API
+var (
+	ErrInvalidParams = define(http.StatusBadRequest, "invalid_params",
+		"入力内容に誤りがあります", "The request parameters are invalid")
+	ErrIdempotencyKeyInProgress = define(http.StatusConflict, "idempotency_key_in_progress",
+		"同じIdempotency-Keyのリクエストを処理中です", "A request with the same Idempotency-Key is in progress")
+	ErrIdempotencyKeyMismatch = define(http.StatusUnprocessableEntity, "idempotency_key_mismatch",
+		"このIdempotency-Keyは別のリクエストで使われています", "The Idempotency-Key is used for another request")
+	ErrNotFound = define(http.StatusNotFound, "not_found",
+		"見つかりません", "Not found")
+	ErrMethodNotAllowed = define(http.StatusMethodNotAllowed, "method_not_allowed",
+		"このメソッドは使えません", "The method is not allowed")
+	ErrInternal = define(http.StatusInternalServerError, "internal_error",
+		"サーバーでエラーが発生しました", "An internal server error occurred")
+
+	// 認証・権限
+	ErrLoginRequired = define(http.StatusUnauthorized, "login_required",
+		"ログインが必要です", "Login is required")
+	ErrAdminLoginRequired = define(http.StatusUnauthorized, "admin_login_required",
+		"管理者としてのログインが必要です", "Administrator login is required")
+	ErrAuthenticationFailed = define(http.StatusUnauthorized, "authentication_failed",
+		"ログイン名またはパスワードが正しくありません", "The login name or the password is incorrect")
+	ErrTooManyAttempts = define(http.StatusTooManyRequests, "too_many_attempts",
+		"試行回数が多すぎます。しばらくしてから再度お試しください", "Too many attempts, please retry later")
+	ErrAccountDeactivated = define(http.StatusForbidden, "account_deactivated",
+		"このアカウントは退会済みです", "The account has been deactivated")
+	ErrForbidden = define(http.StatusForbidden, "forbidden",
+		"この操作をする権限がありません", "You are not allowed to do this")
+	ErrSessionRequired = define(http.StatusForbidden, "session_required",
+		"この操作はAPIトークンではできません", "This operation requires a login session, not an API token")
+	ErrInvalidTOTPCode = define(http.StatusBadRequest, "invalid_totp_code",
+		"確認コードが正しくありません", "The verification code is incorrect")
+	ErrTOTPAlreadyEnabled = define(http.StatusConflict, "totp_already_enabled",
+		"2段階認証は既に有効です", "Two-factor authentication is already enabled")
+	ErrTOTPNotEnrolled = define(http.StatusBadRequest, "totp_not_enrolled",
+		"2段階認証の登録が始まっていません", "Two-factor authentication is not enrolled")
+	ErrTOTPNotPending = define(http.StatusUnauthorized, "totp_not_pending",
+		"先にパスワードでログインしてください", "Login with the password first")
+
+	// ユーザー・管理者
+	ErrDuplicated = define(http.StatusConflict, "duplicated",
+		"このログイン名は既に使われています", "The login name is already taken")
+	ErrInvalidRole = define(http.StatusBadRequest, "invalid_role",
+		"存在しないロールです", "The role does not exist")
+	ErrInvalidScope = define(http.StatusBadRequest, "invalid_scope",
+		"自分のロールで許可されていないスコープです", "The scope is not allowed for your roles")
+	ErrCannotDemoteSelf = define(http.StatusBadRequest, "cannot_demote_self",
+		"自分の管理者管理の権限は外せません", "You cannot remove your own permission to manage administrators")
+	ErrCannotDeleteSelf = define(http.StatusBadRequest, "cannot_delete_self",
+		"自分自身は削除できません", "You cannot delete yourself")
+
+	// イベント・予約
+	ErrInvalidEvent = define(http.StatusNotFound, "invalid_event",
+		"イベントが存在しません", "The event does not exist")
+	ErrInvalidRank = define(http.StatusBadRequest, "invalid_rank",
+		"席のランクが正しくありません", "The sheet rank is invalid")
+	ErrInvalidSheet = define(http.StatusNotFound, "invalid_sheet",
+		"席が存在しません", "The sheet does not exist")
+	ErrSoldOut = define(http.StatusConflict, "sold_out",
+		"売り切れです", "The sheets are sold out")
+	ErrNotReserved = define(http.StatusBadRequest, "not_reserved",
+		"この席は予約されていません", "The sheet is not reserved")
+	ErrNotPermitted = define(http.StatusForbidden, "not_permitted",
+		"他のユーザーの予約は取り消せません", "You cannot cancel the reservation of another user")
+	ErrCannotEditClosedEvent = define(http.StatusBadRequest, "cannot_edit_closed_event",
+		"終了したイベントは編集できません", "A closed event cannot be edited")
+	ErrCannotClosePublicEvent = define(http.StatusBadRequest, "cannot_close_public_event",
+		"公開中のイベントは終了できません", "A public event cannot be closed")
+)
+
+// Message returns the message of the error in the language, see Language
+func (e *Error) Message(lang string) string {
+	m, ok := messages[e.Code]
+	if !ok {
+		// カタログにないコード（echoが返したステータスなど）
+		m = message{ja: "エラーが発生しました", en: http.StatusText(e.Status)}
+	}
+	if lang == "en" {
+		return m.en
+	}
+	return m.ja
+}
+
+// Language returns the supported language preferred by the Accept-Language header
+func Language(acceptLanguage string) string {
+	best, bestQ := Languages[0], 0.0
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag, q := strings.TrimSpace(part), 1.0
+		if i := strings.Index(tag, ";"); i >= 0 {
+			if v := strings.TrimSpace(tag[i+1:]); strings.HasPrefix(v, "q=") {
+				if f, err := strconv.ParseFloat(v[2:], 64); err == nil {
+					q = f
+				}
+			}
+			tag = tag[:i]
+		}
+		primary := strings.ToLower(strings.SplitN(tag, "-", 2)[0])
+		for _, lang := range Languages {
+			if primary == lang && q > bestQ {
+				best, bestQ = lang, q
+			}
+		}
+	}
+	return best
+}
@@ -0,0 +1,253 @@
+package audit
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/json-iterator/go"
+	"github.com/labstack/echo"
+
+	"torb/dialect"
+)
+
+var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+const schema = "CREATE TABLE IF NOT EXISTS audit_logs (" +
+	"id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY," +
+	"administrator_id BIGINT NOT NULL DEFAULT 0," +
+	"action VARCHAR(64) NOT NULL," +
+	"target VARCHAR(128) NOT NULL DEFAULT ''," +
+	"method VARCHAR(8) NOT NULL," +
+	"path VARCHAR(255) NOT NULL," +
+	"status INT NOT NULL," +
+	"ip VARCHAR(64) NOT NULL DEFAULT ''," +
+	"params TEXT," +
+	"before_state MEDIUMTEXT," +
+	"after_state MEDIUMTEXT," +
+	"created_at DATETIME(6) NOT NULL," +
+	"KEY administrator_id (administrator_id, created_at)," +
+	"KEY action (action, created_at)," +
+	"KEY created_at (created_at)" +
+	") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4"
+
+// echo.Context keys set by the handlers
+const (
+	targetKey = "audit_target"
+	beforeKey = "audit_before"
+	afterKey  = "audit_after"
+)
+
+// params with these keys are not stored
+var secretKeys = []string{"password", "token", "secret", "code"}
+
+// Entry is a recorded admin action
+type Entry struct {
+	ID              int64               `json:"id"`
+	AdministratorID int64               `json:"administrator_id"`
+	Action          string              `json:"action"`
+	Target          string              `json:"target,omitempty"`
+	Method          string              `json:"method"`
+	Path            string              `json:"path"`
+	Status          int                 `json:"status"`
+	IP              string              `json:"ip"`
+	Params          jsoniter.RawMessage `json:"params,omitempty"`
+	Before          jsoniter.RawMessage `json:"before,omitempty"`
+	After           jsoniter.RawMessage `json:"after,omitempty"`
+	CreatedAt       time.Time           `json:"created_at"`
+}
+
+// Filter is the condition of Search, zero values are ignored
+type Filter struct {
+	AdministratorID int64
+	Action          string
+	Target          string
+	Since           time.Time
+	Until           time.Time
+	Limit           int
+	Offset          int
+}
+
+// Logger records the entries into the audit_logs table
+type Logger struct {
+	db *sql.DB
+}
+
+// New returns the instance, creating the audit_logs table if not exists
+func New(db *sql.DB, d dialect.Dialect) (*Logger, error) {
+	for _, stmt := range d.Schema(schema) {
+		if _, err := db.Exec(stmt); err != nil {
+			return nil, err
+		}
+	}
+	return &Logger{db: db}, nil
+}
+
+// Record inserts the entry
+func (l *Logger) Record(e *Entry) error {
+	res, err := l.db.Exec("INSERT INTO audit_logs (administrator_id, action, target, method, path, status, ip, params, before_state, after_state, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		e.AdministratorID, e.Action, e.Target, e.Method, e.Path, e.Status, e.IP, nullString(e.Params), nullString(e.Before), nullString(e.After), e.CreatedAt.UTC().Format("2006-01-02 15:04:05.000000"))
+	if err != nil {
+		return err
+	}
+	e.ID, err = res.LastInsertId()
+	return err
+}
+
+// Search returns the entries matching the filter, newest first
+func (l *Logger) Search(f Filter) ([]*Entry, error) {
+	var where []string
+	var args []interface{}
+	if f.AdministratorID != 0 {
+		where = append(where, "administrator_id = ?")
+		args = append(args, f.AdministratorID)
+	}
+	if f.Action != "" {
+		where = append(where, "action = ?")
+		args = append(args, f.Action)
+	}
+	if f.Target != "" {
+		where = append(where, "target = ?")
+		args = append(args, f.Target)
+	}
+	if !f.Since.IsZero() {
+		where = append(where, "created_at >= ?")
+		args = append(args, f.Since.UTC())
+	}
+	if !f.Until.IsZero() {
+		where = append(where, "created_at < ?")
+		args = append(args, f.Until.UTC())
+	}
+	if f.Limit <= 0 || f.Limit > 1000 {
+		f.Limit = 100
+	}
+
+	query := "SELECT id, administrator_id, action, target, method, path, status, ip, params, before_state, after_state, created_at FROM audit_logs"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY id DESC LIMIT ? OFFSET ?"
+	args = append(args, f.Limit, f.Offset)
+
+	rows, err := l.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []*Entry{}
+	for rows.Next() {
+		var e Entry
+		var params, before, after sql.NullString
+		if err := rows.Scan(&e.ID, &e.AdministratorID, &e.Action, &e.Target, &e.Method, &e.Path, &e.Status, &e.IP, &params, &before, &after, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		e.Params = rawMessage(params)
+		e.Before = rawMessage(before)
+		e.After = rawMessage(after)
+		entries = append(entries, &e)
+	}
+	return entries, rows.Err()
+}
+
+// SetTarget sets the resource the action is applied to, such as "event:1"
+func SetTarget(c echo.Context, target string) {
+	c.Set(targetKey, target)
+}
+
+// SetBefore sets the state before the action
+func SetBefore(c echo.Context, v interface{}) {
+	c.Set(beforeKey, v)
+}
+
+// SetAfter sets the state after the action
+func SetAfter(c echo.Context, v interface{}) {
+	c.Set(afterKey, v)
+}
+
+// Target returns the value set by SetTarget
+func Target(c echo.Context) string {
+	target, _ := c.Get(targetKey).(string)
+	return target
+}
+
+// Before returns the value set by SetBefore as JSON
+func Before(c echo.Context) jsoniter.RawMessage {
+	return marshal(c.Get(beforeKey))
+}
+
+// After returns the value set by SetAfter as JSON
+func After(c echo.Context) jsoniter.RawMessage {
+	return marshal(c.Get(afterKey))
+}
+
+// Params returns the path params, query and JSON body as JSON, without secrets such as passwords
+func Params(c echo.Context, body []byte) jsoniter.RawMessage {
+	params := map[string]interface{}{}
+	for i, name := range c.ParamNames() {
+		params[name] = c.ParamValues()[i]
+	}
+	if q := c.QueryParams(); len(q) > 0 {
+		params["query"] = q
+	}
+	if len(body) > 0 {
+		var v interface{}
+		if err := json.Unmarshal(body, &v); err == nil {
+			params["body"] = redact(v)
+		}
+	}
+	if len(params) == 0 {
+		return nil
+	}
+	return marshal(params)
+}
+
+func redact(v interface{}) interface{} {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		for k, vv := range x {
+			if isSecret(k) {
+				x[k] = "[FILTERED]"
+			} else {
+				x[k] = redact(vv)
+			}
+		}
+	case []interface{}:
+		for i := range x {
+			x[i] = redact(x[i])
+		}
+	}
+	return v
+}
+
+func isSecret(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range secretKeys {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func marshal(v interface{}) jsoniter.RawMessage {
+	if v == nil {
+		return nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+func nullString(b jsoniter.RawMessage) sql.NullString {
+	return sql.NullString{String: string(b), Valid: len(b) > 0}
+}
+
+func rawMessage(s sql.NullString) jsoniter.RawMessage {
+	if !s.Valid || s.String == "" {
+		return nil
+	}
+	return jsoniter.RawMessage(s.String)
+}
@@ -1,12 +1,12 @@
 package cache
 
 import (
-	"database/sql"
+	"errors"
 	"fmt"
-	"log"
 	"sort"
 	"strings"
 
+	"torb/repository"
 	. "torb/structs"
 
 	"github.com/go-redis/redis"
@@ -18,39 +18,32 @@ type MyRedisCli redis.Client
 
 var json = jsoniter.ConfigCompatibleWithStandardLibrary
 
-// InitNonCanceledReservations makes map for eventIDs
-func InitNonCanceledReservations(db *sql.DB) error {
-	var reservations []*Reservation
+// ErrUnknownEvent is returned when the event is out of the cached range
+var ErrUnknownEvent = errors.New("event is not in NonCanceledReservations")
 
+// InitNonCanceledReservations makes map for eventIDs up to maxEventLen
+func InitNonCanceledReservations(repo repository.ReservationRepository, maxEventLen int64) error {
 	// fetch all
-	{
-		reservationsRows, err := db.Query("SELECT id, event_id, sheet_id, user_id, reserved_at FROM reservations WHERE canceled_at IS NULL")
-		if err != nil {
-			log.Fatal(err)
-			return err
-		}
-		defer reservationsRows.Close()
-		for reservationsRows.Next() {
-			var reservation Reservation
-			if err := reservationsRows.Scan(&reservation.ID, &reservation.EventID, &reservation.SheetID, &reservation.UserID, &reservation.ReservedAt); err != nil {
-				log.Fatal(err)
-				return err
-			}
-			reservation.ReservedAtUnix = reservation.ReservedAt.Unix()
-			reservations = append(reservations, &reservation)
-		}
+	reservations, err := repo.ListNotCanceled()
+	if err != nil {
+		return err
 	}
+	return SetNonCanceledReservations(reservations, maxEventLen)
+}
 
+// SetNonCanceledReservations makes map for eventIDs from the reservations, such as the ones in a snapshot
+func SetNonCanceledReservations(reservations []*Reservation, maxEventLen int64) error {
 	// init map
 	NonCanceledReservations = map[int64]*SyncReservationMap{}
 
 	// set cache（適当に十分大きな100くらいまで作っておく）
-	const MaxEventLen = int64(100)
-	for eid := int64(1); eid <= MaxEventLen; eid++ {
+	for eid := int64(1); eid <= maxEventLen; eid++ {
 		NonCanceledReservations[eid] = NewSyncReservationMap()
 	}
 	for _, reservation := range reservations {
-		HashSet(reservation.EventID, reservation.ID, reservation)
+		if err := HashSet(reservation.EventID, reservation.ID, reservation); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -62,7 +55,7 @@ func GetReservations(eventID int64) []*Reservation {
 
 	if syncMap, ok := NonCanceledReservations[eventID]; ok {
 		reservations = syncMap.LoadAll()
-		sort.Slice(reservations, func(i, j int) bool { return reservations[i].ReservedAtUnix < reservations[j].ReservedAtUnix })
+		sort.Slice(reservations, func(i, j int) bool { return reservations[i].ReservedAt.Before(*reservations[j].ReservedAt) })
 	}
 
 	return reservations
@@ -88,7 +81,7 @@ func GetReservationsAll(eventIDs []int64) []*Reservation {
 func HashSet(eventID int64, reservationID int64, reservation *Reservation) error {
 	// 初期化時点で十分大きなMapを作っているはずなので、ここで新規作成はありえない
 	if _, ok := NonCanceledReservations[eventID]; !ok {
-		panic("NonCanceledReservations does not have enough eid")
+		return ErrUnknownEvent
 	}
 	NonCanceledReservations[eventID].Store(reservationID, reservation)
 	return nil
@@ -96,7 +89,11 @@ func HashSet(eventID int64, reservationID int64, reservation *Reservation) error
 
 // HashDelete deletes the key from cache
 func HashDelete(eventID int64, reservationID int64) error {
-	NonCanceledReservations[eventID].Delete(reservationID)
+	syncMap, ok := NonCanceledReservations[eventID]
+	if !ok {
+		return ErrUnknownEvent
+	}
+	syncMap.Delete(reservationID)
 	return nil
 }
 
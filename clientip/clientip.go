@@ -0,0 +1,64 @@
+package clientip
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Resolver tells the client address of the requests.
+// X-Forwarded-For and X-Real-IP are only trusted from the trusted proxies, unlike echo's RealIP which trusts anyone,
+// so the address can be used for the login limits and the records.
+type Resolver struct {
+	trusted []*net.IPNet
+}
+
+// New returns the resolver trusting the proxies, nil trusts none and always uses the socket address
+func New(trusted []*net.IPNet) *Resolver {
+	return &Resolver{trusted: trusted}
+}
+
+// IP returns the socket address of the request, or the address forwarded by the trusted proxies
+func (r *Resolver) IP(req *http.Request) string {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+	if !r.Trusted(ip) {
+		return ip
+	}
+
+	// 右から見て最初の信頼していないアドレスがクライアント
+	if xff := req.Header.Get("X-Forwarded-For"); xff != "" {
+		hops := strings.Split(xff, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				break
+			}
+			ip = hop
+			if !r.Trusted(hop) {
+				break
+			}
+		}
+		return ip
+	}
+	if realIP := req.Header.Get("X-Real-Ip"); net.ParseIP(realIP) != nil {
+		return realIP
+	}
+	return ip
+}
+
+// Trusted reports whether ip is one of the trusted proxies
+func (r *Resolver) Trusted(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, proxy := range r.trusted {
+		if proxy.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
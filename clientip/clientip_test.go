@@ -0,0 +1,53 @@
+package clientip
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIP(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	r := New([]*net.IPNet{proxies})
+
+	for _, tt := range []struct {
+		remoteAddr string
+		xff        string
+		realIP     string
+		want       string
+	}{
+		{"192.0.2.1:1234", "", "", "192.0.2.1"},
+		// 信頼していない接続元のヘッダは使わない
+		{"192.0.2.1:1234", "198.51.100.1", "", "192.0.2.1"},
+		{"192.0.2.1:1234", "", "198.51.100.1", "192.0.2.1"},
+		{"10.0.0.1:1234", "198.51.100.1", "", "198.51.100.1"},
+		{"10.0.0.1:1234", "", "198.51.100.1", "198.51.100.1"},
+		// 左端はクライアントが自由に書けるので、右から見て最初の信頼していないアドレス
+		{"10.0.0.1:1234", "203.0.113.9, 198.51.100.1, 10.0.0.2", "", "198.51.100.1"},
+		{"10.0.0.1:1234", "10.0.0.3, 10.0.0.2", "", "10.0.0.3"},
+		{"10.0.0.1:1234", "unknown, 10.0.0.2", "", "10.0.0.2"},
+		{"10.0.0.1:1234", "", "not an ip", "10.0.0.1"},
+		{"[2001:db8::1]:1234", "198.51.100.1", "", "2001:db8::1"},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tt.remoteAddr
+		if tt.xff != "" {
+			req.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		if tt.realIP != "" {
+			req.Header.Set("X-Real-IP", tt.realIP)
+		}
+		if got := r.IP(req); got != tt.want {
+			t.Errorf("IP(%s, X-Forwarded-For %q, X-Real-IP %q) = %s, want %s", tt.remoteAddr, tt.xff, tt.realIP, got, tt.want)
+		}
+	}
+}
+
+func TestIPWithoutProxies(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	if got := New(nil).IP(req); got != "10.0.0.1" {
+		t.Errorf("IP = %s, want the socket address", got)
+	}
+}
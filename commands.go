@@ -0,0 +1,206 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"torb/apitoken"
+	"torb/config"
+	"torb/fixture"
+	"torb/idempotency"
+	"torb/migrate"
+	"torb/rbac"
+	"torb/repository"
+	"torb/seed"
+	"torb/snapshot"
+	"torb/totp"
+)
+
+const commandUsage = `usage:
+  torb [flags]               start the server (torb -h for the flags)
+  torb migrate up            apply all the pending migrations
+  torb migrate down [n]      revert the last n migrations (default 1)
+  torb migrate status        list the migrations and whether they are applied
+  torb seed [flags]          generate users, events and reservations (torb seed -h for the flags)`
+
+// runCommand runs the subcommand and returns the exit status
+func runCommand(cfg *config.Config, args []string) int {
+	switch args[0] {
+	case "migrate":
+		return migrateCommand(args[1:])
+	case "seed":
+		return seedCommand(cfg, args[1:])
+	}
+	fmt.Fprintln(os.Stderr, commandUsage)
+	return 2
+}
+
+func migrateCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, commandUsage)
+		return 2
+	}
+	m, err := migrate.New(db, dbDialect)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	var done []migrate.Migration
+	switch args[0] {
+	case "up":
+		done, err = m.Up()
+	case "down":
+		n := 1
+		if len(args) > 1 {
+			if n, err = strconv.Atoi(args[1]); err != nil || n < 1 {
+				fmt.Fprintln(os.Stderr, commandUsage)
+				return 2
+			}
+		}
+		done, err = m.Down(n)
+	case "status":
+		statuses, err := m.Status()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		for _, status := range statuses {
+			state := "pending"
+			if status.AppliedAt != nil {
+				state = "applied " + status.AppliedAt.UTC().Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d %-40s %s\n", status.Version, status.Name, state)
+		}
+		return 0
+	default:
+		fmt.Fprintln(os.Stderr, commandUsage)
+		return 2
+	}
+
+	for _, migration := range done {
+		fmt.Printf("%s %04d %s\n", args[0], migration.Version, migration.Name)
+	}
+	if len(done) > 0 {
+		if terr := touchChangeMarker(); err == nil {
+			err = terr
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if len(done) == 0 {
+		fmt.Println("no migration to " + args[0])
+	}
+	return 0
+}
+
+// seedCommand generates the data into the DB, resetting the same tables as /initialize,
+// or into the fixture files with -out
+func seedCommand(appCfg *config.Config, args []string) int {
+	cfg := seed.DefaultConfig()
+	fset := flag.NewFlagSet("seed", flag.ContinueOnError)
+	fset.IntVar(&cfg.Users, "users", cfg.Users, "number of users")
+	fset.IntVar(&cfg.Events, "events", cfg.Events, "number of events (up to MAX_EVENT_LEN)")
+	fset.Float64Var(&cfg.ClosedRate, "closed", cfg.ClosedRate, "ratio of the closed events")
+	fset.Float64Var(&cfg.PublicRate, "public", cfg.PublicRate, "ratio of the public events in the events not closed")
+	reserve := fset.String("reserve", "S=0.9,A=0.7,B=0.5,C=0.3", "ratio of the reserved sheets, a value or by rank")
+	cancel := fset.String("cancel", "S=0.05,A=0.1,B=0.1,C=0.2", "ratio of the canceled reservations, a value or by rank")
+	fset.Int64Var(&cfg.Seed, "seed", cfg.Seed, "random seed")
+	out := fset.String("out", "", "write the fixture files into the directory instead of the DB")
+	format := fset.String("format", "csv", "format of the fixture files: csv or sql")
+	if err := fset.Parse(args); err != nil {
+		return 2
+	}
+
+	var err error
+	if cfg.ReserveRates, err = seed.ParseRankRates(*reserve); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if cfg.CancelRates, err = seed.ParseRankRates(*cancel); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	// キャッシュは MAX_EVENT_LEN イベントまでしか持たない
+	if int64(cfg.Events) > appCfg.MaxEventLen {
+		fmt.Fprintf(os.Stderr, "seed: events must be at most %d\n", appCfg.MaxEventLen)
+		return 2
+	}
+	if *format != "csv" && *format != "sql" {
+		fmt.Fprintln(os.Stderr, "seed: format must be csv or sql")
+		return 2
+	}
+
+	tables, err := seed.Generate(cfg, fixture.Embedded())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if *out != "" {
+		if *format == "sql" {
+			err = seed.WriteSQL(*out, tables)
+		} else {
+			err = seed.WriteCSV(*out, tables)
+		}
+	} else {
+		err = seedDB(tables)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	for _, t := range tables {
+		fmt.Printf("%-16s %d rows\n", t.Name, len(t.Rows))
+	}
+	return 0
+}
+
+func seedDB(tables []*seed.Table) error {
+	dir, err := os.MkdirTemp("", "torb-seed")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	if err := seed.WriteCSV(dir, tables); err != nil {
+		return err
+	}
+	// サーバーの起動時に作られるテーブルもここで作っておく
+	repos, err := repository.New(db, dbDialect)
+	if err != nil {
+		return err
+	}
+	if _, err := totp.NewStore(db, dbDialect); err != nil {
+		return err
+	}
+	if _, err := apitoken.New(db, dbDialect); err != nil {
+		return err
+	}
+	if _, err := idempotency.New(db, dbDialect, 0); err != nil {
+		return err
+	}
+	if err := fixture.Truncate(db, dbDialect, initializeTables...); err != nil {
+		return err
+	}
+	if err := fixture.Load(db, os.DirFS(dir)); err != nil {
+		return err
+	}
+	if _, err := repos.Administrators.GrantRoleless(rbac.Superadmin); err != nil {
+		return err
+	}
+	return touchChangeMarker()
+}
+
+// touchChangeMarker records the change of the DB so that the server does not restore an older cache snapshot
+func touchChangeMarker() error {
+	marker, err := snapshot.NewMarker(db, dbDialect)
+	if err != nil {
+		return err
+	}
+	return marker.Touch()
+}
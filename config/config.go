@@ -0,0 +1,415 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"torb/dialect"
+	"torb/rbac"
+	"torb/report"
+	sess "torb/session"
+
+	"github.com/joho/godotenv"
+)
+
+// DefaultFile is read if it exists and no other file is given
+const DefaultFile = "../env.sh"
+
+// EmbeddedFixtures is the INITIALIZE_FIXTURES_DIR which loads the fixtures built into the binary
+const EmbeddedFixtures = "embedded"
+
+// Config is the settings of the server and the commands
+type Config struct {
+	DB DB
+
+	// Listen is the address of the HTTP server
+	Listen string
+	// PprofListen is the address of net/http/pprof, empty disables it
+	PprofListen string
+	// ShutdownTimeout is how long the shutdown waits for the requests in flight
+	ShutdownTimeout time.Duration
+
+	// CacheExpiration and CacheCleanupInterval are for go-cache, 0 means never
+	CacheExpiration      time.Duration
+	CacheCleanupInterval time.Duration
+	// MaxEventLen is the number of events the caches are made for
+	MaxEventLen int64
+	// SnapshotPath is the file of the cache snapshot, empty disables it
+	SnapshotPath string
+	// InitializeFixturesDir is loaded by /initialize, or EmbeddedFixtures.
+	// /initialize refuses to reset the DB if it is empty.
+	InitializeFixturesDir string
+
+	ReportLocation   *time.Location
+	ReportArchiveDir string
+	ReportRetention  time.Duration
+	// ReportSchedule is nil if the reports are not archived
+	ReportSchedule *report.Schedule
+
+	// AdminDefaultRole is the role of the administrators without roles, empty for no permission
+	AdminDefaultRole string
+	TOTPIssuer       string
+	IdempotencyTTL   time.Duration
+
+	LoginMaxFailures   int
+	LoginIPMaxFailures int
+	LoginLockout       time.Duration
+	// TrustedProxies are the reverse proxies whose X-Forwarded-For and X-Real-IP are trusted for the client IP
+	TrustedProxies []*net.IPNet
+
+	Session *sess.Config
+}
+
+// DB is the connection settings of the database
+type DB struct {
+	Driver   dialect.Dialect
+	Host     string
+	Port     string
+	User     string
+	Password string
+	// Database is the schema name of MySQL or the file of SQLite
+	Database string
+
+	// MaxOpenConns, MaxIdleConns, ConnMaxLifetime and ConnMaxIdleTime are the pool settings of database/sql,
+	// 0 is the default of database/sql (unlimited, 2 idle connections, no limit, no limit)
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+	// ConnectTimeout is how long the startup retries the ping
+	ConnectTimeout time.Duration
+
+	// ReplicaHosts are "host:port" of the read replicas of MySQL, with the same user, password, database and pool settings
+	ReplicaHosts []string
+	// ReplicaMaxLag is how long a user reads from the primary after the write to see it
+	ReplicaMaxLag time.Duration
+}
+
+// Default returns the config used when nothing is set
+func Default() *Config {
+	return &Config{
+		DB:                   DB{Driver: dialect.MySQL, ConnectTimeout: 30 * time.Second, ReplicaMaxLag: 5 * time.Second},
+		Listen:               ":8080",
+		PprofListen:          "0.0.0.0:6060",
+		ShutdownTimeout:      10 * time.Second,
+		CacheExpiration:      60 * time.Minute,
+		CacheCleanupInterval: 120 * time.Minute,
+		MaxEventLen:          100,
+		ReportLocation:       time.UTC,
+		ReportArchiveDir:     "../reports",
+		ReportRetention:      7 * 24 * time.Hour,
+		TOTPIssuer:           "torb",
+		IdempotencyTTL:       24 * time.Hour,
+		LoginMaxFailures:     5,
+		LoginIPMaxFailures:   50,
+		LoginLockout:         15 * time.Minute,
+		Session:              sess.DefaultConfig(),
+	}
+}
+
+// Keys are the variables of the config. Each can also be given as a flag such as -db-host.
+var Keys = []struct{ Name, Usage string }{
+	{"DB_DRIVER", "mysql or sqlite3"},
+	{"DB_HOST", "host of MySQL"},
+	{"DB_PORT", "port of MySQL"},
+	{"DB_USER", "user of MySQL"},
+	{"DB_PASS", "password of MySQL"},
+	{"DB_DATABASE", "database of MySQL or file of SQLite (default torb.sqlite3)"},
+	{"DB_MAX_OPEN_CONNS", "max open connections, 0 for unlimited (always 1 for SQLite)"},
+	{"DB_MAX_IDLE_CONNS", "max idle connections, 0 for the default of database/sql (2)"},
+	{"DB_CONN_MAX_LIFETIME", "max lifetime of a connection, 0 for unlimited"},
+	{"DB_CONN_MAX_IDLE_TIME", "max idle time of a connection, 0 for unlimited"},
+	{"DB_CONNECT_TIMEOUT", "how long the startup waits for the database (default 30s)"},
+	{"DB_REPLICA_HOSTS", "\"host:port,host:port\" of the read replicas of MySQL"},
+	{"DB_REPLICA_MAX_LAG", "how long a user reads from the primary after the write (default 5s)"},
+	{"LISTEN", "address of the HTTP server (default :8080)"},
+	{"PPROF_LISTEN", "address of pprof, empty to disable (default 0.0.0.0:6060)"},
+	{"SHUTDOWN_TIMEOUT", "wait for the requests in flight on shutdown (default 10s)"},
+	{"CACHE_EXPIRATION", "expiration of go-cache, 0 for never (default 60m)"},
+	{"CACHE_CLEANUP_INTERVAL", "cleanup interval of go-cache, 0 for never (default 120m)"},
+	{"MAX_EVENT_LEN", "number of events the caches are made for (default 100)"},
+	{"SNAPSHOT_PATH", "file of the cache snapshot, empty to disable"},
+	{"INITIALIZE_FIXTURES_DIR", "fixtures loaded by /initialize, \"embedded\" for the sheets and admin in the binary, the server does not start if unset"},
+	{"REPORT_TZ", "time zone of the sales reports (default UTC)"},
+	{"REPORT_ARCHIVE_DIR", "directory of the archived reports (default ../reports)"},
+	{"REPORT_RETENTION", "retention of the archived reports (default 168h)"},
+	{"REPORT_SCHEDULE", "schedule of the archived reports, empty to disable"},
+	{"ADMIN_DEFAULT_ROLE", "role of the administrators without roles (default none, no permission)"},
+	{"TOTP_ISSUER", "issuer of the TOTP URIs (default torb)"},
+	{"IDEMPOTENCY_TTL", "how long the Idempotency-Key responses are replayed (default 24h)"},
+	{"LOGIN_MAX_FAILURES", "failures before the lockout by login_name (default 5)"},
+	{"LOGIN_IP_MAX_FAILURES", "failures before the lockout by IP (default 50)"},
+	{"LOGIN_LOCKOUT", "duration of the lockout (default 15m)"},
+	{"TRUSTED_PROXIES", "\"cidr,ip\" of the reverse proxies trusted for X-Forwarded-For, empty uses the socket address"},
+	{"SESSION_KEYS", "\"auth1:enc1,auth2:enc2\", newest first"},
+	{"SESSION_COOKIE", "name of the session cookie"},
+	{"SESSION_PATH", "path of the session cookie"},
+	{"SESSION_DOMAIN", "domain of the session cookie"},
+	{"SESSION_MAX_AGE", "max age of the session cookie in seconds"},
+	{"SESSION_SECURE", "secure attribute of the session cookie"},
+	{"SESSION_HTTP_ONLY", "httponly attribute of the session cookie"},
+	{"SESSION_SAME_SITE", "lax, strict, none or default"},
+	{"SESSION_STORE", "memory, mysql or redis"},
+	{"SESSION_REDIS_ADDR", "address of redis for the redis session store"},
+}
+
+// FlagName returns the flag of the key, DB_HOST is -db-host
+func FlagName(key string) string {
+	return strings.ToLower(strings.Replace(key, "_", "-", -1))
+}
+
+// Load loads the config from, in order of priority, the flags in args, the env vars,
+// the file given by -config or CONFIG_FILE (DefaultFile if it exists) and the defaults.
+// It returns the args after the flags, which are the subcommand.
+func Load(args []string) (*Config, []string, error) {
+	fset := flag.NewFlagSet("torb", flag.ContinueOnError)
+	file := fset.String("config", "", "env file of the config (default "+DefaultFile+" if exists)")
+	flags := map[string]string{}
+	for _, key := range Keys {
+		name := key.Name
+		fset.Func(FlagName(name), key.Usage, func(v string) error {
+			flags[name] = v
+			return nil
+		})
+	}
+	if err := fset.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	path, required := *file, true
+	if path == "" {
+		path = os.Getenv("CONFIG_FILE")
+	}
+	if path == "" {
+		path, required = DefaultFile, false
+	}
+	vars, err := godotenv.Read(path)
+	if err != nil {
+		if required || !os.IsNotExist(err) {
+			return nil, nil, fmt.Errorf("config: %s: %v", path, err)
+		}
+		vars = map[string]string{}
+	}
+
+	cfg, err := load(func(key string) (string, bool) {
+		if v, ok := flags[key]; ok {
+			return v, true
+		}
+		if v, ok := os.LookupEnv(key); ok {
+			return v, true
+		}
+		v, ok := vars[key]
+		return v, ok
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return cfg, fset.Args(), cfg.Validate()
+}
+
+func load(lookup func(key string) (string, bool)) (*Config, error) {
+	cfg := Default()
+	l := &loader{lookup: lookup}
+
+	if v, ok := lookup("DB_DRIVER"); ok && v != "" {
+		d, err := dialect.Parse(v)
+		l.check("DB_DRIVER", err)
+		cfg.DB.Driver = d
+	}
+	l.string("DB_HOST", &cfg.DB.Host)
+	l.string("DB_PORT", &cfg.DB.Port)
+	l.string("DB_USER", &cfg.DB.User)
+	l.string("DB_PASS", &cfg.DB.Password)
+	l.string("DB_DATABASE", &cfg.DB.Database)
+	if cfg.DB.Driver == dialect.SQLite && cfg.DB.Database == "" {
+		cfg.DB.Database = "torb.sqlite3"
+	}
+	l.int("DB_MAX_OPEN_CONNS", &cfg.DB.MaxOpenConns)
+	l.int("DB_MAX_IDLE_CONNS", &cfg.DB.MaxIdleConns)
+	l.duration("DB_CONN_MAX_LIFETIME", &cfg.DB.ConnMaxLifetime)
+	l.duration("DB_CONN_MAX_IDLE_TIME", &cfg.DB.ConnMaxIdleTime)
+	l.duration("DB_CONNECT_TIMEOUT", &cfg.DB.ConnectTimeout)
+	if v, ok := lookup("DB_REPLICA_HOSTS"); ok && v != "" {
+		for _, host := range strings.Split(v, ",") {
+			host = strings.TrimSpace(host)
+			_, _, err := net.SplitHostPort(host)
+			l.check("DB_REPLICA_HOSTS", err)
+			cfg.DB.ReplicaHosts = append(cfg.DB.ReplicaHosts, host)
+		}
+	}
+	l.duration("DB_REPLICA_MAX_LAG", &cfg.DB.ReplicaMaxLag)
+
+	l.string("LISTEN", &cfg.Listen)
+	// 空文字は pprof を起動しない
+	if v, ok := lookup("PPROF_LISTEN"); ok {
+		cfg.PprofListen = v
+	}
+	l.duration("SHUTDOWN_TIMEOUT", &cfg.ShutdownTimeout)
+
+	l.duration("CACHE_EXPIRATION", &cfg.CacheExpiration)
+	l.duration("CACHE_CLEANUP_INTERVAL", &cfg.CacheCleanupInterval)
+	if v, ok := lookup("MAX_EVENT_LEN"); ok && v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		l.check("MAX_EVENT_LEN", err)
+		cfg.MaxEventLen = n
+	}
+	l.string("SNAPSHOT_PATH", &cfg.SnapshotPath)
+	l.string("INITIALIZE_FIXTURES_DIR", &cfg.InitializeFixturesDir)
+
+	if v, ok := lookup("REPORT_TZ"); ok && v != "" {
+		loc, err := time.LoadLocation(v)
+		l.check("REPORT_TZ", err)
+		cfg.ReportLocation = loc
+	}
+	l.string("REPORT_ARCHIVE_DIR", &cfg.ReportArchiveDir)
+	l.duration("REPORT_RETENTION", &cfg.ReportRetention)
+	if v, ok := lookup("REPORT_SCHEDULE"); ok && v != "" {
+		schedule, err := report.ParseSchedule(v)
+		l.check("REPORT_SCHEDULE", err)
+		cfg.ReportSchedule = schedule
+	}
+
+	// 空文字は「ロールなし（権限なし）」なので、未設定とは区別する
+	if v, ok := lookup("ADMIN_DEFAULT_ROLE"); ok {
+		cfg.AdminDefaultRole = v
+	}
+	l.string("TOTP_ISSUER", &cfg.TOTPIssuer)
+	l.duration("IDEMPOTENCY_TTL", &cfg.IdempotencyTTL)
+
+	l.int("LOGIN_MAX_FAILURES", &cfg.LoginMaxFailures)
+	l.int("LOGIN_IP_MAX_FAILURES", &cfg.LoginIPMaxFailures)
+	l.duration("LOGIN_LOCKOUT", &cfg.LoginLockout)
+	if v, ok := lookup("TRUSTED_PROXIES"); ok && v != "" {
+		for _, proxy := range strings.Split(v, ",") {
+			proxy = strings.TrimSpace(proxy)
+			// IPだけの場合は /32（IPv6は /128）とみなす
+			if !strings.Contains(proxy, "/") {
+				if net.ParseIP(proxy).To4() != nil {
+					proxy += "/32"
+				} else {
+					proxy += "/128"
+				}
+			}
+			_, ipNet, err := net.ParseCIDR(proxy)
+			l.check("TRUSTED_PROXIES", err)
+			if ipNet != nil {
+				cfg.TrustedProxies = append(cfg.TrustedProxies, ipNet)
+			}
+		}
+	}
+
+	if l.err != nil {
+		return nil, l.err
+	}
+	session, err := sess.LoadConfig(func(key string) string {
+		v, _ := lookup(key)
+		return v
+	})
+	if err != nil {
+		return nil, fmt.Errorf("config: %v", err)
+	}
+	cfg.Session = session
+	return cfg, nil
+}
+
+// Validate checks the values which are parsed but may be out of range
+func (cfg *Config) Validate() error {
+	if cfg.Listen == "" {
+		return errors.New("config: LISTEN is empty")
+	}
+	if cfg.DB.Database == "" {
+		return errors.New("config: DB_DATABASE is empty")
+	}
+	if cfg.DB.MaxOpenConns < 0 || cfg.DB.MaxIdleConns < 0 || cfg.DB.ConnMaxLifetime < 0 || cfg.DB.ConnMaxIdleTime < 0 {
+		return errors.New("config: DB_MAX_OPEN_CONNS, DB_MAX_IDLE_CONNS, DB_CONN_MAX_LIFETIME and DB_CONN_MAX_IDLE_TIME must not be negative")
+	}
+	if cfg.DB.Driver == dialect.SQLite && cfg.DB.MaxOpenConns > 1 {
+		return errors.New("config: DB_MAX_OPEN_CONNS must be 1 for SQLite")
+	}
+	if cfg.DB.Driver == dialect.SQLite && len(cfg.DB.ReplicaHosts) > 0 {
+		return errors.New("config: DB_REPLICA_HOSTS requires DB_DRIVER=mysql")
+	}
+	if cfg.DB.ReplicaMaxLag < 0 {
+		return errors.New("config: DB_REPLICA_MAX_LAG must not be negative")
+	}
+	if cfg.DB.ConnectTimeout <= 0 {
+		return errors.New("config: DB_CONNECT_TIMEOUT must be positive")
+	}
+	if cfg.ShutdownTimeout <= 0 {
+		return errors.New("config: SHUTDOWN_TIMEOUT must be positive")
+	}
+	if cfg.CacheExpiration < 0 || cfg.CacheCleanupInterval < 0 {
+		return errors.New("config: CACHE_EXPIRATION and CACHE_CLEANUP_INTERVAL must not be negative")
+	}
+	if cfg.MaxEventLen < 1 {
+		return errors.New("config: MAX_EVENT_LEN must be positive")
+	}
+	if dir := cfg.InitializeFixturesDir; dir != "" && dir != EmbeddedFixtures {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return fmt.Errorf("config: INITIALIZE_FIXTURES_DIR: %s is not a directory", dir)
+		}
+	}
+	if cfg.ReportRetention <= 0 {
+		return errors.New("config: REPORT_RETENTION must be positive")
+	}
+	if cfg.AdminDefaultRole != "" && !rbac.ValidRole(cfg.AdminDefaultRole) {
+		return fmt.Errorf("config: ADMIN_DEFAULT_ROLE: unknown role %q", cfg.AdminDefaultRole)
+	}
+	if cfg.TOTPIssuer == "" {
+		return errors.New("config: TOTP_ISSUER is empty")
+	}
+	if cfg.IdempotencyTTL <= 0 {
+		return errors.New("config: IDEMPOTENCY_TTL must be positive")
+	}
+	if cfg.LoginMaxFailures < 1 || cfg.LoginIPMaxFailures < 1 {
+		return errors.New("config: LOGIN_MAX_FAILURES and LOGIN_IP_MAX_FAILURES must be positive")
+	}
+	if cfg.LoginLockout <= 0 {
+		return errors.New("config: LOGIN_LOCKOUT must be positive")
+	}
+	if cfg.Session.Store == "mysql" && cfg.DB.Driver != dialect.MySQL {
+		return errors.New("config: SESSION_STORE=mysql requires DB_DRIVER=mysql")
+	}
+	return cfg.Session.Validate()
+}
+
+// loader keeps the first error of parsing the values
+type loader struct {
+	lookup func(key string) (string, bool)
+	err    error
+}
+
+func (l *loader) check(key string, err error) {
+	if err != nil && l.err == nil {
+		l.err = fmt.Errorf("config: %s: %v", key, err)
+	}
+}
+
+// string sets the value if it is set and not empty
+func (l *loader) string(key string, dst *string) {
+	if v, ok := l.lookup(key); ok && v != "" {
+		*dst = v
+	}
+}
+
+func (l *loader) duration(key string, dst *time.Duration) {
+	if v, ok := l.lookup(key); ok && v != "" {
+		d, err := time.ParseDuration(v)
+		l.check(key, err)
+		*dst = d
+	}
+}
+
+func (l *loader) int(key string, dst *int) {
+	if v, ok := l.lookup(key); ok && v != "" {
+		n, err := strconv.Atoi(v)
+		l.check(key, err)
+		*dst = n
+	}
+}
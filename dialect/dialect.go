@@ -0,0 +1,154 @@
+package dialect
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Dialect is the SQL flavor of a database/sql driver
+type Dialect string
+
+// Supported dialects, the values are the driver names
+const (
+	MySQL  Dialect = "mysql"
+	SQLite Dialect = "sqlite3"
+)
+
+// Parse returns the dialect of the driver name, "" is MySQL
+func Parse(driver string) (Dialect, error) {
+	switch strings.ToLower(driver) {
+	case "", "mysql":
+		return MySQL, nil
+	case "sqlite", "sqlite3":
+		return SQLite, nil
+	}
+	return "", fmt.Errorf("dialect: unsupported driver %q", driver)
+}
+
+var (
+	createTableRe    = regexp.MustCompile(`(?i)^CREATE TABLE IF NOT EXISTS (\w+)`)
+	autoIncrementRe  = regexp.MustCompile(`(?i)\bBIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY\b`)
+	datetimeRe       = regexp.MustCompile(`(?i)\bDATETIME\(\d\)`)
+	tableOptionsRe   = regexp.MustCompile(`(?i)\)\s*ENGINE=.*$`)
+	indexRe          = regexp.MustCompile(`(?i),\s*(UNIQUE )?KEY (\w+) \(([^)]*)\)`)
+	valuesFunctionRe = regexp.MustCompile(`(?i)\bVALUES\((\w+)\)`)
+	createIndexRe    = regexp.MustCompile(`(?i)^CREATE (UNIQUE )?INDEX (IF NOT EXISTS )?(\w+) ON (\w+)`)
+	indexColumnRe    = regexp.MustCompile(`^\s*\(\s*` + "`?" + `(\w+)`)
+	dropIndexRe      = regexp.MustCompile(`(?i)^DROP INDEX (IF EXISTS )?(\w+) ON (\w+)$`)
+)
+
+// Schema rewrites a MySQL DDL statement into the statements of the dialect.
+// For SQLite the indexes are named <table>_<key> since their names are not scoped by the table,
+// and the inline KEYs of "CREATE TABLE IF NOT EXISTS" become CREATE INDEX statements.
+// "CREATE INDEX IF NOT EXISTS" and "DROP INDEX IF EXISTS" are accepted although MySQL lacks them,
+// see IndexIfNotExists and DropIndexIfExists.
+func (d Dialect) Schema(mysql string) []string {
+	if d != SQLite {
+		return []string{mysql}
+	}
+	if createIndexRe.MatchString(mysql) {
+		return []string{createIndexRe.ReplaceAllString(mysql, "CREATE ${1}INDEX ${2}${4}_${3} ON $4")}
+	}
+	if dropIndexRe.MatchString(mysql) {
+		return []string{dropIndexRe.ReplaceAllString(mysql, "DROP INDEX IF EXISTS ${3}_${2}")}
+	}
+	m := createTableRe.FindStringSubmatch(mysql)
+	if m == nil {
+		return []string{mysql}
+	}
+	table := m[1]
+
+	var indexes []string
+	s := indexRe.ReplaceAllStringFunc(mysql, func(key string) string {
+		k := indexRe.FindStringSubmatch(key)
+		indexes = append(indexes, fmt.Sprintf("CREATE %sINDEX IF NOT EXISTS %s_%s ON %s (%s)", strings.ToUpper(k[1]), table, k[2], table, k[3]))
+		return ""
+	})
+	s = autoIncrementRe.ReplaceAllString(s, "INTEGER PRIMARY KEY AUTOINCREMENT")
+	s = datetimeRe.ReplaceAllString(s, "DATETIME")
+	s = tableOptionsRe.ReplaceAllString(s, ")")
+	return append([]string{s}, indexes...)
+}
+
+// Index is the index of "CREATE INDEX IF NOT EXISTS" parsed by IndexIfNotExists
+type Index struct {
+	Name   string
+	Table  string
+	Column string // the first column
+	Unique bool
+}
+
+// IndexIfNotExists parses "CREATE [UNIQUE] INDEX IF NOT EXISTS <index> ON <table> (<column>, ...)".
+// IF NOT EXISTS only looks at the name in SQLite and does not exist in MySQL, so the caller instead checks
+// IndexExistsQuery, which finds the index on the same first column whatever its name, such as one added by hand,
+// and runs stmt (without IF NOT EXISTS, still to be rewritten by Schema) if it is missing.
+// ok is false for the other statements.
+func (d Dialect) IndexIfNotExists(mysql string) (index Index, stmt string, ok bool) {
+	m := createIndexRe.FindStringSubmatch(mysql)
+	if m == nil || m[2] == "" {
+		return Index{}, mysql, false
+	}
+	column := indexColumnRe.FindStringSubmatch(mysql[len(m[0]):])
+	if column == nil {
+		return Index{}, mysql, false
+	}
+	index = Index{Name: m[3], Table: m[4], Column: column[1], Unique: m[1] != ""}
+	return index, createIndexRe.ReplaceAllString(mysql, "CREATE ${1}INDEX $3 ON $4"), true
+}
+
+// IndexExistsQuery returns the query selecting whether the table has an index starting with the column of index,
+// a unique one if index is unique
+func (d Dialect) IndexExistsQuery(index Index) (string, []interface{}) {
+	if d == SQLite {
+		q := "SELECT EXISTS (SELECT 1 FROM pragma_index_list(?) l, pragma_index_info(l.name) i WHERE i.seqno = 0 AND i.name = ?"
+		if index.Unique {
+			q += " AND l.\"unique\" = 1"
+		}
+		return q + ")", []interface{}{index.Table, index.Column}
+	}
+	q := "SELECT EXISTS (SELECT 1 FROM information_schema.statistics WHERE table_schema = DATABASE() AND table_name = ? AND column_name = ? AND seq_in_index = 1"
+	if index.Unique {
+		q += " AND non_unique = 0"
+	}
+	return q + ")", []interface{}{index.Table, index.Column}
+}
+
+// DropIndexIfExists parses "DROP INDEX IF EXISTS <index> ON <table>" for MySQL, which has no such syntax.
+// It returns the query selecting whether the index exists and the statement without IF EXISTS to run if so.
+// ok is false for the other statements and for SQLite, which supports the syntax.
+func (d Dialect) DropIndexIfExists(mysql string) (query string, args []interface{}, stmt string, ok bool) {
+	m := dropIndexRe.FindStringSubmatch(mysql)
+	if d == SQLite || m == nil || m[1] == "" {
+		return "", nil, mysql, false
+	}
+	query = "SELECT EXISTS (SELECT 1 FROM information_schema.statistics WHERE table_schema = DATABASE() AND table_name = ? AND index_name = ?)"
+	return query, []interface{}{m[3], m[2]}, dropIndexRe.ReplaceAllString(mysql, "DROP INDEX $2 ON $3"), true
+}
+
+// InsertIgnore returns the INSERT which skips the rows conflicting with a unique key
+func (d Dialect) InsertIgnore() string {
+	if d == SQLite {
+		return "INSERT OR IGNORE"
+	}
+	return "INSERT IGNORE"
+}
+
+// OnDuplicateKeyUpdate returns the upsert clause of the INSERT.
+// set is written in MySQL syntax, VALUES(col) refers to the inserted value.
+// key is the conflicting columns, which SQLite requires.
+func (d Dialect) OnDuplicateKeyUpdate(key, set string) string {
+	if d == SQLite {
+		return "ON CONFLICT (" + key + ") DO UPDATE SET " + valuesFunctionRe.ReplaceAllString(set, "excluded.$1")
+	}
+	return "ON DUPLICATE KEY UPDATE " + set
+}
+
+// Truncate returns the statements which delete all the rows of the table and reset its auto increment
+func (d Dialect) Truncate(table string) []string {
+	if d == SQLite {
+		// sqlite_sequence はAUTOINCREMENTのテーブルを作った時点で存在する
+		return []string{"DELETE FROM " + table, "DELETE FROM sqlite_sequence WHERE name = '" + table + "'"}
+	}
+	return []string{"TRUNCATE TABLE " + table}
+}
@@ -0,0 +1,85 @@
+package dialect
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSchemaIndexes(t *testing.T) {
+	for _, tt := range []struct {
+		d     Dialect
+		mysql string
+		want  []string
+	}{
+		{MySQL, "CREATE INDEX user_id_idx ON reservations (user_id)", []string{"CREATE INDEX user_id_idx ON reservations (user_id)"}},
+		{SQLite, "CREATE INDEX user_id_idx ON reservations (user_id)", []string{"CREATE INDEX reservations_user_id_idx ON reservations (user_id)"}},
+		{SQLite, "CREATE UNIQUE INDEX uniq ON users (login_name)", []string{"CREATE UNIQUE INDEX users_uniq ON users (login_name)"}},
+		{SQLite, "CREATE INDEX IF NOT EXISTS user_id_idx ON reservations (user_id)", []string{"CREATE INDEX IF NOT EXISTS reservations_user_id_idx ON reservations (user_id)"}},
+		{MySQL, "DROP INDEX user_id_idx ON reservations", []string{"DROP INDEX user_id_idx ON reservations"}},
+		{SQLite, "DROP INDEX user_id_idx ON reservations", []string{"DROP INDEX IF EXISTS reservations_user_id_idx"}},
+		{SQLite, "DROP INDEX IF EXISTS user_id_idx ON reservations", []string{"DROP INDEX IF EXISTS reservations_user_id_idx"}},
+	} {
+		if got := tt.d.Schema(tt.mysql); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s.Schema(%q) = %q, want %q", tt.d, tt.mysql, got, tt.want)
+		}
+	}
+}
+
+func TestIndexIfNotExists(t *testing.T) {
+	for _, d := range []Dialect{MySQL, SQLite} {
+		index, stmt, ok := d.IndexIfNotExists("CREATE INDEX IF NOT EXISTS user_id_idx ON reservations (user_id, id)")
+		want := Index{Name: "user_id_idx", Table: "reservations", Column: "user_id"}
+		if !ok || index != want || stmt != "CREATE INDEX user_id_idx ON reservations (user_id, id)" {
+			t.Errorf("%s.IndexIfNotExists = %+v, %q, %v", d, index, stmt, ok)
+		}
+	}
+	index, _, ok := MySQL.IndexIfNotExists("CREATE UNIQUE INDEX IF NOT EXISTS uniq ON users (`login_name`)")
+	if want := (Index{Name: "uniq", Table: "users", Column: "login_name", Unique: true}); !ok || index != want {
+		t.Errorf("IndexIfNotExists unique = %+v, %v", index, ok)
+	}
+	for _, mysql := range []string{
+		"CREATE INDEX user_id_idx ON reservations (user_id)",
+		"DROP INDEX user_id_idx ON reservations",
+		"CREATE TABLE IF NOT EXISTS t (id BIGINT)",
+	} {
+		if _, stmt, ok := MySQL.IndexIfNotExists(mysql); ok || stmt != mysql {
+			t.Errorf("IndexIfNotExists(%q) = %q, %v, want unchanged", mysql, stmt, ok)
+		}
+	}
+}
+
+func TestIndexExistsQuery(t *testing.T) {
+	index := Index{Name: "user_id_idx", Table: "reservations", Column: "user_id"}
+	for _, d := range []Dialect{MySQL, SQLite} {
+		// 名前ではなく表と先頭の列で探す
+		query, args := d.IndexExistsQuery(index)
+		if !reflect.DeepEqual(args, []interface{}{"reservations", "user_id"}) || strings.Contains(query, "unique") {
+			t.Errorf("%s.IndexExistsQuery = %q, %v", d, query, args)
+		}
+		index.Unique = true
+		if query, _ := d.IndexExistsQuery(index); !strings.Contains(query, "unique") {
+			t.Errorf("%s.IndexExistsQuery unique = %q", d, query)
+		}
+		index.Unique = false
+	}
+}
+
+func TestDropIndexIfExists(t *testing.T) {
+	query, args, stmt, ok := MySQL.DropIndexIfExists("DROP INDEX IF EXISTS user_id_idx ON reservations")
+	if !ok || query == "" || !reflect.DeepEqual(args, []interface{}{"reservations", "user_id_idx"}) || stmt != "DROP INDEX user_id_idx ON reservations" {
+		t.Errorf("DropIndexIfExists = %q, %v, %q, %v", query, args, stmt, ok)
+	}
+	for _, tt := range []struct {
+		d     Dialect
+		mysql string
+	}{
+		{MySQL, "DROP INDEX user_id_idx ON reservations"},
+		{MySQL, "CREATE INDEX IF NOT EXISTS user_id_idx ON reservations (user_id)"},
+		{SQLite, "DROP INDEX IF EXISTS user_id_idx ON reservations"},
+	} {
+		if _, _, stmt, ok := tt.d.DropIndexIfExists(tt.mysql); ok || stmt != tt.mysql {
+			t.Errorf("%s.DropIndexIfExists(%q) = %q, %v, want unchanged", tt.d, tt.mysql, stmt, ok)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package fixture
+
+import (
+	"bufio"
+	"compress/gzip"
+	"database/sql"
+	"embed"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+
+	"torb/dialect"
+)
+
+// the default data: the sheets of the venue and the administrator admin/admin
+//
+//go:embed data/*.csv
+var embedded embed.FS
+
+// Null is the CSV value loaded as NULL, the same as mysqldump
+const Null = `\N`
+
+// Embedded returns the fixtures built into the binary
+func Embedded() fs.FS {
+	sub, err := fs.Sub(embedded, "data")
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}
+
+// Truncate deletes all the rows of the tables and resets their auto increments
+func Truncate(db *sql.DB, d dialect.Dialect, tables ...string) error {
+	for _, table := range tables {
+		for _, stmt := range d.Truncate(table) {
+			if _, err := db.Exec(stmt); err != nil {
+				return fmt.Errorf("truncate %s: %w", table, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Load loads the files at the root of fsys ordered by name:
+//
+//	<table>.csv   rows of the table, the header is the column names
+//	*.sql         statements separated by ";" at the end of the lines, such as a mysqldump
+//	*.sql.gz      gzipped *.sql
+//
+// Other files are ignored.
+func Load(db *sql.DB, fsys fs.FS) error {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			continue
+		}
+		var err error
+		switch {
+		case strings.HasSuffix(name, ".csv"):
+			err = loadFile(fsys, name, false, func(r io.Reader) error {
+				return loadCSV(db, strings.TrimSuffix(name, ".csv"), r)
+			})
+		case strings.HasSuffix(name, ".sql"):
+			err = loadFile(fsys, name, false, func(r io.Reader) error { return loadSQL(db, r) })
+		case strings.HasSuffix(name, ".sql.gz"):
+			err = loadFile(fsys, name, true, func(r io.Reader) error { return loadSQL(db, r) })
+		default:
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("load %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func loadFile(fsys fs.FS, name string, gzipped bool, load func(io.Reader) error) error {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if gzipped {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	return load(r)
+}
+
+func loadCSV(db *sql.DB, table string, r io.Reader) error {
+	cr := csv.NewReader(r)
+	columns, err := cr.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		// rank のような予約語も使えるようにクォートする（SQLiteもバッククォートを受け付ける）
+		quoted[i] = "`" + strings.TrimSpace(column) + "`"
+	}
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", table, strings.Join(quoted, ", "), strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", "))
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(query)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	args := make([]interface{}, len(columns))
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		for i, v := range record {
+			if v == Null {
+				args[i] = nil
+			} else {
+				args[i] = v
+			}
+		}
+		if _, err := stmt.Exec(args...); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func loadSQL(db *sql.DB, r io.Reader) error {
+	br := bufio.NewReader(r)
+	var stmt strings.Builder
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		trimmed := strings.TrimSpace(line)
+		if trimmed != "" && !strings.HasPrefix(trimmed, "--") {
+			stmt.WriteString(line)
+			if strings.HasSuffix(trimmed, ";") {
+				if _, err := db.Exec(stmt.String()); err != nil {
+					return err
+				}
+				stmt.Reset()
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	if strings.TrimSpace(stmt.String()) != "" {
+		_, err := db.Exec(stmt.String())
+		return err
+	}
+	return nil
+}
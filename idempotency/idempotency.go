@@ -0,0 +1,159 @@
+package idempotency
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"torb/dialect"
+)
+
+const schema = "CREATE TABLE IF NOT EXISTS idempotency_keys (" +
+	"scope VARCHAR(255) NOT NULL," +
+	"idempotency_key VARCHAR(255) NOT NULL," +
+	"fingerprint CHAR(64) NOT NULL," +
+	"status INT NOT NULL DEFAULT 0," +
+	"content_type VARCHAR(128) NOT NULL DEFAULT ''," +
+	"body MEDIUMBLOB," +
+	"created_at DATETIME(6) NOT NULL," +
+	"completed_at DATETIME(6) NULL," +
+	"expires_at DATETIME(6) NOT NULL," +
+	"PRIMARY KEY (scope, idempotency_key)," +
+	"KEY expires_at (expires_at)" +
+	") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4"
+
+// LockTimeout is how long a request holds the key, after that it is treated as crashed and the key can be retried
+const LockTimeout = time.Minute
+
+// MaxKeyLength is the longest Idempotency-Key accepted
+const MaxKeyLength = 255
+
+// how often Begin deletes the expired keys of all the scopes
+const purgeInterval = time.Minute
+
+var (
+	// ErrInProgress is returned while the first request with the key is not finished
+	ErrInProgress = errors.New("idempotency key is in progress")
+	// ErrMismatch is returned when the key was used for another request
+	ErrMismatch = errors.New("idempotency key is used for another request")
+)
+
+// Response is the stored response of the first request
+type Response struct {
+	Status      int
+	ContentType string
+	Body        []byte
+}
+
+// Store keeps the keys in the idempotency_keys table
+type Store struct {
+	db  *sql.DB
+	d   dialect.Dialect
+	ttl time.Duration
+	now func() time.Time
+
+	mu         sync.Mutex
+	lastPurged time.Time
+}
+
+// New returns the instance which replays the responses for ttl, creating the table if not exists
+func New(db *sql.DB, d dialect.Dialect, ttl time.Duration) (*Store, error) {
+	for _, stmt := range d.Schema(schema) {
+		if _, err := db.Exec(stmt); err != nil {
+			return nil, err
+		}
+	}
+	return &Store{db: db, d: d, ttl: ttl, now: time.Now}, nil
+}
+
+// Fingerprint identifies the request, the same key must be used with the same fingerprint
+func Fingerprint(method, path string, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(method + " " + path + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Begin takes the key for the request.
+// It returns the stored response if the request was already done, nil if the caller should process it
+// and call Complete or Abort.
+func (s *Store) Begin(scope, key, fingerprint string) (*Response, error) {
+	now := s.now().UTC()
+	if err := s.purge(now); err != nil {
+		return nil, err
+	}
+	// 期限切れの記録と、途中で落ちたリクエストの記録は取り直せるようにする
+	if _, err := s.db.Exec("DELETE FROM idempotency_keys WHERE scope = ? AND idempotency_key = ? AND (expires_at <= ? OR (completed_at IS NULL AND created_at <= ?))",
+		scope, key, now, now.Add(-LockTimeout)); err != nil {
+		return nil, err
+	}
+
+	// 同時に来た重複リクエストは主キーで1つだけが挿入に成功する
+	res, err := s.db.Exec(s.d.InsertIgnore()+" INTO idempotency_keys (scope, idempotency_key, fingerprint, created_at, expires_at) VALUES (?, ?, ?, ?, ?)",
+		scope, key, fingerprint, now, now.Add(s.ttl))
+	if err != nil {
+		return nil, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if n == 1 {
+		return nil, nil
+	}
+
+	var stored string
+	var completedAt *time.Time
+	response := &Response{}
+	err = s.db.QueryRow("SELECT fingerprint, status, content_type, body, completed_at FROM idempotency_keys WHERE scope = ? AND idempotency_key = ?", scope, key).
+		Scan(&stored, &response.Status, &response.ContentType, &response.Body, &completedAt)
+	if err == sql.ErrNoRows {
+		// 挿入と確認の間に中断された場合
+		return nil, ErrInProgress
+	}
+	if err != nil {
+		return nil, err
+	}
+	if stored != fingerprint {
+		return nil, ErrMismatch
+	}
+	if completedAt == nil {
+		return nil, ErrInProgress
+	}
+	return response, nil
+}
+
+// Complete stores the response to be replayed for the key
+func (s *Store) Complete(scope, key string, response *Response) error {
+	_, err := s.db.Exec("UPDATE idempotency_keys SET status = ?, content_type = ?, body = ?, completed_at = ? WHERE scope = ? AND idempotency_key = ?",
+		response.Status, response.ContentType, response.Body, s.now().UTC(), scope, key)
+	return err
+}
+
+// Abort releases the key without a response so that the request can be retried
+func (s *Store) Abort(scope, key string) error {
+	_, err := s.db.Exec("DELETE FROM idempotency_keys WHERE scope = ? AND idempotency_key = ? AND completed_at IS NULL", scope, key)
+	return err
+}
+
+// DeleteExpired deletes the expired keys of all the scopes, Begin calls it every purgeInterval
+func (s *Store) DeleteExpired() error {
+	_, err := s.db.Exec("DELETE FROM idempotency_keys WHERE expires_at <= ?", s.now().UTC())
+	return err
+}
+
+// purge calls DeleteExpired if purgeInterval has passed since the last one.
+// 期限切れの記録は同じキーが来たときしか消えないので、まとめて消さないとテーブルが増え続ける
+func (s *Store) purge(now time.Time) error {
+	s.mu.Lock()
+	if now.Sub(s.lastPurged) < purgeInterval {
+		s.mu.Unlock()
+		return nil
+	}
+	s.lastPurged = now
+	s.mu.Unlock()
+	return s.DeleteExpired()
+}
@@ -0,0 +1,138 @@
+package idempotency
+
+import (
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"torb/dialect"
+)
+
+// newStore returns the store on a new SQLite database with the clock moved by the returned function
+func newStore(t *testing.T, ttl time.Duration) (*Store, *sql.DB, func(d time.Duration)) {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "torb.sqlite3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	s, err := New(db, dialect.SQLite, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+	return s, db, func(d time.Duration) { now = now.Add(d) }
+}
+
+func count(t *testing.T, db *sql.DB) int {
+	t.Helper()
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM idempotency_keys").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestReplay(t *testing.T) {
+	s, _, _ := newStore(t, time.Hour)
+	fp := Fingerprint("POST", "/api/users", []byte(`{}`))
+
+	if res, err := s.Begin("user:1", "key", fp); res != nil || err != nil {
+		t.Fatalf("first Begin = %v, %v, want nil", res, err)
+	}
+	if _, err := s.Begin("user:1", "key", fp); err != ErrInProgress {
+		t.Errorf("Begin in progress: %v, want ErrInProgress", err)
+	}
+	want := &Response{Status: 201, ContentType: "application/json", Body: []byte(`{"id":1}`)}
+	if err := s.Complete("user:1", "key", want); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := s.Begin("user:1", "key", fp); err != nil || !reflect.DeepEqual(res, want) {
+		t.Errorf("Begin after Complete = %+v, %v, want %+v", res, err, want)
+	}
+	if _, err := s.Begin("user:1", "key", Fingerprint("POST", "/api/users", []byte(`{"a":1}`))); err != ErrMismatch {
+		t.Errorf("Begin with another request: %v, want ErrMismatch", err)
+	}
+	// キーはスコープごと
+	if res, err := s.Begin("user:2", "key", fp); res != nil || err != nil {
+		t.Errorf("Begin of another scope = %v, %v, want nil", res, err)
+	}
+}
+
+func TestAbort(t *testing.T) {
+	s, _, _ := newStore(t, time.Hour)
+	fp := Fingerprint("POST", "/api/users", nil)
+	if _, err := s.Begin("user:1", "key", fp); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Abort("user:1", "key"); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := s.Begin("user:1", "key", fp); res != nil || err != nil {
+		t.Errorf("Begin after Abort = %v, %v, want nil", res, err)
+	}
+}
+
+func TestLockTimeout(t *testing.T) {
+	s, _, advance := newStore(t, time.Hour)
+	fp := Fingerprint("POST", "/api/users", nil)
+	if _, err := s.Begin("user:1", "key", fp); err != nil {
+		t.Fatal(err)
+	}
+	// 途中で落ちたリクエストのキーは LockTimeout 後に取り直せる
+	advance(LockTimeout)
+	if res, err := s.Begin("user:1", "key", fp); res != nil || err != nil {
+		t.Errorf("Begin after LockTimeout = %v, %v, want nil", res, err)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	s, db, advance := newStore(t, time.Hour)
+	fp := Fingerprint("POST", "/api/users", nil)
+	for _, key := range []string{"a", "b"} {
+		if _, err := s.Begin("user:1", key, fp); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Complete("user:1", key, &Response{Status: 201}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 期限が切れたら再送せず、処理し直させる
+	advance(time.Hour)
+	if res, err := s.Begin("user:1", "a", fp); res != nil || err != nil {
+		t.Errorf("Begin after the ttl = %v, %v, want nil", res, err)
+	}
+	// 他のキーの期限切れの記録もまとめて消える
+	if n := count(t, db); n != 1 {
+		t.Errorf("%d keys after the purge, want only a", n)
+	}
+}
+
+func TestPurgeInterval(t *testing.T) {
+	s, db, advance := newStore(t, 10*time.Second)
+	fp := Fingerprint("POST", "/api/users", nil)
+	if _, err := s.Begin("user:1", "a", fp); err != nil {
+		t.Fatal(err)
+	}
+	// purgeInterval 経つまではまとめて消さない
+	advance(20 * time.Second)
+	if _, err := s.Begin("user:1", "b", fp); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(t, db); n != 2 {
+		t.Errorf("%d keys before purgeInterval, want the expired a and b", n)
+	}
+	advance(purgeInterval)
+	if _, err := s.Begin("user:1", "c", fp); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(t, db); n != 1 {
+		t.Errorf("%d keys after purgeInterval, want only c", n)
+	}
+}
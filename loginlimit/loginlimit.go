@@ -0,0 +1,142 @@
+package loginlimit
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Config is the settings of the Limiter
+type Config struct {
+	// MaxFailures is the number of consecutive failures before the lockout
+	MaxFailures int
+	// BaseDelay is the wait after the first failure, doubled on every failure up to MaxDelay.
+	// 0 disables the backoff, the key is blocked only by the lockout.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Lockout is the wait after MaxFailures failures, failures are forgotten after Lockout without failure
+	Lockout time.Duration
+}
+
+// Limiter counts login failures per key (login_name or client IP) in memory
+type Limiter struct {
+	cfg Config
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*entry
+	fails   int
+}
+
+type entry struct {
+	failures     int
+	lastFailure  time.Time
+	blockedUntil time.Time
+}
+
+// Lock is a key under backoff or lockout
+type Lock struct {
+	Key          string    `json:"key"`
+	Failures     int       `json:"failures"`
+	LockedOut    bool      `json:"locked_out"`
+	BlockedUntil time.Time `json:"blocked_until"`
+}
+
+// New returns the instance
+func New(cfg Config) *Limiter {
+	return &Limiter{cfg: cfg, now: time.Now, entries: map[string]*entry{}}
+}
+
+// Wait returns how long the key must wait before the next attempt, 0 if allowed
+func (l *Limiter) Wait(key string) time.Duration {
+	now := l.now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, ok := l.entries[key]
+	if !ok {
+		return 0
+	}
+	if l.stale(e, now) {
+		delete(l.entries, key)
+		return 0
+	}
+	if e.blockedUntil.After(now) {
+		return e.blockedUntil.Sub(now)
+	}
+	return 0
+}
+
+// Fail records a failure and returns the wait before the next attempt
+func (l *Limiter) Fail(key string) time.Duration {
+	now := l.now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// ときどき古いエントリを掃除する
+	l.fails++
+	if l.fails%1024 == 0 {
+		for k, e := range l.entries {
+			if l.stale(e, now) {
+				delete(l.entries, k)
+			}
+		}
+	}
+
+	e, ok := l.entries[key]
+	if !ok || l.stale(e, now) {
+		e = &entry{}
+		l.entries[key] = e
+	}
+	e.failures++
+	e.lastFailure = now
+
+	wait := l.cfg.Lockout
+	if e.failures < l.cfg.MaxFailures && l.cfg.BaseDelay <= 0 {
+		wait = 0
+	} else if e.failures < l.cfg.MaxFailures {
+		wait = l.cfg.BaseDelay << uint(e.failures-1)
+		if wait > l.cfg.MaxDelay || wait <= 0 {
+			wait = l.cfg.MaxDelay
+		}
+	}
+	e.blockedUntil = now.Add(wait)
+	return wait
+}
+
+// Reset forgets the failures of the key, used on successful login and by admins to unlock
+func (l *Limiter) Reset(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.entries[key]
+	delete(l.entries, key)
+	return ok
+}
+
+// Locks returns the keys currently under backoff or lockout
+func (l *Limiter) Locks() []*Lock {
+	now := l.now()
+	locks := []*Lock{}
+
+	l.mu.Lock()
+	for k, e := range l.entries {
+		if !e.blockedUntil.After(now) {
+			continue
+		}
+		locks = append(locks, &Lock{
+			Key:          k,
+			Failures:     e.failures,
+			LockedOut:    e.failures >= l.cfg.MaxFailures,
+			BlockedUntil: e.blockedUntil,
+		})
+	}
+	l.mu.Unlock()
+
+	sort.Slice(locks, func(i, j int) bool { return locks[i].Key < locks[j].Key })
+	return locks
+}
+
+func (l *Limiter) stale(e *entry, now time.Time) bool {
+	return now.Sub(e.lastFailure) > l.cfg.Lockout && !e.blockedUntil.After(now)
+}
@@ -0,0 +1,144 @@
+package loginlimit
+
+import (
+	"testing"
+	"time"
+)
+
+// newLimiter returns the limiter with the clock moved by the returned function
+func newLimiter(cfg Config) (*Limiter, func(d time.Duration)) {
+	l := New(cfg)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	l.now = func() time.Time { return now }
+	return l, func(d time.Duration) { now = now.Add(d) }
+}
+
+// アカウント単位の設定：失敗するたびに待ち時間を倍にし、5回目でロックアウト
+var accountConfig = Config{MaxFailures: 5, BaseDelay: time.Second, MaxDelay: 3 * time.Second, Lockout: time.Minute}
+
+func TestBackoff(t *testing.T) {
+	l, advance := newLimiter(accountConfig)
+	if wait := l.Wait("user"); wait != 0 {
+		t.Errorf("Wait before failures = %v, want 0", wait)
+	}
+
+	// 1s, 2s, 4s は MaxDelay の 3s に抑え、MaxFailures 回目で Lockout
+	for i, want := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second, time.Minute} {
+		if wait := l.Fail("user"); wait != want {
+			t.Errorf("failure %d: Fail = %v, want %v", i+1, wait, want)
+		}
+		if wait := l.Wait("user"); wait != want {
+			t.Errorf("failure %d: Wait = %v, want %v", i+1, wait, want)
+		}
+		advance(want)
+		if wait := l.Wait("user"); wait != 0 {
+			t.Errorf("failure %d: Wait after %v = %v, want 0", i+1, want, wait)
+		}
+	}
+	// ロックアウト後も失敗すればまたロックアウト
+	if wait := l.Fail("user"); wait != time.Minute {
+		t.Errorf("Fail after the lockout = %v, want %v", wait, time.Minute)
+	}
+
+	// 他のキーには影響しない
+	if wait := l.Wait("other"); wait != 0 {
+		t.Errorf("Wait of another key = %v, want 0", wait)
+	}
+}
+
+func TestBackoffForgotten(t *testing.T) {
+	l, advance := newLimiter(accountConfig)
+	l.Fail("user")
+	if wait := l.Fail("user"); wait != 2*time.Second {
+		t.Fatalf("second Fail = %v, want 2s", wait)
+	}
+
+	// 待ち時間が過ぎても Lockout の間は失敗を数え続ける
+	advance(time.Minute)
+	if wait := l.Fail("user"); wait != 3*time.Second {
+		t.Errorf("Fail within the lockout = %v, want 3s", wait)
+	}
+	// Lockout の間失敗しなければ忘れる
+	advance(time.Minute + time.Second)
+	if wait := l.Wait("user"); wait != 0 {
+		t.Errorf("Wait after the lockout = %v, want 0", wait)
+	}
+	if wait := l.Fail("user"); wait != time.Second {
+		t.Errorf("Fail after the lockout = %v, want 1s", wait)
+	}
+}
+
+func TestIPLockout(t *testing.T) {
+	// IPアドレス単位（LOGIN_IP_MAX_FAILURES）は待ち時間なしで、回数を超えたらロックアウトだけ
+	l, advance := newLimiter(Config{MaxFailures: 3, Lockout: time.Minute})
+	for i := 1; i < 3; i++ {
+		if wait := l.Fail("192.0.2.1"); wait != 0 {
+			t.Errorf("failure %d: Fail = %v, want 0", i, wait)
+		}
+		if wait := l.Wait("192.0.2.1"); wait != 0 {
+			t.Errorf("failure %d: Wait = %v, want 0", i, wait)
+		}
+	}
+	if wait := l.Fail("192.0.2.1"); wait != time.Minute {
+		t.Errorf("failure 3: Fail = %v, want 1m", wait)
+	}
+	advance(30 * time.Second)
+	if wait := l.Wait("192.0.2.1"); wait != 30*time.Second {
+		t.Errorf("Wait in the lockout = %v, want 30s", wait)
+	}
+	if wait := l.Wait("192.0.2.2"); wait != 0 {
+		t.Errorf("Wait of another IP = %v, want 0", wait)
+	}
+
+	advance(30 * time.Second)
+	if wait := l.Wait("192.0.2.1"); wait != 0 {
+		t.Errorf("Wait after the lockout = %v, want 0", wait)
+	}
+}
+
+func TestReset(t *testing.T) {
+	l, _ := newLimiter(accountConfig)
+	for i := 0; i < accountConfig.MaxFailures; i++ {
+		l.Fail("user")
+	}
+	if wait := l.Wait("user"); wait != time.Minute {
+		t.Fatalf("Wait = %v, want 1m", wait)
+	}
+
+	// ログインに成功したら失敗を忘れ、次の失敗は最初の待ち時間から
+	if !l.Reset("user") {
+		t.Error("Reset = false, want true")
+	}
+	if wait := l.Wait("user"); wait != 0 {
+		t.Errorf("Wait after Reset = %v, want 0", wait)
+	}
+	if wait := l.Fail("user"); wait != time.Second {
+		t.Errorf("Fail after Reset = %v, want 1s", wait)
+	}
+	if l.Reset("other") {
+		t.Error("Reset of the key without failures = true, want false")
+	}
+}
+
+func TestLocks(t *testing.T) {
+	l, advance := newLimiter(accountConfig)
+	for i := 0; i < accountConfig.MaxFailures; i++ {
+		l.Fail("b")
+	}
+	l.Fail("a")
+	l.Fail("a")
+	l.Fail("c")
+	advance(time.Second)
+
+	// 待ち時間が過ぎた c は含まない
+	locks := l.Locks()
+	if len(locks) != 2 {
+		t.Fatalf("%d locks, want 2", len(locks))
+	}
+	if locks[0].Key != "a" || locks[0].Failures != 2 || locks[0].LockedOut {
+		t.Errorf("locks[0] = %+v, want a with 2 failures not locked out", locks[0])
+	}
+	if locks[1].Key != "b" || locks[1].Failures != accountConfig.MaxFailures || !locks[1].LockedOut {
+		t.Errorf("locks[1] = %+v, want b locked out", locks[1])
+	}
+}
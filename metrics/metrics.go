@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// dbMetrics are the fields of sql.DBStats in the Prometheus text format
+var dbMetrics = []struct {
+	name, typ, help string
+	value           func(s sql.DBStats) float64
+}{
+	{"torb_db_max_open_connections", "gauge", "Maximum number of open connections to the database, 0 is unlimited.",
+		func(s sql.DBStats) float64 { return float64(s.MaxOpenConnections) }},
+	{"torb_db_open_connections", "gauge", "Number of established connections both in use and idle.",
+		func(s sql.DBStats) float64 { return float64(s.OpenConnections) }},
+	{"torb_db_in_use_connections", "gauge", "Number of connections currently in use.",
+		func(s sql.DBStats) float64 { return float64(s.InUse) }},
+	{"torb_db_idle_connections", "gauge", "Number of idle connections.",
+		func(s sql.DBStats) float64 { return float64(s.Idle) }},
+	{"torb_db_wait_count_total", "counter", "Total number of connections waited for.",
+		func(s sql.DBStats) float64 { return float64(s.WaitCount) }},
+	{"torb_db_wait_duration_seconds_total", "counter", "Total time blocked waiting for a new connection.",
+		func(s sql.DBStats) float64 { return s.WaitDuration.Seconds() }},
+	{"torb_db_max_idle_closed_total", "counter", "Total number of connections closed due to DB_MAX_IDLE_CONNS.",
+		func(s sql.DBStats) float64 { return float64(s.MaxIdleClosed) }},
+	{"torb_db_max_idle_time_closed_total", "counter", "Total number of connections closed due to DB_CONN_MAX_IDLE_TIME.",
+		func(s sql.DBStats) float64 { return float64(s.MaxIdleTimeClosed) }},
+	{"torb_db_max_lifetime_closed_total", "counter", "Total number of connections closed due to DB_CONN_MAX_LIFETIME.",
+		func(s sql.DBStats) float64 { return float64(s.MaxLifetimeClosed) }},
+}
+
+// DBStatsHandler serves the pool statistics of the databases in the Prometheus text format,
+// labeled by the names of dbs
+func DBStatsHandler(dbs map[string]*sql.DB) http.Handler {
+	names := make([]string, 0, len(dbs))
+	for name := range dbs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stats := make([]sql.DBStats, len(names))
+		for i, name := range names {
+			stats[i] = dbs[name].Stats()
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeDBStats(w, names, stats)
+	})
+}
+
+func writeDBStats(w io.Writer, names []string, stats []sql.DBStats) {
+	for _, m := range dbMetrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.typ)
+		for i, name := range names {
+			fmt.Fprintf(w, "%s{db=%q} %g\n", m.name, name, m.value(stats[i]))
+		}
+	}
+}
+
+// HealthHandler responds 200 if all the databases answer a ping in timeout, otherwise 503
+func HealthHandler(dbs map[string]*sql.DB, timeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		for name, db := range dbs {
+			if err := db.PingContext(ctx); err != nil {
+				http.Error(w, fmt.Sprintf("%s: %v", name, err), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		io.WriteString(w, "ok\n")
+	})
+}
@@ -0,0 +1,247 @@
+package migrate
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"torb/dialect"
+)
+
+// migrations/<version>_<name>.up.sql and .down.sql, written in MySQL and rewritten by dialect.Schema
+//
+//go:embed migrations/*.sql
+var files embed.FS
+
+const schema = "CREATE TABLE IF NOT EXISTS schema_migrations (" +
+	"version BIGINT NOT NULL PRIMARY KEY," +
+	"name VARCHAR(255) NOT NULL," +
+	"applied_at DATETIME(6) NOT NULL" +
+	") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4"
+
+// Migration is a versioned change of the schema
+type Migration struct {
+	Version int64
+	Name    string
+	Up      []string
+	Down    []string
+}
+
+// Status is a migration and when it was applied, AppliedAt is nil if pending
+type Status struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// Load returns the embedded migrations ordered by version
+func Load() ([]Migration, error) {
+	entries, err := files.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int64]*Migration{}
+	for _, entry := range entries {
+		name := entry.Name()
+		var direction string
+		switch {
+		case strings.HasSuffix(name, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(name, ".down.sql"):
+			direction = "down"
+		default:
+			return nil, fmt.Errorf("migrate: unknown file %s", name)
+		}
+		base := strings.TrimSuffix(name, "."+direction+".sql")
+		i := strings.Index(base, "_")
+		if i < 0 {
+			return nil, fmt.Errorf("migrate: no version in %s", name)
+		}
+		version, err := strconv.ParseInt(base[:i], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("migrate: no version in %s", name)
+		}
+
+		b, err := files.ReadFile(path.Join("migrations", name))
+		if err != nil {
+			return nil, err
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: base[i+1:]}
+			byVersion[version] = m
+		} else if m.Name != base[i+1:] {
+			return nil, fmt.Errorf("migrate: version %d is used by %s and %s", version, m.Name, base[i+1:])
+		}
+		if direction == "up" {
+			m.Up = statements(string(b))
+		} else {
+			m.Down = statements(string(b))
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == nil || m.Down == nil {
+			return nil, fmt.Errorf("migrate: %04d_%s needs both up and down", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// statements splits the file by ";", dropping the "--" comments
+func statements(sqlText string) []string {
+	var lines []string
+	for _, line := range strings.Split(sqlText, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "--") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	stmts := []string{}
+	for _, stmt := range strings.Split(strings.Join(lines, "\n"), ";") {
+		if stmt = strings.TrimSpace(stmt); stmt != "" {
+			stmts = append(stmts, stmt)
+		}
+	}
+	return stmts
+}
+
+// Migrator applies the migrations and records them in the schema_migrations table
+type Migrator struct {
+	db         *sql.DB
+	d          dialect.Dialect
+	migrations []Migration
+}
+
+// New returns the instance with the embedded migrations, creating the schema_migrations table if not exists
+func New(db *sql.DB, d dialect.Dialect) (*Migrator, error) {
+	migrations, err := Load()
+	if err != nil {
+		return nil, err
+	}
+	for _, stmt := range d.Schema(schema) {
+		if _, err := db.Exec(stmt); err != nil {
+			return nil, err
+		}
+	}
+	return &Migrator{db: db, d: d, migrations: migrations}, nil
+}
+
+// Status returns all the migrations with their applied time
+func (m *Migrator) Status() ([]Status, error) {
+	rows, err := m.db.Query("SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int64]time.Time{}
+	for rows.Next() {
+		var version int64
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	statuses := make([]Status, 0, len(m.migrations))
+	for _, migration := range m.migrations {
+		status := Status{Migration: migration}
+		if t, ok := applied[migration.Version]; ok {
+			status.AppliedAt = &t
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// Up applies all the pending migrations in order and returns them
+func (m *Migrator) Up() ([]Migration, error) {
+	statuses, err := m.Status()
+	if err != nil {
+		return nil, err
+	}
+	var done []Migration
+	for _, status := range statuses {
+		if status.AppliedAt != nil {
+			continue
+		}
+		if err := m.exec(status.Up); err != nil {
+			return done, fmt.Errorf("migrate: %04d_%s: %v", status.Version, status.Name, err)
+		}
+		if _, err := m.db.Exec("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)", status.Version, status.Name, time.Now().UTC()); err != nil {
+			return done, err
+		}
+		done = append(done, status.Migration)
+	}
+	return done, nil
+}
+
+// Down reverts the last n applied migrations in reverse order and returns them
+func (m *Migrator) Down(n int) ([]Migration, error) {
+	statuses, err := m.Status()
+	if err != nil {
+		return nil, err
+	}
+	var done []Migration
+	for i := len(statuses) - 1; i >= 0 && len(done) < n; i-- {
+		status := statuses[i]
+		if status.AppliedAt == nil {
+			continue
+		}
+		if err := m.exec(status.Down); err != nil {
+			return done, fmt.Errorf("migrate: %04d_%s: %v", status.Version, status.Name, err)
+		}
+		if _, err := m.db.Exec("DELETE FROM schema_migrations WHERE version = ?", status.Version); err != nil {
+			return done, err
+		}
+		done = append(done, status.Migration)
+	}
+	return done, nil
+}
+
+// exec runs the statements one by one, MySQL commits each DDL so a migration is not atomic
+func (m *Migrator) exec(stmts []string) error {
+	for _, stmt := range stmts {
+		// 名前が違っても同じ列の索引が手で追加されていれば作らない
+		if index, create, ok := m.d.IndexIfNotExists(stmt); ok {
+			query, args := m.d.IndexExistsQuery(index)
+			var exists bool
+			if err := m.db.QueryRow(query, args...).Scan(&exists); err != nil {
+				return err
+			}
+			if exists {
+				continue
+			}
+			stmt = create
+		}
+		if query, args, drop, ok := m.d.DropIndexIfExists(stmt); ok {
+			var exists bool
+			if err := m.db.QueryRow(query, args...).Scan(&exists); err != nil {
+				return err
+			}
+			if !exists {
+				continue
+			}
+			stmt = drop
+		}
+		for _, s := range m.d.Schema(stmt) {
+			if _, err := m.db.Exec(s); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package migrate
+
+import (
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"torb/dialect"
+)
+
+func newSQLite(t *testing.T) (*sql.DB, *Migrator) {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "torb.sqlite3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	m, err := New(db, dialect.SQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, m
+}
+
+// reservationIndexes returns the indexes of reservations starting with user_id
+func reservationIndexes(t *testing.T, db *sql.DB) []string {
+	t.Helper()
+	rows, err := db.Query("SELECT l.name FROM pragma_index_list('reservations') l, pragma_index_info(l.name) i WHERE i.seqno = 0 AND i.name = 'user_id' ORDER BY l.name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+func TestUserIDIndex(t *testing.T) {
+	db, m := newSQLite(t)
+	if _, err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if got := reservationIndexes(t, db); !reflect.DeepEqual(got, []string{"reservations_user_id_idx"}) {
+		t.Errorf("indexes after up = %v", got)
+	}
+	// 0007 と 0006 を戻す
+	if _, err := m.Down(2); err != nil {
+		t.Fatal(err)
+	}
+	if got := reservationIndexes(t, db); got != nil {
+		t.Errorf("indexes after down = %v", got)
+	}
+}
+
+func TestUserIDIndexAddedByHand(t *testing.T) {
+	db, m := newSQLite(t)
+	if _, err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Down(2); err != nil {
+		t.Fatal(err)
+	}
+	// 別の名前で手で追加した索引があれば、同じ列の索引を重ねて作らない
+	if _, err := db.Exec("CREATE INDEX by_hand ON reservations (user_id, reserved_at)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if got := reservationIndexes(t, db); !reflect.DeepEqual(got, []string{"by_hand"}) {
+		t.Errorf("indexes after up = %v, want only by_hand", got)
+	}
+	// 作らなかった索引を戻しても失敗せず、手で追加したものは残る
+	if _, err := m.Down(2); err != nil {
+		t.Fatal(err)
+	}
+	if got := reservationIndexes(t, db); !reflect.DeepEqual(got, []string{"by_hand"}) {
+		t.Errorf("indexes after down = %v, want by_hand", got)
+	}
+}
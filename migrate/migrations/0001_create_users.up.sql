@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS users (
+    id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    nickname VARCHAR(128) NOT NULL,
+    login_name VARCHAR(128) NOT NULL,
+    pass_hash VARCHAR(128) NOT NULL,
+    UNIQUE KEY login_name_uniq (login_name)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS events (
+    id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    title VARCHAR(128) NOT NULL,
+    public_fg TINYINT(1) NOT NULL,
+    closed_fg TINYINT(1) NOT NULL,
+    price INTEGER UNSIGNED NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
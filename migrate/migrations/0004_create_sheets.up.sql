@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS sheets (
+    id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    `rank` VARCHAR(128) NOT NULL,
+    num INTEGER UNSIGNED NOT NULL,
+    price INTEGER UNSIGNED NOT NULL,
+    UNIQUE KEY rank_num_uniq (`rank`, num)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
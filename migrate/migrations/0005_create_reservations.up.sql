@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS reservations (
+    id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    event_id BIGINT NOT NULL,
+    sheet_id BIGINT NOT NULL,
+    user_id BIGINT NOT NULL,
+    reserved_at DATETIME(6) NOT NULL,
+    canceled_at DATETIME(6) DEFAULT NULL,
+    KEY event_id_and_sheet_id_idx (event_id, sheet_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
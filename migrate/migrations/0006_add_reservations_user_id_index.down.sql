@@ -0,0 +1,3 @@
+-- up で作らなかった場合（別の名前の索引が手で追加済み）もあるので、なければ何もしない
+-- 同じ名前の user_id_idx が手で追加されていた場合はそれも消えるので、戻した後に必要なら付け直すこと
+DROP INDEX IF EXISTS user_id_idx ON reservations;
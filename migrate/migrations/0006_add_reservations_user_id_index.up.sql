@@ -0,0 +1,3 @@
+-- /api/users/:id の最近の予約・合計金額の検索用（SCORE LOG 4810）
+-- 手で追加済みの環境があるので、名前にかかわらず reservations の user_id から始まる索引が既にあれば作らない
+CREATE INDEX IF NOT EXISTS user_id_idx ON reservations (user_id);
@@ -0,0 +1 @@
+-- 付けたロールと元からあったロールは区別できないので戻さない
@@ -0,0 +1,10 @@
+-- ロールのない管理者を superadmin として扱うのをやめたので、既存の管理者には明示的に superadmin を付ける
+-- administrator_roles は起動時にも作られるが、起動前に流せるようにここでも作る
+CREATE TABLE IF NOT EXISTS administrator_roles (
+    administrator_id BIGINT NOT NULL,
+    role VARCHAR(32) NOT NULL,
+    PRIMARY KEY (administrator_id, role)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+INSERT INTO administrator_roles (administrator_id, role)
+    SELECT a.id, 'superadmin' FROM administrators a LEFT JOIN administrator_roles r ON r.administrator_id = a.id
+    WHERE r.administrator_id IS NULL;
@@ -0,0 +1,62 @@
+package password
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// bcryptPrefix is the hash-format prefix of pass_hash hashed in the app.
+// pass_hash without prefix is the legacy hex of MySQL's SHA2(?, 256).
+const bcryptPrefix = "bcrypt:"
+
+// MaxBytes is the longest password bcrypt can hash, the rest would be ignored
+const MaxBytes = 72
+
+// ErrTooLong is returned by Hash for the password longer than MaxBytes
+var ErrTooLong = errors.New("password: longer than 72 bytes")
+
+// Cost is the bcrypt cost for new hashes, hashes with lower cost are rehashed on login
+var Cost = bcrypt.DefaultCost
+
+// Hash returns pass_hash for the plain password
+func Hash(plain string) (string, error) {
+	if len(plain) > MaxBytes {
+		return "", ErrTooLong
+	}
+	b, err := bcrypt.GenerateFromPassword([]byte(plain), Cost)
+	if err != nil {
+		return "", err
+	}
+	return bcryptPrefix + string(b), nil
+}
+
+// LegacyHash returns pass_hash in the legacy format, which is fast to make for the fixtures and rehashed on login
+func LegacyHash(plain string) string {
+	sum := sha256.Sum256([]byte(plain))
+	return hex.EncodeToString(sum[:])
+}
+
+// Verify compares pass_hash with the plain password.
+// needsRehash is true when the password matched but pass_hash should be replaced by Hash(plain),
+// which is never for the legacy password longer than MaxBytes.
+func Verify(passHash, plain string) (ok bool, needsRehash bool) {
+	if strings.HasPrefix(passHash, bcryptPrefix) {
+		b := []byte(strings.TrimPrefix(passHash, bcryptPrefix))
+		if bcrypt.CompareHashAndPassword(b, []byte(plain)) != nil {
+			return false, false
+		}
+		cost, err := bcrypt.Cost(b)
+		return true, err != nil || cost < Cost
+	}
+
+	// legacy: SHA2(?, 256) without salt
+	if subtle.ConstantTimeCompare([]byte(strings.ToLower(passHash)), []byte(LegacyHash(plain))) != 1 {
+		return false, false
+	}
+	return true, len(plain) <= MaxBytes
+}
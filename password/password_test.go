@@ -0,0 +1,82 @@
+package password
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHash(t *testing.T) {
+	passHash, err := Hash("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(passHash, bcryptPrefix) {
+		t.Errorf("Hash = %s, want the prefix %s", passHash, bcryptPrefix)
+	}
+	// ソルトが入るので同じパスワードでも毎回違う
+	if other, err := Hash("password"); err != nil || other == passHash {
+		t.Errorf("Hash twice = %s, %v, want another hash", other, err)
+	}
+
+	if ok, needsRehash := Verify(passHash, "password"); !ok || needsRehash {
+		t.Errorf("Verify = %v, %v, want true, false", ok, needsRehash)
+	}
+	for _, plain := range []string{"", "Password", "password "} {
+		if ok, needsRehash := Verify(passHash, plain); ok || needsRehash {
+			t.Errorf("Verify(%q) = %v, %v, want false, false", plain, ok, needsRehash)
+		}
+	}
+
+	// 72バイトまでは受け付け、それより長いとbcryptで切り捨てられるのでエラー
+	if _, err := Hash(strings.Repeat("a", MaxBytes)); err != nil {
+		t.Errorf("Hash of %d bytes: %v", MaxBytes, err)
+	}
+	if _, err := Hash(strings.Repeat("a", MaxBytes+1)); err != ErrTooLong {
+		t.Errorf("Hash of %d bytes: %v, want ErrTooLong", MaxBytes+1, err)
+	}
+}
+
+func TestVerifyLowCost(t *testing.T) {
+	b, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	passHash := bcryptPrefix + string(b)
+
+	// Cost より低いコストのハッシュは作り直す
+	if ok, needsRehash := Verify(passHash, "password"); !ok || !needsRehash {
+		t.Errorf("Verify = %v, %v, want true, true", ok, needsRehash)
+	}
+	if ok, needsRehash := Verify(passHash, "wrong"); ok || needsRehash {
+		t.Errorf("Verify with the wrong password = %v, %v, want false, false", ok, needsRehash)
+	}
+}
+
+func TestVerifyLegacy(t *testing.T) {
+	// MySQL の SHA2('password', 256)
+	const legacy = "5e884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542d8"
+	if got := LegacyHash("password"); got != legacy {
+		t.Fatalf("LegacyHash = %s, want %s", got, legacy)
+	}
+
+	// 一致すれば bcrypt に置き換える
+	for _, passHash := range []string{legacy, strings.ToUpper(legacy)} {
+		if ok, needsRehash := Verify(passHash, "password"); !ok || !needsRehash {
+			t.Errorf("Verify(%s) = %v, %v, want true, true", passHash, ok, needsRehash)
+		}
+	}
+	// 一致しなければ置き換えない
+	for _, plain := range []string{"", "Password", "wrong"} {
+		if ok, needsRehash := Verify(legacy, plain); ok || needsRehash {
+			t.Errorf("Verify(%q) = %v, %v, want false, false", plain, ok, needsRehash)
+		}
+	}
+
+	// 72バイトより長いパスワードは bcrypt にできないので旧形式のまま
+	long := strings.Repeat("a", MaxBytes+1)
+	if ok, needsRehash := Verify(LegacyHash(long), long); !ok || needsRehash {
+		t.Errorf("Verify of the long password = %v, %v, want true, false", ok, needsRehash)
+	}
+}
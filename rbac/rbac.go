@@ -0,0 +1,46 @@
+package rbac
+
+// Permission is an operation on the admin API
+type Permission string
+
+const (
+	ViewEvents           Permission = "events:read"
+	ManageEvents         Permission = "events:write"
+	ViewReports          Permission = "reports:read"
+	ManageUsers          Permission = "users:write"
+	ManageAdministrators Permission = "administrators:write"
+	ViewAudit            Permission = "audit:read"
+)
+
+// Roles which can be attached to administrators
+const (
+	Viewer       = "viewer"
+	EventManager = "event_manager"
+	Finance      = "finance"
+	Superadmin   = "superadmin"
+)
+
+var rolePermissions = map[string][]Permission{
+	Viewer:       {ViewEvents},
+	EventManager: {ViewEvents, ManageEvents},
+	Finance:      {ViewEvents, ViewReports},
+	Superadmin:   {ViewEvents, ManageEvents, ViewReports, ManageUsers, ManageAdministrators, ViewAudit},
+}
+
+// ValidRole returns whether the role exists
+func ValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// Allowed returns whether any of the roles has the permission
+func Allowed(roles []string, p Permission) bool {
+	for _, role := range roles {
+		for _, x := range rolePermissions[role] {
+			if x == p {
+				return true
+			}
+		}
+	}
+	return false
+}
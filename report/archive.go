@@ -0,0 +1,178 @@
+package report
+
+import (
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	fileExt    = ".csv.gz"
+	timeLayout = "20060102T150405Z"
+)
+
+// ErrNotFound is returned when the archived file does not exist
+var ErrNotFound = errors.New("archived report not found")
+
+// File is an archived report
+type File struct {
+	Name        string    `json:"name"`
+	Report      string    `json:"report"`
+	GeneratedAt time.Time `json:"generated_at"`
+	Size        int64     `json:"size"`
+}
+
+// Archive stores the generated reports as gzip files in a directory
+type Archive struct {
+	dir       string
+	retention time.Duration
+}
+
+// NewArchive returns the instance, retention <= 0 keeps files forever
+func NewArchive(dir string, retention time.Duration) (*Archive, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Archive{dir: dir, retention: retention}, nil
+}
+
+// Save writes the csv as "<report>-<timestamp>.csv.gz"
+func (a *Archive) Save(report string, generatedAt time.Time, csv []byte) (*File, error) {
+	name := report + "-" + generatedAt.UTC().Format(timeLayout) + fileExt
+
+	// 書き込み途中のファイルが一覧に出ないように、一時ファイルに書いてからrenameする
+	tmp, err := ioutil.TempFile(a.dir, ".tmp-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+
+	zw := gzip.NewWriter(tmp)
+	zw.Name = strings.TrimSuffix(name, ".gz")
+	zw.ModTime = generatedAt
+	if _, err := zw.Write(csv); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(a.dir, name)); err != nil {
+		return nil, err
+	}
+	return a.stat(name)
+}
+
+// List returns the archived reports, newest first
+func (a *Archive) List() ([]*File, error) {
+	infos, err := ioutil.ReadDir(a.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []*File{}
+	for _, info := range infos {
+		if f := parseFile(info); f != nil {
+			files = append(files, f)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].GeneratedAt.Equal(files[j].GeneratedAt) {
+			return files[i].Name < files[j].Name
+		}
+		return files[i].GeneratedAt.After(files[j].GeneratedAt)
+	})
+	return files, nil
+}
+
+// Path returns the path of the archived file, the name must be one returned by List
+func (a *Archive) Path(name string) (string, error) {
+	if name != filepath.Base(name) {
+		return "", ErrNotFound
+	}
+	if _, err := a.stat(name); err != nil {
+		return "", err
+	}
+	return filepath.Join(a.dir, name), nil
+}
+
+// Prune removes the files older than the retention
+func (a *Archive) Prune(now time.Time) error {
+	if a.retention <= 0 {
+		return nil
+	}
+	files, err := a.List()
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if now.Sub(f.GeneratedAt) <= a.retention {
+			continue
+		}
+		if err := os.Remove(filepath.Join(a.dir, f.Name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *Archive) stat(name string) (*File, error) {
+	info, err := os.Stat(filepath.Join(a.dir, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	f := parseFile(info)
+	if f == nil {
+		return nil, ErrNotFound
+	}
+	return f, nil
+}
+
+func parseFile(info os.FileInfo) *File {
+	name := info.Name()
+	if info.IsDir() || !strings.HasSuffix(name, fileExt) {
+		return nil
+	}
+	base := strings.TrimSuffix(name, fileExt)
+	i := strings.LastIndex(base, "-")
+	if i <= 0 {
+		return nil
+	}
+	generatedAt, err := time.Parse(timeLayout, base[i+1:])
+	if err != nil {
+		return nil
+	}
+	return &File{Name: name, Report: base[:i], GeneratedAt: generatedAt, Size: info.Size()}
+}
+
+// Run calls job at every activation of the schedule until stop is closed
+func Run(schedule *Schedule, stop <-chan struct{}, job func(now time.Time)) {
+	for {
+		next := schedule.Next(time.Now())
+		if next.IsZero() {
+			log.Printf("report schedule never fires")
+			return
+		}
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case now := <-timer.C:
+			job(now)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package report
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a cron-like schedule, "minute hour day-of-month month day-of-week" or "@every <duration>"
+type Schedule struct {
+	every time.Duration
+
+	minute, hour, dom, month, dow map[int]bool
+	domStar, dowStar              bool
+}
+
+// ParseSchedule parses the spec such as "*/30 * * * *", "0 3 * * 1-5" or "@every 15m"
+func ParseSchedule(spec string) (*Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, "@every ") {
+		d, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(spec, "@every ")))
+		if err != nil {
+			return nil, err
+		}
+		if d < time.Minute {
+			return nil, fmt.Errorf("schedule %q: interval must be at least 1m", spec)
+		}
+		return &Schedule{every: d}, nil
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("schedule %q: expected 5 fields", spec)
+	}
+
+	s := &Schedule{
+		domStar: fields[2] == "*",
+		dowStar: fields[4] == "*",
+	}
+	var err error
+	if s.minute, err = parseField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if s.hour, err = parseField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if s.dom, err = parseField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if s.month, err = parseField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if s.dow, err = parseField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	// 日曜日は 0 と 7 のどちらでも書ける
+	if s.dow[7] {
+		s.dow[0] = true
+	}
+	return s, nil
+}
+
+// Next returns the first activation time after t
+func (s *Schedule) Next(t time.Time) time.Time {
+	if s.every > 0 {
+		return t.Add(s.every)
+	}
+
+	// 分単位で走査する。4年分見つからなければ存在しない日付（2/31など）
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	for limit := t.AddDate(4, 0, 0); t.Before(limit); t = t.Add(time.Minute) {
+		if s.month[int(t.Month())] && s.matchDay(t) && s.hour[t.Hour()] && s.minute[t.Minute()] {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// cronと同じく、日と曜日の両方が指定されている場合はどちらかに合致すればよい
+func (s *Schedule) matchDay(t time.Time) bool {
+	dom := s.dom[t.Day()]
+	dow := s.dow[int(t.Weekday())]
+	switch {
+	case s.domStar && s.dowStar:
+		return true
+	case s.domStar:
+		return dow
+	case s.dowStar:
+		return dom
+	}
+	return dom || dow
+}
+
+func parseField(field string, min, max int) (map[int]bool, error) {
+	set := map[int]bool{}
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("schedule field %q: invalid step", field)
+			}
+			step = n
+			part = part[:i]
+		}
+
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, fmt.Errorf("schedule field %q: %v", field, err)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("schedule field %q: %v", field, err)
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return nil, fmt.Errorf("schedule field %q: out of range %d-%d", field, min, max)
+		}
+
+		for v := lo; v <= hi; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
@@ -0,0 +1,84 @@
+package report
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseScheduleErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"a * * * *",
+		"1-b * * * *",
+		"@every 30s",
+		"@every soon",
+	} {
+		if _, err := ParseSchedule(spec); err == nil {
+			t.Errorf("ParseSchedule(%q) = nil error, want error", spec)
+		}
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	// 2024-01-01 は月曜日
+	base := time.Date(2024, 1, 1, 10, 17, 30, 0, time.UTC)
+	for _, tt := range []struct {
+		spec string
+		from time.Time
+		want time.Time
+	}{
+		{"* * * * *", base, time.Date(2024, 1, 1, 10, 18, 0, 0, time.UTC)},
+		{"*/30 * * * *", base, time.Date(2024, 1, 1, 10, 30, 0, 0, time.UTC)},
+		{"0 3 * * *", base, time.Date(2024, 1, 2, 3, 0, 0, 0, time.UTC)},
+		{"15,45 10 * * *", base, time.Date(2024, 1, 1, 10, 45, 0, 0, time.UTC)},
+		{"0 9-17/4 * * *", base, time.Date(2024, 1, 1, 13, 0, 0, 0, time.UTC)},
+		{"10/20 * * * *", base, time.Date(2024, 1, 1, 10, 30, 0, 0, time.UTC)},
+		{"0 0 1 * *", base, time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * 3 *", base, time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 1-5", time.Date(2024, 1, 5, 12, 0, 0, 0, time.UTC), time.Date(2024, 1, 8, 0, 0, 0, 0, time.UTC)},
+		// 日曜日は 0 と 7 のどちらでもよい
+		{"0 0 * * 0", base, time.Date(2024, 1, 7, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", base, time.Date(2024, 1, 7, 0, 0, 0, 0, time.UTC)},
+		// 日と曜日の両方を指定した場合はどちらかに合致すればよい
+		{"0 0 15 * 3", base, time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC)},
+		{"0 0 2 * 3", base, time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)},
+		// うるう年の 2/29
+		{"0 0 29 2 *", base, time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// 存在しない日付
+		{"0 0 31 2 *", base, time.Time{}},
+		{"@every 15m", base, base.Add(15 * time.Minute)},
+		{" @every 1h ", base, base.Add(time.Hour)},
+	} {
+		s, err := ParseSchedule(tt.spec)
+		if err != nil {
+			t.Errorf("ParseSchedule(%q): %v", tt.spec, err)
+			continue
+		}
+		if got := s.Next(tt.from); !got.Equal(tt.want) {
+			t.Errorf("ParseSchedule(%q).Next(%v) = %v, want %v", tt.spec, tt.from, got, tt.want)
+		}
+	}
+}
+
+func TestScheduleNextOnTheMinute(t *testing.T) {
+	s, err := ParseSchedule("0 * * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ちょうどの時刻からは次の回を返す
+	from := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	if got, want := s.Next(from), time.Date(2024, 1, 1, 11, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("Next(%v) = %v, want %v", from, got, want)
+	}
+}
@@ -0,0 +1,472 @@
+package repository
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	. "torb/structs"
+)
+
+// memoryDB keeps all the rows in the process, for tests and development without MySQL
+type memoryDB struct {
+	mu             sync.RWMutex
+	users          map[int64]*User
+	deactivations  map[int64]time.Time
+	administrators map[int64]*Administrator
+	events         map[int64]*Event
+	sheets         []Sheet
+	reservations   map[int64]*Reservation
+	lastIDs        map[string]int64
+}
+
+// NewMemory returns the repositories kept in memory with the sheets.
+// Rows are copied on read and write, so the callers can modify the returned values.
+func NewMemory(sheets []Sheet) *Repositories {
+	m := &memoryDB{
+		users:          map[int64]*User{},
+		deactivations:  map[int64]time.Time{},
+		administrators: map[int64]*Administrator{},
+		events:         map[int64]*Event{},
+		sheets:         append([]Sheet(nil), sheets...),
+		reservations:   map[int64]*Reservation{},
+		lastIDs:        map[string]int64{},
+	}
+	sort.Slice(m.sheets, func(i, j int) bool {
+		if m.sheets[i].Rank != m.sheets[j].Rank {
+			return m.sheets[i].Rank < m.sheets[j].Rank
+		}
+		return m.sheets[i].Num < m.sheets[j].Num
+	})
+	return &Repositories{
+		Users:          &memoryUsers{m},
+		Administrators: &memoryAdministrators{m},
+		Events:         &memoryEvents{m},
+		Sheets:         &memorySheets{m},
+		Reservations:   &memoryReservations{m},
+	}
+}
+
+// nextID is AUTO_INCREMENT, the caller must hold the lock
+func (m *memoryDB) nextID(table string) int64 {
+	m.lastIDs[table]++
+	return m.lastIDs[table]
+}
+
+type memoryUsers struct {
+	*memoryDB
+}
+
+func (r *memoryUsers) Get(id int64) (*User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	u, ok := r.users[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	_, deactivated := r.deactivations[id]
+	return &User{ID: u.ID, LoginName: u.LoginName, Nickname: u.Nickname, Deactivated: deactivated}, nil
+}
+
+func (r *memoryUsers) GetByLoginName(loginName string) (*User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, u := range r.users {
+		if u.LoginName == loginName {
+			copied := *u
+			_, copied.Deactivated = r.deactivations[u.ID]
+			return &copied, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (r *memoryUsers) PassHash(id int64) (string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	u, ok := r.users[id]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return u.PassHash, nil
+}
+
+func (r *memoryUsers) Create(user *User) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, u := range r.users {
+		if u.LoginName == user.LoginName {
+			return ErrDuplicated
+		}
+	}
+	user.ID = r.nextID("users")
+	copied := *user
+	r.users[user.ID] = &copied
+	return nil
+}
+
+func (r *memoryUsers) UpdateNickname(id int64, nickname string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if u, ok := r.users[id]; ok {
+		u.Nickname = nickname
+	}
+	return nil
+}
+
+func (r *memoryUsers) UpdatePassHash(id int64, passHash string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if u, ok := r.users[id]; ok {
+		u.PassHash = passHash
+	}
+	return nil
+}
+
+func (r *memoryUsers) Deactivate(id int64, at time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.deactivations[id]; !ok {
+		r.deactivations[id] = at
+	}
+	return nil
+}
+
+type memoryAdministrators struct {
+	*memoryDB
+}
+
+func copyAdministrator(a *Administrator, withPassHash bool) *Administrator {
+	copied := *a
+	copied.Roles = append([]string(nil), a.Roles...)
+	if !withPassHash {
+		copied.PassHash = ""
+	}
+	return &copied
+}
+
+func (r *memoryAdministrators) Get(id int64) (*Administrator, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	a, ok := r.administrators[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return copyAdministrator(a, false), nil
+}
+
+func (r *memoryAdministrators) GetByLoginName(loginName string) (*Administrator, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, a := range r.administrators {
+		if a.LoginName == loginName {
+			return copyAdministrator(a, true), nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (r *memoryAdministrators) List() ([]*Administrator, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	administrators := []*Administrator{}
+	for _, a := range r.administrators {
+		administrators = append(administrators, copyAdministrator(a, false))
+	}
+	sort.Slice(administrators, func(i, j int) bool { return administrators[i].ID < administrators[j].ID })
+	return administrators, nil
+}
+
+func (r *memoryAdministrators) Create(administrator *Administrator) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, a := range r.administrators {
+		if a.LoginName == administrator.LoginName {
+			return ErrDuplicated
+		}
+	}
+	administrator.ID = r.nextID("administrators")
+	stored := copyAdministrator(administrator, true)
+	sort.Strings(stored.Roles)
+	r.administrators[administrator.ID] = stored
+	return nil
+}
+
+func (r *memoryAdministrators) Update(administrator *Administrator) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	a, ok := r.administrators[administrator.ID]
+	if !ok {
+		return nil
+	}
+	a.Nickname = administrator.Nickname
+	a.Roles = append([]string(nil), administrator.Roles...)
+	sort.Strings(a.Roles)
+	return nil
+}
+
+func (r *memoryAdministrators) UpdatePassHash(id int64, passHash string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if a, ok := r.administrators[id]; ok {
+		a.PassHash = passHash
+	}
+	return nil
+}
+
+func (r *memoryAdministrators) Delete(id int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.administrators[id]; !ok {
+		return ErrNotFound
+	}
+	delete(r.administrators, id)
+	return nil
+}
+
+func (r *memoryAdministrators) GrantRoleless(role string) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var n int64
+	for _, a := range r.administrators {
+		if len(a.Roles) == 0 {
+			a.Roles = []string{role}
+			n++
+		}
+	}
+	return n, nil
+}
+
+type memoryEvents struct {
+	*memoryDB
+}
+
+func copyEvent(e *Event) *Event {
+	return &Event{ID: e.ID, Title: e.Title, PublicFg: e.PublicFg, ClosedFg: e.ClosedFg, Price: e.Price}
+}
+
+func (r *memoryEvents) List() ([]*Event, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var events []*Event
+	for _, e := range r.events {
+		events = append(events, copyEvent(e))
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].ID < events[j].ID })
+	return events, nil
+}
+
+func (r *memoryEvents) ListIn(ids []int64) ([]*Event, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var events []*Event
+	seen := map[int64]bool{}
+	for _, id := range ids {
+		if e, ok := r.events[id]; ok && !seen[id] {
+			seen[id] = true
+			events = append(events, copyEvent(e))
+		}
+	}
+	return events, nil
+}
+
+func (r *memoryEvents) Get(id int64) (*Event, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	e, ok := r.events[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return copyEvent(e), nil
+}
+
+func (r *memoryEvents) Create(event *Event) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	event.ID = r.nextID("events")
+	stored := copyEvent(event)
+	stored.ClosedFg = false
+	r.events[event.ID] = stored
+	return nil
+}
+
+func (r *memoryEvents) UpdateFlags(id int64, public, closed bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e, ok := r.events[id]; ok {
+		e.PublicFg = public
+		e.ClosedFg = closed
+	}
+	return nil
+}
+
+type memorySheets struct {
+	*memoryDB
+}
+
+func (r *memorySheets) List() ([]Sheet, error) {
+	return append([]Sheet(nil), r.sheets...), nil
+}
+
+func (r *memorySheets) Get(id int64) (*Sheet, error) {
+	for _, s := range r.sheets {
+		if s.ID == id {
+			copied := s
+			return &copied, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (r *memorySheets) GetByRankNum(rank string, num int64) (*Sheet, error) {
+	for _, s := range r.sheets {
+		if s.Rank == rank && s.Num == num {
+			copied := s
+			return &copied, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (r *memorySheets) CountByRank(rank string) (int, error) {
+	count := 0
+	for _, s := range r.sheets {
+		if s.Rank == rank {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (r *memorySheets) byID() map[int64]Sheet {
+	sheets := map[int64]Sheet{}
+	for _, s := range r.sheets {
+		sheets[s.ID] = s
+	}
+	return sheets
+}
+
+type memoryReservations struct {
+	*memoryDB
+}
+
+func copyReservation(r *Reservation) *Reservation {
+	copied := Reservation{ID: r.ID, EventID: r.EventID, SheetID: r.SheetID, UserID: r.UserID}
+	copied.SetReservedAt(*r.ReservedAt)
+	if r.CanceledAt != nil {
+		copied.SetCanceledAt(*r.CanceledAt)
+	}
+	return &copied
+}
+
+// updatedAt is IFNULL(canceled_at, reserved_at)
+func updatedAt(r *Reservation) time.Time {
+	if r.CanceledAt != nil {
+		return *r.CanceledAt
+	}
+	return *r.ReservedAt
+}
+
+func (r *memoryReservations) Insert(reservation *Reservation) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reservations[reservation.ID] = copyReservation(reservation)
+	return nil
+}
+
+func (r *memoryReservations) Cancel(id int64, canceledAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if reservation, ok := r.reservations[id]; ok {
+		reservation.SetCanceledAt(canceledAt)
+	}
+	return nil
+}
+
+func (r *memoryReservations) filter(match func(*Reservation) bool) []*Reservation {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var reservations []*Reservation
+	for _, reservation := range r.reservations {
+		if match(reservation) {
+			reservations = append(reservations, copyReservation(reservation))
+		}
+	}
+	return reservations
+}
+
+func (r *memoryReservations) ListNotCanceled() ([]*Reservation, error) {
+	return r.filter(func(x *Reservation) bool { return x.CanceledAt == nil }), nil
+}
+
+func (r *memoryReservations) ListCanceled() ([]*Reservation, error) {
+	return r.filter(func(x *Reservation) bool { return x.CanceledAt != nil }), nil
+}
+
+func (r *memoryReservations) ListByEvent(eventID int64) ([]*Reservation, error) {
+	reservations := r.filter(func(x *Reservation) bool { return x.EventID == eventID })
+	sort.Slice(reservations, func(i, j int) bool { return reservations[i].ReservedAt.Before(*reservations[j].ReservedAt) })
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	sheets := (&memorySheets{r.memoryDB}).byID()
+	for _, reservation := range reservations {
+		sheet := sheets[reservation.SheetID]
+		reservation.SheetRank = sheet.Rank
+		reservation.SheetNum = sheet.Num
+		if e, ok := r.events[reservation.EventID]; ok {
+			reservation.Price = e.Price + sheet.Price
+		}
+	}
+	return reservations, nil
+}
+
+func (r *memoryReservations) RecentByUser(userID int64, limit int) ([]Reservation, error) {
+	found := r.filter(func(x *Reservation) bool { return x.UserID == userID })
+	sort.Slice(found, func(i, j int) bool { return updatedAt(found[i]).After(updatedAt(found[j])) })
+	if len(found) > limit {
+		found = found[:limit]
+	}
+
+	sheets := (&memorySheets{r.memoryDB}).byID()
+	reservations := []Reservation{}
+	for _, reservation := range found {
+		sheet := sheets[reservation.SheetID]
+		reservation.SheetRank = sheet.Rank
+		reservation.SheetNum = sheet.Num
+		reservations = append(reservations, *reservation)
+	}
+	return reservations, nil
+}
+
+func (r *memoryReservations) RecentEventIDsByUser(userID int64, limit int) ([]int64, error) {
+	latest := map[int64]time.Time{}
+	for _, reservation := range r.filter(func(x *Reservation) bool { return x.UserID == userID }) {
+		if t := updatedAt(reservation); t.After(latest[reservation.EventID]) {
+			latest[reservation.EventID] = t
+		}
+	}
+	var eventIDs []int64
+	for id := range latest {
+		eventIDs = append(eventIDs, id)
+	}
+	sort.Slice(eventIDs, func(i, j int) bool { return latest[eventIDs[i]].After(latest[eventIDs[j]]) })
+	if len(eventIDs) > limit {
+		eventIDs = eventIDs[:limit]
+	}
+	return eventIDs, nil
+}
+
+func (r *memoryReservations) TotalPriceByUser(userID int64) (int64, error) {
+	sheets := (&memorySheets{r.memoryDB}).byID()
+	var total int64
+	for _, reservation := range r.filter(func(x *Reservation) bool { return x.UserID == userID && x.CanceledAt == nil }) {
+		r.mu.RLock()
+		e, ok := r.events[reservation.EventID]
+		r.mu.RUnlock()
+		if ok {
+			total += e.Price + sheets[reservation.SheetID].Price
+		}
+	}
+	return total, nil
+}
@@ -0,0 +1,91 @@
+package repository
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	. "torb/structs"
+)
+
+// ErrNotFound is returned when the row does not exist.
+// sql.ErrNoRows そのものなので、既存の err == sql.ErrNoRows の判定はそのまま使える
+var ErrNotFound = sql.ErrNoRows
+
+// ErrDuplicated is returned when the login name is already used
+var ErrDuplicated = errors.New("duplicated login name")
+
+// Repositories is the set of the repositories of a storage backend
+type Repositories struct {
+	Users          UserRepository
+	Administrators AdministratorRepository
+	Events         EventRepository
+	Sheets         SheetRepository
+	Reservations   ReservationRepository
+}
+
+// UserRepository stores the users and their deactivations.
+// PassHash is only set by GetByLoginName and PassHash, Deactivated is set by Get and GetByLoginName.
+type UserRepository interface {
+	Get(id int64) (*User, error)
+	GetByLoginName(loginName string) (*User, error)
+	PassHash(id int64) (string, error)
+	// Create sets user.ID, ErrDuplicated is returned if the login name is used
+	Create(user *User) error
+	UpdateNickname(id int64, nickname string) error
+	UpdatePassHash(id int64, passHash string) error
+	Deactivate(id int64, at time.Time) error
+}
+
+// AdministratorRepository stores the administrators and their roles.
+// PassHash is only set by GetByLoginName, Roles are the attached roles without the default one.
+type AdministratorRepository interface {
+	Get(id int64) (*Administrator, error)
+	GetByLoginName(loginName string) (*Administrator, error)
+	List() ([]*Administrator, error)
+	// Create sets administrator.ID, ErrDuplicated is returned if the login name is used
+	Create(administrator *Administrator) error
+	// Update saves the nickname and the roles
+	Update(administrator *Administrator) error
+	UpdatePassHash(id int64, passHash string) error
+	Delete(id int64) error
+	// GrantRoleless attaches the role to the administrators without any role and returns their number
+	GrantRoleless(role string) (int64, error)
+}
+
+// EventRepository stores the events, Total/Remains/Sheets are computed by the caller
+type EventRepository interface {
+	// List returns all the events ordered by id
+	List() ([]*Event, error)
+	ListIn(ids []int64) ([]*Event, error)
+	Get(id int64) (*Event, error)
+	// Create sets event.ID, the event is not closed
+	Create(event *Event) error
+	UpdateFlags(id int64, public, closed bool) error
+}
+
+// SheetRepository reads the sheets, they are never changed by the app
+type SheetRepository interface {
+	// List returns all the sheets ordered by rank and num
+	List() ([]Sheet, error)
+	Get(id int64) (*Sheet, error)
+	GetByRankNum(rank string, num int64) (*Sheet, error)
+	CountByRank(rank string) (int, error)
+}
+
+// ReservationRepository stores the reservations
+type ReservationRepository interface {
+	// Insert stores the reservation with its ID and ReservedAt
+	Insert(reservation *Reservation) error
+	Cancel(id int64, canceledAt time.Time) error
+	ListNotCanceled() ([]*Reservation, error)
+	ListCanceled() ([]*Reservation, error)
+	// ListByEvent returns the reservations of the event ordered by reserved_at, with SheetRank, SheetNum and Price
+	ListByEvent(eventID int64) ([]*Reservation, error)
+	// RecentByUser returns the last updated reservations of the user, with SheetRank and SheetNum
+	RecentByUser(userID int64, limit int) ([]Reservation, error)
+	// RecentEventIDsByUser returns the events the user reserved or canceled lately
+	RecentEventIDsByUser(userID int64, limit int) ([]int64, error)
+	// TotalPriceByUser returns the sum of the prices of the reservations not canceled
+	TotalPriceByUser(userID int64) (int64, error)
+}
@@ -0,0 +1,409 @@
+package repository_test
+
+import (
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"torb/dialect"
+	"torb/migrate"
+	"torb/repository"
+	. "torb/structs"
+)
+
+var testSheets = []Sheet{
+	{ID: 1, Rank: "S", Num: 1, Price: 5000},
+	{ID: 2, Rank: "S", Num: 2, Price: 5000},
+	{ID: 3, Rank: "A", Num: 1, Price: 3000},
+	{ID: 4, Rank: "C", Num: 1, Price: 0},
+}
+
+// forEach runs the same test against all the implementations, so that they behave the same
+func forEach(t *testing.T, test func(t *testing.T, r *repository.Repositories)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, repository.NewMemory(testSheets))
+	})
+	t.Run("sqlite", func(t *testing.T) {
+		test(t, newSQLite(t))
+	})
+}
+
+func newSQLite(t *testing.T) *repository.Repositories {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "torb.sqlite3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	m, err := migrate.New(db, dialect.SQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range testSheets {
+		if _, err := db.Exec("INSERT INTO sheets (id, `rank`, num, price) VALUES (?, ?, ?, ?)", s.ID, s.Rank, s.Num, s.Price); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r, err := repository.New(db, dialect.SQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestUsers(t *testing.T) {
+	forEach(t, func(t *testing.T, r *repository.Repositories) {
+		user := &User{Nickname: "ユーザー1", LoginName: "user1", PassHash: "hash1"}
+		if err := r.Users.Create(user); err != nil {
+			t.Fatal(err)
+		}
+		if user.ID == 0 {
+			t.Fatal("Create did not set the ID")
+		}
+		if err := r.Users.Create(&User{Nickname: "dup", LoginName: "user1", PassHash: "x"}); err != repository.ErrDuplicated {
+			t.Errorf("Create with the same login name: %v, want ErrDuplicated", err)
+		}
+
+		got, err := r.Users.Get(user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := (&User{ID: user.ID, Nickname: "ユーザー1", LoginName: "user1"}); !reflect.DeepEqual(got, want) {
+			t.Errorf("Get = %+v, want %+v without the pass hash", got, want)
+		}
+		got, err = r.Users.GetByLoginName("user1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.ID != user.ID || got.PassHash != "hash1" {
+			t.Errorf("GetByLoginName = %+v, want the user with the pass hash", got)
+		}
+		if _, err := r.Users.Get(user.ID + 100); err != repository.ErrNotFound {
+			t.Errorf("Get unknown: %v, want ErrNotFound", err)
+		}
+		if _, err := r.Users.GetByLoginName("nobody"); err != repository.ErrNotFound {
+			t.Errorf("GetByLoginName unknown: %v, want ErrNotFound", err)
+		}
+
+		if err := r.Users.UpdateNickname(user.ID, "renamed"); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Users.UpdatePassHash(user.ID, "hash2"); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := r.Users.Get(user.ID); got.Nickname != "renamed" {
+			t.Errorf("nickname = %q after UpdateNickname", got.Nickname)
+		}
+		if passHash, err := r.Users.PassHash(user.ID); err != nil || passHash != "hash2" {
+			t.Errorf("PassHash = %q, %v after UpdatePassHash", passHash, err)
+		}
+
+		if got, err := r.Users.Get(user.ID); err != nil || got.Deactivated {
+			t.Errorf("Get = %+v, %v before Deactivate", got, err)
+		}
+		for i := 0; i < 2; i++ {
+			if err := r.Users.Deactivate(user.ID, time.Now()); err != nil {
+				t.Fatalf("Deactivate #%d: %v", i+1, err)
+			}
+		}
+		if got, err := r.Users.Get(user.ID); err != nil || !got.Deactivated {
+			t.Errorf("Get = %+v, %v after Deactivate", got, err)
+		}
+		if got, err := r.Users.GetByLoginName("user1"); err != nil || !got.Deactivated {
+			t.Errorf("GetByLoginName = %+v, %v after Deactivate", got, err)
+		}
+	})
+}
+
+func TestAdministrators(t *testing.T) {
+	forEach(t, func(t *testing.T, r *repository.Repositories) {
+		admin := &Administrator{Nickname: "admin", LoginName: "admin", PassHash: "hash", Roles: []string{"superadmin"}}
+		if err := r.Administrators.Create(admin); err != nil {
+			t.Fatal(err)
+		}
+		viewer := &Administrator{Nickname: "viewer", LoginName: "viewer", PassHash: "hash", Roles: []string{"viewer", "finance"}}
+		if err := r.Administrators.Create(viewer); err != nil {
+			t.Fatal(err)
+		}
+		roleless := &Administrator{Nickname: "old", LoginName: "old", PassHash: "hash"}
+		if err := r.Administrators.Create(roleless); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Administrators.Create(&Administrator{Nickname: "dup", LoginName: "admin", PassHash: "x"}); err != repository.ErrDuplicated {
+			t.Errorf("Create with the same login name: %v, want ErrDuplicated", err)
+		}
+
+		got, err := r.Administrators.Get(viewer.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := &Administrator{ID: viewer.ID, Nickname: "viewer", LoginName: "viewer", Roles: []string{"finance", "viewer"}}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Get = %+v, want %+v with the sorted roles", got, want)
+		}
+		if got, err := r.Administrators.GetByLoginName("admin"); err != nil || got.PassHash != "hash" || !reflect.DeepEqual(got.Roles, []string{"superadmin"}) {
+			t.Errorf("GetByLoginName = %+v, %v, want the pass hash and the roles", got, err)
+		}
+		if _, err := r.Administrators.Get(roleless.ID + 100); err != repository.ErrNotFound {
+			t.Errorf("Get unknown: %v, want ErrNotFound", err)
+		}
+
+		viewer.Nickname = "finance"
+		viewer.Roles = []string{"finance"}
+		if err := r.Administrators.Update(viewer); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := r.Administrators.Get(viewer.ID); got.Nickname != "finance" || !reflect.DeepEqual(got.Roles, []string{"finance"}) {
+			t.Errorf("Get = %+v after Update", got)
+		}
+		if err := r.Administrators.UpdatePassHash(viewer.ID, "hash2"); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := r.Administrators.GetByLoginName("viewer"); got.PassHash != "hash2" {
+			t.Errorf("pass hash = %q after UpdatePassHash", got.PassHash)
+		}
+
+		n, err := r.Administrators.GrantRoleless("superadmin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Errorf("GrantRoleless = %d, want 1", n)
+		}
+		if got, _ := r.Administrators.Get(roleless.ID); !reflect.DeepEqual(got.Roles, []string{"superadmin"}) {
+			t.Errorf("roles = %v after GrantRoleless", got.Roles)
+		}
+		if n, err := r.Administrators.GrantRoleless("superadmin"); err != nil || n != 0 {
+			t.Errorf("GrantRoleless again = %d, %v, want 0", n, err)
+		}
+
+		if err := r.Administrators.Delete(roleless.ID); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Administrators.Delete(roleless.ID); err != repository.ErrNotFound {
+			t.Errorf("Delete twice: %v, want ErrNotFound", err)
+		}
+		list, err := r.Administrators.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []int64
+		for _, a := range list {
+			if a.PassHash != "" {
+				t.Errorf("List returned the pass hash of %d", a.ID)
+			}
+			ids = append(ids, a.ID)
+		}
+		if want := []int64{admin.ID, viewer.ID}; !reflect.DeepEqual(ids, want) {
+			t.Errorf("List IDs = %v, want %v", ids, want)
+		}
+	})
+}
+
+func TestEvents(t *testing.T) {
+	forEach(t, func(t *testing.T, r *repository.Repositories) {
+		var ids []int64
+		for i, public := range []bool{true, false, true} {
+			event := &Event{Title: "event", PublicFg: public, ClosedFg: true, Price: int64(1000 * (i + 1))}
+			if err := r.Events.Create(event); err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, event.ID)
+		}
+
+		got, err := r.Events.Get(ids[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := (&Event{ID: ids[0], Title: "event", PublicFg: true, Price: 1000}); !reflect.DeepEqual(got, want) {
+			t.Errorf("Get = %+v, want %+v not closed", got, want)
+		}
+		if _, err := r.Events.Get(ids[2] + 100); err != repository.ErrNotFound {
+			t.Errorf("Get unknown: %v, want ErrNotFound", err)
+		}
+
+		if err := r.Events.UpdateFlags(ids[1], true, true); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := r.Events.Get(ids[1]); !got.PublicFg || !got.ClosedFg {
+			t.Errorf("Get = %+v after UpdateFlags", got)
+		}
+
+		list, err := r.Events.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := eventIDs(list); !reflect.DeepEqual(got, ids) {
+			t.Errorf("List IDs = %v, want %v", got, ids)
+		}
+		in, err := r.Events.ListIn([]int64{ids[2], ids[0], ids[0], ids[2] + 100})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got2 := eventIDs(in)
+		sort.Slice(got2, func(i, j int) bool { return got2[i] < got2[j] })
+		if want := []int64{ids[0], ids[2]}; !reflect.DeepEqual(got2, want) {
+			t.Errorf("ListIn IDs = %v, want %v", got2, want)
+		}
+		if in, err := r.Events.ListIn(nil); err != nil || len(in) != 0 {
+			t.Errorf("ListIn(nil) = %v, %v", in, err)
+		}
+	})
+}
+
+func eventIDs(events []*Event) []int64 {
+	var ids []int64
+	for _, e := range events {
+		ids = append(ids, e.ID)
+	}
+	return ids
+}
+
+func TestSheets(t *testing.T) {
+	forEach(t, func(t *testing.T, r *repository.Repositories) {
+		list, err := r.Sheets.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []int64
+		for _, s := range list {
+			ids = append(ids, s.ID)
+		}
+		// rank, num の順
+		if want := []int64{3, 4, 1, 2}; !reflect.DeepEqual(ids, want) {
+			t.Errorf("List IDs = %v, want %v", ids, want)
+		}
+
+		if got, err := r.Sheets.Get(2); err != nil || *got != testSheets[1] {
+			t.Errorf("Get(2) = %+v, %v", got, err)
+		}
+		if got, err := r.Sheets.GetByRankNum("A", 1); err != nil || *got != testSheets[2] {
+			t.Errorf("GetByRankNum(A, 1) = %+v, %v", got, err)
+		}
+		if _, err := r.Sheets.GetByRankNum("B", 1); err != repository.ErrNotFound {
+			t.Errorf("GetByRankNum unknown: %v, want ErrNotFound", err)
+		}
+		if n, err := r.Sheets.CountByRank("S"); err != nil || n != 2 {
+			t.Errorf("CountByRank(S) = %d, %v, want 2", n, err)
+		}
+		if n, err := r.Sheets.CountByRank("X"); err != nil || n != 0 {
+			t.Errorf("CountByRank(X) = %d, %v, want 0", n, err)
+		}
+	})
+}
+
+func TestReservations(t *testing.T) {
+	forEach(t, func(t *testing.T, r *repository.Repositories) {
+		e1 := &Event{Title: "e1", PublicFg: true, Price: 1000}
+		e2 := &Event{Title: "e2", PublicFg: true, Price: 2000}
+		for _, e := range []*Event{e1, e2} {
+			if err := r.Events.Create(e); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		base := time.Date(2018, 10, 20, 12, 0, 0, 123456000, time.UTC)
+		insert := func(id, eventID, sheetID, userID int64, reservedAt time.Time) {
+			t.Helper()
+			reservation := &Reservation{ID: id, EventID: eventID, SheetID: sheetID, UserID: userID}
+			reservation.SetReservedAt(reservedAt)
+			if err := r.Reservations.Insert(reservation); err != nil {
+				t.Fatal(err)
+			}
+		}
+		insert(1, e1.ID, 1, 10, base)
+		insert(2, e1.ID, 3, 10, base.Add(time.Minute))
+		insert(3, e2.ID, 4, 10, base.Add(2*time.Minute))
+		insert(4, e1.ID, 2, 20, base.Add(3*time.Minute))
+		// e1 の予約を最後にキャンセルすると e1 が最近のイベントになる
+		canceledAt := base.Add(10 * time.Minute)
+		if err := r.Reservations.Cancel(1, canceledAt); err != nil {
+			t.Fatal(err)
+		}
+
+		notCanceled, err := r.Reservations.ListNotCanceled()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := reservationIDs(notCanceled)
+		sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+		if !reflect.DeepEqual(got, []int64{2, 3, 4}) {
+			t.Errorf("ListNotCanceled IDs = %v", got)
+		}
+		canceled, err := r.Reservations.ListCanceled()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(canceled) != 1 || canceled[0].ID != 1 || canceled[0].CanceledAt == nil || !canceled[0].CanceledAt.Equal(canceledAt) {
+			t.Fatalf("ListCanceled = %+v", canceled)
+		}
+		if !canceled[0].ReservedAt.Equal(base) || canceled[0].ReservedAtUnix != base.Unix() {
+			t.Errorf("reserved_at = %v, want %v in microseconds", canceled[0].ReservedAt, base)
+		}
+
+		byEvent, err := r.Reservations.ListByEvent(e1.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := reservationIDs(byEvent); !reflect.DeepEqual(got, []int64{1, 2, 4}) {
+			t.Errorf("ListByEvent IDs = %v, want in reserved_at order", got)
+		}
+		if got := byEvent[1]; got.SheetRank != "A" || got.SheetNum != 1 || got.Price != 4000 {
+			t.Errorf("ListByEvent[1] = %+v, want A-1 for 4000", got)
+		}
+
+		recent, err := r.Reservations.RecentByUser(10, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var recentIDs []int64
+		for _, reservation := range recent {
+			recentIDs = append(recentIDs, reservation.ID)
+		}
+		if want := []int64{1, 3}; !reflect.DeepEqual(recentIDs, want) {
+			t.Errorf("RecentByUser IDs = %v, want %v", recentIDs, want)
+		}
+		if recent[1].SheetRank != "C" || recent[1].SheetNum != 1 {
+			t.Errorf("RecentByUser[1] = %+v, want C-1", recent[1])
+		}
+		if recent, err := r.Reservations.RecentByUser(99, 5); err != nil || len(recent) != 0 {
+			t.Errorf("RecentByUser without reservations = %v, %v", recent, err)
+		}
+
+		eventIDs, err := r.Reservations.RecentEventIDsByUser(10, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []int64{e1.ID, e2.ID}; !reflect.DeepEqual(eventIDs, want) {
+			t.Errorf("RecentEventIDsByUser = %v, want %v", eventIDs, want)
+		}
+		if eventIDs, err := r.Reservations.RecentEventIDsByUser(10, 1); err != nil || len(eventIDs) != 1 {
+			t.Errorf("RecentEventIDsByUser limit 1 = %v, %v", eventIDs, err)
+		}
+
+		// 2: e1 (1000) + A (3000)、3: e2 (2000) + C (0)。キャンセルした1は含まない
+		if total, err := r.Reservations.TotalPriceByUser(10); err != nil || total != 6000 {
+			t.Errorf("TotalPriceByUser = %d, %v, want 6000", total, err)
+		}
+		if total, err := r.Reservations.TotalPriceByUser(99); err != nil || total != 0 {
+			t.Errorf("TotalPriceByUser without reservations = %d, %v, want 0", total, err)
+		}
+	})
+}
+
+func reservationIDs(reservations []*Reservation) []int64 {
+	var ids []int64
+	for _, r := range reservations {
+		ids = append(ids, r.ID)
+	}
+	return ids
+}
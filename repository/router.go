@@ -0,0 +1,69 @@
+package repository
+
+import (
+	"database/sql"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"torb/dialect"
+)
+
+// NewReadOnly returns the repositories on a read replica, which must only be used for reads.
+// The tables are created on the primary and replicated.
+func NewReadOnly(db *sql.DB, d dialect.Dialect) *Repositories {
+	return newSQL(db, d)
+}
+
+// Router chooses the primary or a replica for the reads.
+// Writes always go to the primary, so they use Primary.
+type Router struct {
+	primary  *Repositories
+	replicas []*Repositories
+	next     uint32
+	// maxLag is how long the writer reads from the primary after its write
+	maxLag time.Duration
+	// wroteAt is the last write time by user ID
+	wroteAt sync.Map
+}
+
+// NewRouter returns the router, which reads from the primary if no replica is given
+func NewRouter(primary *Repositories, replicas []*Repositories, maxLag time.Duration) *Router {
+	return &Router{primary: primary, replicas: replicas, maxLag: maxLag}
+}
+
+// Primary returns the repositories for the writes and the reads which must see them
+func (r *Router) Primary() *Repositories {
+	return r.primary
+}
+
+// Stale returns the repositories of the next replica for the reads which tolerate the replication lag
+func (r *Router) Stale() *Repositories {
+	if len(r.replicas) == 0 {
+		return r.primary
+	}
+	i := atomic.AddUint32(&r.next, 1)
+	return r.replicas[int(i)%len(r.replicas)]
+}
+
+// Reader returns Stale for the user, or Primary if the user wrote within the max lag to read their own writes.
+// userID 0 is anonymous.
+func (r *Router) Reader(userID int64) *Repositories {
+	if userID != 0 {
+		if t, ok := r.wroteAt.Load(userID); ok {
+			if time.Since(t.(time.Time)) < r.maxLag {
+				return r.primary
+			}
+			r.wroteAt.Delete(userID)
+		}
+	}
+	return r.Stale()
+}
+
+// Wrote records the write by the user for Reader
+func (r *Router) Wrote(userID int64) {
+	if userID == 0 || len(r.replicas) == 0 {
+		return
+	}
+	r.wroteAt.Store(userID, time.Now())
+}
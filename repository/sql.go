@@ -0,0 +1,512 @@
+package repository
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"torb/dialect"
+	. "torb/structs"
+)
+
+// reserved_at/canceled_at are stored as DATETIME(6)
+const datetimeFormat = "2006-01-02 15:04:05.000000"
+
+// tables added by the app, users/administrators/events/sheets/reservations are created by the migrations
+var appSchemas = []string{
+	// 退会したユーザー。予約や売上の記録に使われているので users からは消さない
+	"CREATE TABLE IF NOT EXISTS user_deactivations (user_id BIGINT NOT NULL PRIMARY KEY, deactivated_at DATETIME(6) NOT NULL) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4",
+	"CREATE TABLE IF NOT EXISTS administrator_roles (administrator_id BIGINT NOT NULL, role VARCHAR(32) NOT NULL, PRIMARY KEY (administrator_id, role)) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4",
+}
+
+// New returns the repositories on the migrated database, creating the tables added by the app if not exist
+func New(db *sql.DB, d dialect.Dialect) (*Repositories, error) {
+	for _, schema := range appSchemas {
+		for _, stmt := range d.Schema(schema) {
+			if _, err := db.Exec(stmt); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return newSQL(db, d), nil
+}
+
+func newSQL(db *sql.DB, d dialect.Dialect) *Repositories {
+	return &Repositories{
+		Users:          &sqlUsers{db: db, d: d},
+		Administrators: &sqlAdministrators{db: db},
+		Events:         &sqlEvents{db: db},
+		Sheets:         &sqlSheets{db: db},
+		Reservations:   &sqlReservations{db: db},
+	}
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func inClause(ids []int64) string {
+	s := make([]string, len(ids))
+	for i, id := range ids {
+		s[i] = fmt.Sprint(id)
+	}
+	return strings.Join(s, ",")
+}
+
+type sqlUsers struct {
+	db *sql.DB
+	d  dialect.Dialect
+}
+
+// 退会はリクエストごとに確認するので、別のクエリにせず LEFT JOIN で users と一緒に読む
+func (r *sqlUsers) Get(id int64) (*User, error) {
+	var user User
+	if err := r.db.QueryRow("SELECT u.id, u.login_name, u.nickname, d.user_id IS NOT NULL FROM users u LEFT JOIN user_deactivations d ON d.user_id = u.id WHERE u.id = ?", id).Scan(&user.ID, &user.LoginName, &user.Nickname, &user.Deactivated); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (r *sqlUsers) GetByLoginName(loginName string) (*User, error) {
+	var user User
+	if err := r.db.QueryRow("SELECT u.id, u.login_name, u.nickname, u.pass_hash, d.user_id IS NOT NULL FROM users u LEFT JOIN user_deactivations d ON d.user_id = u.id WHERE u.login_name = ?", loginName).Scan(&user.ID, &user.LoginName, &user.Nickname, &user.PassHash, &user.Deactivated); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (r *sqlUsers) PassHash(id int64) (string, error) {
+	var passHash string
+	err := r.db.QueryRow("SELECT pass_hash FROM users WHERE id = ?", id).Scan(&passHash)
+	return passHash, err
+}
+
+func (r *sqlUsers) Create(user *User) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	var exists int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM users WHERE login_name = ?", user.LoginName).Scan(&exists); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if exists > 0 {
+		tx.Rollback()
+		return ErrDuplicated
+	}
+
+	res, err := tx.Exec("INSERT INTO users (login_name, pass_hash, nickname) VALUES (?, ?, ?)", user.LoginName, user.PassHash, user.Nickname)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if user.ID, err = res.LastInsertId(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *sqlUsers) UpdateNickname(id int64, nickname string) error {
+	_, err := r.db.Exec("UPDATE users SET nickname = ? WHERE id = ?", nickname, id)
+	return err
+}
+
+func (r *sqlUsers) UpdatePassHash(id int64, passHash string) error {
+	_, err := r.db.Exec("UPDATE users SET pass_hash = ? WHERE id = ?", passHash, id)
+	return err
+}
+
+func (r *sqlUsers) Deactivate(id int64, at time.Time) error {
+	_, err := r.db.Exec(r.d.InsertIgnore()+" INTO user_deactivations (user_id, deactivated_at) VALUES (?, ?)", id, at)
+	return err
+}
+
+type sqlAdministrators struct {
+	db *sql.DB
+}
+
+func (r *sqlAdministrators) Get(id int64) (*Administrator, error) {
+	var administrator Administrator
+	if err := r.db.QueryRow("SELECT id, login_name, nickname FROM administrators WHERE id = ?", id).Scan(&administrator.ID, &administrator.LoginName, &administrator.Nickname); err != nil {
+		return nil, err
+	}
+	roles, err := r.roles(id)
+	if err != nil {
+		return nil, err
+	}
+	administrator.Roles = roles
+	return &administrator, nil
+}
+
+func (r *sqlAdministrators) GetByLoginName(loginName string) (*Administrator, error) {
+	var administrator Administrator
+	if err := r.db.QueryRow("SELECT id, login_name, nickname, pass_hash FROM administrators WHERE login_name = ?", loginName).Scan(&administrator.ID, &administrator.LoginName, &administrator.Nickname, &administrator.PassHash); err != nil {
+		return nil, err
+	}
+	roles, err := r.roles(administrator.ID)
+	if err != nil {
+		return nil, err
+	}
+	administrator.Roles = roles
+	return &administrator, nil
+}
+
+func (r *sqlAdministrators) List() ([]*Administrator, error) {
+	rows, err := r.db.Query("SELECT id, login_name, nickname FROM administrators ORDER BY id ASC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	administrators := []*Administrator{}
+	for rows.Next() {
+		var administrator Administrator
+		if err := rows.Scan(&administrator.ID, &administrator.LoginName, &administrator.Nickname); err != nil {
+			return nil, err
+		}
+		administrators = append(administrators, &administrator)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, administrator := range administrators {
+		if administrator.Roles, err = r.roles(administrator.ID); err != nil {
+			return nil, err
+		}
+	}
+	return administrators, nil
+}
+
+func (r *sqlAdministrators) roles(id int64) ([]string, error) {
+	rows, err := r.db.Query("SELECT role FROM administrator_roles WHERE administrator_id = ? ORDER BY role", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var roles []string
+	for rows.Next() {
+		var role string
+		if err := rows.Scan(&role); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	return roles, rows.Err()
+}
+
+func setRoles(tx *sql.Tx, id int64, roles []string) error {
+	if _, err := tx.Exec("DELETE FROM administrator_roles WHERE administrator_id = ?", id); err != nil {
+		return err
+	}
+	for _, role := range roles {
+		if _, err := tx.Exec("INSERT INTO administrator_roles (administrator_id, role) VALUES (?, ?)", id, role); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *sqlAdministrators) Create(administrator *Administrator) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	var exists int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM administrators WHERE login_name = ?", administrator.LoginName).Scan(&exists); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if exists > 0 {
+		tx.Rollback()
+		return ErrDuplicated
+	}
+
+	res, err := tx.Exec("INSERT INTO administrators (login_name, pass_hash, nickname) VALUES (?, ?, ?)", administrator.LoginName, administrator.PassHash, administrator.Nickname)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if administrator.ID, err = res.LastInsertId(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := setRoles(tx, administrator.ID, administrator.Roles); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *sqlAdministrators) Update(administrator *Administrator) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE administrators SET nickname = ? WHERE id = ?", administrator.Nickname, administrator.ID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := setRoles(tx, administrator.ID, administrator.Roles); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *sqlAdministrators) GrantRoleless(role string) (int64, error) {
+	res, err := r.db.Exec("INSERT INTO administrator_roles (administrator_id, role) "+
+		"SELECT a.id, ? FROM administrators a LEFT JOIN administrator_roles r ON r.administrator_id = a.id "+
+		"WHERE r.administrator_id IS NULL", role)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (r *sqlAdministrators) UpdatePassHash(id int64, passHash string) error {
+	_, err := r.db.Exec("UPDATE administrators SET pass_hash = ? WHERE id = ?", passHash, id)
+	return err
+}
+
+func (r *sqlAdministrators) Delete(id int64) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec("DELETE FROM administrators WHERE id = ?", id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		tx.Rollback()
+		if err != nil {
+			return err
+		}
+		return ErrNotFound
+	}
+	if err := setRoles(tx, id, nil); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+type sqlEvents struct {
+	db *sql.DB
+}
+
+func scanEvent(row scanner) (*Event, error) {
+	var event Event
+	if err := row.Scan(&event.ID, &event.Title, &event.PublicFg, &event.ClosedFg, &event.Price); err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
+
+func (r *sqlEvents) query(query string, args ...interface{}) ([]*Event, error) {
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []*Event
+	for rows.Next() {
+		event, err := scanEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+func (r *sqlEvents) List() ([]*Event, error) {
+	return r.query("SELECT id, title, public_fg, closed_fg, price FROM events ORDER BY id ASC")
+}
+
+func (r *sqlEvents) ListIn(ids []int64) ([]*Event, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	return r.query(fmt.Sprintf("SELECT id, title, public_fg, closed_fg, price FROM events WHERE id IN (%s)", inClause(ids)))
+}
+
+func (r *sqlEvents) Get(id int64) (*Event, error) {
+	return scanEvent(r.db.QueryRow("SELECT id, title, public_fg, closed_fg, price FROM events WHERE id = ?", id))
+}
+
+func (r *sqlEvents) Create(event *Event) error {
+	res, err := r.db.Exec("INSERT INTO events (title, public_fg, closed_fg, price) VALUES (?, ?, 0, ?)", event.Title, event.PublicFg, event.Price)
+	if err != nil {
+		return err
+	}
+	event.ID, err = res.LastInsertId()
+	return err
+}
+
+func (r *sqlEvents) UpdateFlags(id int64, public, closed bool) error {
+	_, err := r.db.Exec("UPDATE events SET public_fg = ?, closed_fg = ? WHERE id = ?", public, closed, id)
+	return err
+}
+
+type sqlSheets struct {
+	db *sql.DB
+}
+
+func scanSheet(row scanner) (*Sheet, error) {
+	var sheet Sheet
+	if err := row.Scan(&sheet.ID, &sheet.Rank, &sheet.Num, &sheet.Price); err != nil {
+		return nil, err
+	}
+	return &sheet, nil
+}
+
+func (r *sqlSheets) List() ([]Sheet, error) {
+	rows, err := r.db.Query("SELECT id, `rank`, num, price FROM sheets ORDER BY `rank`, num")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sheets []Sheet
+	for rows.Next() {
+		sheet, err := scanSheet(rows)
+		if err != nil {
+			return nil, err
+		}
+		sheets = append(sheets, *sheet)
+	}
+	return sheets, rows.Err()
+}
+
+func (r *sqlSheets) Get(id int64) (*Sheet, error) {
+	return scanSheet(r.db.QueryRow("SELECT id, `rank`, num, price FROM sheets WHERE id = ?", id))
+}
+
+func (r *sqlSheets) GetByRankNum(rank string, num int64) (*Sheet, error) {
+	return scanSheet(r.db.QueryRow("SELECT id, `rank`, num, price FROM sheets WHERE `rank` = ? AND num = ?", rank, num))
+}
+
+func (r *sqlSheets) CountByRank(rank string) (int, error) {
+	var count int
+	err := r.db.QueryRow("SELECT COUNT(*) FROM sheets WHERE `rank` = ?", rank).Scan(&count)
+	return count, err
+}
+
+type sqlReservations struct {
+	db *sql.DB
+}
+
+// setTimes fills the unix fields of the scanned times
+func setTimes(reservation *Reservation) {
+	reservation.SetReservedAt(*reservation.ReservedAt)
+	if reservation.CanceledAt != nil {
+		reservation.SetCanceledAt(*reservation.CanceledAt)
+	}
+}
+
+func (r *sqlReservations) Insert(reservation *Reservation) error {
+	_, err := r.db.Exec("INSERT INTO reservations (id, event_id, sheet_id, user_id, reserved_at) VALUES (?, ?, ?, ?, ?)",
+		reservation.ID, reservation.EventID, reservation.SheetID, reservation.UserID, reservation.ReservedAt.Format(datetimeFormat))
+	return err
+}
+
+func (r *sqlReservations) Cancel(id int64, canceledAt time.Time) error {
+	_, err := r.db.Exec("UPDATE reservations SET canceled_at = ? WHERE id = ?", canceledAt.Format(datetimeFormat), id)
+	return err
+}
+
+func (r *sqlReservations) list(query string, args ...interface{}) ([]*Reservation, error) {
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var reservations []*Reservation
+	for rows.Next() {
+		var reservation Reservation
+		if err := rows.Scan(&reservation.ID, &reservation.EventID, &reservation.SheetID, &reservation.UserID, &reservation.ReservedAt, &reservation.CanceledAt); err != nil {
+			return nil, err
+		}
+		setTimes(&reservation)
+		reservations = append(reservations, &reservation)
+	}
+	return reservations, rows.Err()
+}
+
+func (r *sqlReservations) ListNotCanceled() ([]*Reservation, error) {
+	return r.list("SELECT id, event_id, sheet_id, user_id, reserved_at, canceled_at FROM reservations WHERE canceled_at IS NULL")
+}
+
+func (r *sqlReservations) ListCanceled() ([]*Reservation, error) {
+	return r.list("SELECT id, event_id, sheet_id, user_id, reserved_at, canceled_at FROM reservations WHERE canceled_at IS NOT NULL")
+}
+
+func (r *sqlReservations) ListByEvent(eventID int64) ([]*Reservation, error) {
+	rows, err := r.db.Query("SELECT r.id, r.event_id, r.sheet_id, r.user_id, r.reserved_at, r.canceled_at, s.rank, s.num, e.price + s.price FROM reservations r INNER JOIN sheets s ON s.id = r.sheet_id INNER JOIN events e ON e.id = r.event_id WHERE r.event_id = ? ORDER BY reserved_at ASC", eventID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var reservations []*Reservation
+	for rows.Next() {
+		var reservation Reservation
+		if err := rows.Scan(&reservation.ID, &reservation.EventID, &reservation.SheetID, &reservation.UserID, &reservation.ReservedAt, &reservation.CanceledAt, &reservation.SheetRank, &reservation.SheetNum, &reservation.Price); err != nil {
+			return nil, err
+		}
+		setTimes(&reservation)
+		reservations = append(reservations, &reservation)
+	}
+	return reservations, rows.Err()
+}
+
+func (r *sqlReservations) RecentByUser(userID int64, limit int) ([]Reservation, error) {
+	rows, err := r.db.Query("SELECT r.id, r.event_id, r.sheet_id, r.user_id, r.reserved_at, r.canceled_at, s.rank, s.num FROM reservations r INNER JOIN sheets s ON s.id = r.sheet_id WHERE r.user_id = ? ORDER BY COALESCE(r.canceled_at, r.reserved_at) DESC LIMIT ?", userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reservations := []Reservation{}
+	for rows.Next() {
+		var reservation Reservation
+		if err := rows.Scan(&reservation.ID, &reservation.EventID, &reservation.SheetID, &reservation.UserID, &reservation.ReservedAt, &reservation.CanceledAt, &reservation.SheetRank, &reservation.SheetNum); err != nil {
+			return nil, err
+		}
+		setTimes(&reservation)
+		reservations = append(reservations, reservation)
+	}
+	return reservations, rows.Err()
+}
+
+func (r *sqlReservations) RecentEventIDsByUser(userID int64, limit int) ([]int64, error) {
+	rows, err := r.db.Query("SELECT event_id FROM reservations WHERE user_id = ? GROUP BY event_id ORDER BY MAX(COALESCE(canceled_at, reserved_at)) DESC LIMIT ?", userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var eventIDs []int64
+	for rows.Next() {
+		var eventID int64
+		if err := rows.Scan(&eventID); err != nil {
+			return nil, err
+		}
+		eventIDs = append(eventIDs, eventID)
+	}
+	return eventIDs, rows.Err()
+}
+
+func (r *sqlReservations) TotalPriceByUser(userID int64) (int64, error) {
+	var totalPrice int64
+	err := r.db.QueryRow("SELECT COALESCE(SUM(e.price + s.price), 0) FROM reservations r INNER JOIN sheets s ON s.id = r.sheet_id INNER JOIN events e ON e.id = r.event_id WHERE r.user_id = ? AND r.canceled_at IS NULL", userID).Scan(&totalPrice)
+	return totalPrice, err
+}
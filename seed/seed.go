@@ -0,0 +1,231 @@
+package seed
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io/fs"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"torb/fixture"
+	"torb/password"
+)
+
+// Ranks of the sheets
+var Ranks = []string{"S", "A", "B", "C"}
+
+// Config is the shape of the generated data
+type Config struct {
+	Users  int
+	Events int
+	// ClosedRate is the ratio of the closed events, which are not public
+	ClosedRate float64
+	// PublicRate is the ratio of the public events in the events not closed
+	PublicRate float64
+	// ReserveRates is the ratio of the reserved sheets by rank in the public events
+	ReserveRates map[string]float64
+	// CancelRates is the ratio of the canceled reservations by rank, the canceled sheets may be reserved again
+	CancelRates map[string]float64
+	// Since and Until are the range of reserved_at and canceled_at
+	Since time.Time
+	Until time.Time
+	// Seed makes the same data for the same config
+	Seed int64
+}
+
+// DefaultConfig returns a dataset a bit smaller than the initial data of the contest
+func DefaultConfig() *Config {
+	now := time.Now().UTC()
+	return &Config{
+		Users:        1000,
+		Events:       20,
+		ClosedRate:   0.2,
+		PublicRate:   0.9,
+		ReserveRates: map[string]float64{"S": 0.9, "A": 0.7, "B": 0.5, "C": 0.3},
+		CancelRates:  map[string]float64{"S": 0.05, "A": 0.1, "B": 0.1, "C": 0.2},
+		Since:        now.AddDate(0, -1, 0),
+		Until:        now,
+		Seed:         1,
+	}
+}
+
+// ParseRankRates parses "0.5" for all the ranks or "S=0.9,A=0.7,B=0.5,C=0.3", missing ranks are 0
+func ParseRankRates(s string) (map[string]float64, error) {
+	rates := map[string]float64{}
+	if !strings.Contains(s, "=") {
+		rate, err := parseRate(s)
+		if err != nil {
+			return nil, err
+		}
+		for _, rank := range Ranks {
+			rates[rank] = rate
+		}
+		return rates, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 || !validRank(kv[0]) {
+			return nil, fmt.Errorf("seed: invalid rank rate %q", part)
+		}
+		rate, err := parseRate(kv[1])
+		if err != nil {
+			return nil, err
+		}
+		rates[kv[0]] = rate
+	}
+	return rates, nil
+}
+
+func parseRate(s string) (float64, error) {
+	rate, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || rate < 0 || rate > 1 {
+		return 0, fmt.Errorf("seed: rate must be between 0 and 1: %q", s)
+	}
+	return rate, nil
+}
+
+func validRank(rank string) bool {
+	for _, r := range Ranks {
+		if r == rank {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the config
+func (cfg *Config) Validate() error {
+	if cfg.Users < 1 {
+		return fmt.Errorf("seed: users must be at least 1")
+	}
+	if cfg.Events < 0 {
+		return fmt.Errorf("seed: events must not be negative")
+	}
+	if cfg.ClosedRate < 0 || cfg.ClosedRate > 1 || cfg.PublicRate < 0 || cfg.PublicRate > 1 {
+		return fmt.Errorf("seed: rate must be between 0 and 1")
+	}
+	if !cfg.Since.Before(cfg.Until) {
+		return fmt.Errorf("seed: since must be before until")
+	}
+	return nil
+}
+
+// Table is the generated rows of a table, nil is NULL
+type Table struct {
+	Name    string
+	Columns []string
+	Rows    [][]interface{}
+}
+
+const datetimeFormat = "2006-01-02 15:04:05.000000"
+
+// Generate returns the sheets and administrators of base (the fixtures such as fixture.Embedded())
+// and the generated users, events and reservations
+func Generate(cfg *Config, base fs.FS) ([]*Table, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	sheets, err := readCSV(base, "sheets")
+	if err != nil {
+		return nil, err
+	}
+	administrators, err := readCSV(base, "administrators")
+	if err != nil {
+		return nil, err
+	}
+	rankOf := map[int64]string{}
+	for _, row := range sheets.Rows {
+		id, err := strconv.ParseInt(row[0].(string), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("seed: invalid sheet id %v", row[0])
+		}
+		rankOf[id] = row[1].(string)
+	}
+
+	rnd := rand.New(rand.NewSource(cfg.Seed))
+	randomTime := func(from time.Time) time.Time {
+		return from.Add(time.Duration(rnd.Int63n(int64(cfg.Until.Sub(from)) + 1)))
+	}
+
+	users := &Table{Name: "users", Columns: []string{"id", "nickname", "login_name", "pass_hash"}}
+	for id := 1; id <= cfg.Users; id++ {
+		// パスワードはログイン名と同じ
+		loginName := fmt.Sprintf("user%d", id)
+		users.Rows = append(users.Rows, []interface{}{int64(id), fmt.Sprintf("ユーザー%d", id), loginName, password.LegacyHash(loginName)})
+	}
+
+	events := &Table{Name: "events", Columns: []string{"id", "title", "public_fg", "closed_fg", "price"}}
+	reservations := &Table{Name: "reservations", Columns: []string{"id", "event_id", "sheet_id", "user_id", "reserved_at", "canceled_at"}}
+	var reservationID int64
+	for id := int64(1); id <= int64(cfg.Events); id++ {
+		closed := rnd.Float64() < cfg.ClosedRate
+		public := !closed && rnd.Float64() < cfg.PublicRate
+		price := int64(1000 * (1 + rnd.Intn(10)))
+		events.Rows = append(events.Rows, []interface{}{id, fmt.Sprintf("イベント%d", id), boolInt(public), boolInt(closed), price})
+		// 予約できるのは公開中のイベントだけなので、非公開・終了済みのイベントには予約を作らない
+		if !public {
+			continue
+		}
+
+		for _, row := range sheets.Rows {
+			sheetID, _ := strconv.ParseInt(row[0].(string), 10, 64)
+			rank := rankOf[sheetID]
+			from := cfg.Since
+			// キャンセルされた席はまた予約されうる。無限に続かないよう3回まで
+			for i := 0; i < 3 && rnd.Float64() < cfg.ReserveRates[rank]; i++ {
+				reservationID++
+				reservedAt := randomTime(from)
+				var canceledAt interface{}
+				canceled := rnd.Float64() < cfg.CancelRates[rank] && reservedAt.Before(cfg.Until)
+				if canceled {
+					t := randomTime(reservedAt)
+					canceledAt = t.Format(datetimeFormat)
+					from = t
+				}
+				userID := 1 + rnd.Int63n(int64(cfg.Users))
+				reservations.Rows = append(reservations.Rows, []interface{}{reservationID, id, sheetID, userID, reservedAt.Format(datetimeFormat), canceledAt})
+				if !canceled {
+					break
+				}
+			}
+		}
+	}
+
+	return []*Table{sheets, administrators, users, events, reservations}, nil
+}
+
+func boolInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func readCSV(fsys fs.FS, table string) (*Table, error) {
+	f, err := fsys.Open(table + ".csv")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("seed: %s.csv: %v", table, err)
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("seed: %s.csv is empty", table)
+	}
+	t := &Table{Name: table, Columns: records[0]}
+	for _, record := range records[1:] {
+		row := make([]interface{}, len(record))
+		for i, v := range record {
+			if v != fixture.Null {
+				row[i] = v
+			}
+		}
+		t.Rows = append(t.Rows, row)
+	}
+	return t, nil
+}
@@ -0,0 +1,207 @@
+package seed
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"torb/fixture"
+)
+
+func TestParseRankRates(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want map[string]float64
+	}{
+		{"0.5", map[string]float64{"S": 0.5, "A": 0.5, "B": 0.5, "C": 0.5}},
+		{"0", map[string]float64{"S": 0, "A": 0, "B": 0, "C": 0}},
+		{"1", map[string]float64{"S": 1, "A": 1, "B": 1, "C": 1}},
+		{"S=0.9,A=0.7,B=0.5,C=0.3", map[string]float64{"S": 0.9, "A": 0.7, "B": 0.5, "C": 0.3}},
+		// 指定しないランクは0
+		{"S=0.1, C=0.3", map[string]float64{"S": 0.1, "C": 0.3}},
+	} {
+		got, err := ParseRankRates(tt.in)
+		if err != nil {
+			t.Errorf("ParseRankRates(%q): %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseRankRates(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+
+	for _, in := range []string{
+		"",
+		"x",
+		"D=0.5",
+		"s=0.5",
+		"S",
+		"S=0.5,D=0.1",
+		"S=x",
+		"-0.1",
+		"1.5",
+		"S=1.01",
+		"A=-1",
+	} {
+		if _, err := ParseRankRates(in); err == nil {
+			t.Errorf("ParseRankRates(%q) = nil error, want error", in)
+		}
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	if err := DefaultConfig().Validate(); err != nil {
+		t.Errorf("DefaultConfig().Validate(): %v", err)
+	}
+	for name, modify := range map[string]func(cfg *Config){
+		"no users":        func(cfg *Config) { cfg.Users = 0 },
+		"negative events": func(cfg *Config) { cfg.Events = -1 },
+		"closed rate < 0": func(cfg *Config) { cfg.ClosedRate = -0.1 },
+		"closed rate > 1": func(cfg *Config) { cfg.ClosedRate = 1.1 },
+		"public rate < 0": func(cfg *Config) { cfg.PublicRate = -0.1 },
+		"public rate > 1": func(cfg *Config) { cfg.PublicRate = 1.1 },
+		"since = until":   func(cfg *Config) { cfg.Since = cfg.Until },
+		"since > until":   func(cfg *Config) { cfg.Since = cfg.Until.Add(time.Second) },
+	} {
+		cfg := DefaultConfig()
+		modify(cfg)
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("%s: Validate = nil, want error", name)
+		}
+		if _, err := Generate(cfg, fixture.Embedded()); err == nil {
+			t.Errorf("%s: Generate = nil error, want error", name)
+		}
+	}
+
+	cfg := DefaultConfig()
+	cfg.Events = 0
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("no events: %v", err)
+	}
+}
+
+func testConfig() *Config {
+	cfg := DefaultConfig()
+	cfg.Users = 50
+	cfg.Events = 20
+	cfg.ClosedRate = 0.3
+	cfg.PublicRate = 0.7
+	cfg.CancelRates = map[string]float64{"S": 0.5, "A": 0.5, "B": 0.5, "C": 0.5}
+	cfg.Since = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	cfg.Until = time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+	return cfg
+}
+
+func tableOf(t *testing.T, tables []*Table, name string) *Table {
+	t.Helper()
+	for _, table := range tables {
+		if table.Name == name {
+			return table
+		}
+	}
+	t.Fatalf("no table %s", name)
+	return nil
+}
+
+func TestGenerateDeterministic(t *testing.T) {
+	a, err := Generate(testConfig(), fixture.Embedded())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := Generate(testConfig(), fixture.Embedded())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(a, b) {
+		t.Error("Generate with the same seed returned different tables")
+	}
+
+	cfg := testConfig()
+	cfg.Seed = 2
+	c, err := Generate(cfg, fixture.Embedded())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reflect.DeepEqual(tableOf(t, a, "reservations"), tableOf(t, c, "reservations")) {
+		t.Error("Generate with another seed returned the same reservations")
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	cfg := testConfig()
+	tables, err := Generate(cfg, fixture.Embedded())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(tableOf(t, tables, "users").Rows); got != cfg.Users {
+		t.Errorf("users = %d, want %d", got, cfg.Users)
+	}
+	events := tableOf(t, tables, "events")
+	if len(events.Rows) != cfg.Events {
+		t.Fatalf("events = %d, want %d", len(events.Rows), cfg.Events)
+	}
+
+	public := map[int64]bool{}
+	var closed, private int
+	for _, row := range events.Rows {
+		switch {
+		case row[3] == int64(1):
+			if row[2] == int64(1) {
+				t.Errorf("event %d is public and closed", row[0])
+			}
+			closed++
+		case row[2] == int64(1):
+			public[row[0].(int64)] = true
+		default:
+			private++
+		}
+	}
+	if closed == 0 || private == 0 || len(public) == 0 {
+		t.Fatalf("closed %d, private %d, public %d events, want all kinds", closed, private, len(public))
+	}
+
+	reservations := tableOf(t, tables, "reservations")
+	if len(reservations.Rows) == 0 {
+		t.Fatal("no reservations")
+	}
+	var canceled int
+	notCanceled := map[[2]int64]bool{}
+	for _, row := range reservations.Rows {
+		eventID, sheetID, userID := row[1].(int64), row[2].(int64), row[3].(int64)
+		if !public[eventID] {
+			t.Errorf("reservation %d is for the closed or private event %d", row[0], eventID)
+		}
+		if userID < 1 || userID > int64(cfg.Users) {
+			t.Errorf("reservation %d is for the unknown user %d", row[0], userID)
+		}
+		reservedAt, err := time.Parse(datetimeFormat, row[4].(string))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reservedAt.Before(cfg.Since) || reservedAt.After(cfg.Until) {
+			t.Errorf("reservation %d reserved_at %v is out of [%v, %v]", row[0], reservedAt, cfg.Since, cfg.Until)
+		}
+		if row[5] == nil {
+			key := [2]int64{eventID, sheetID}
+			if notCanceled[key] {
+				t.Errorf("sheet %d of event %d is reserved twice", sheetID, eventID)
+			}
+			notCanceled[key] = true
+			continue
+		}
+		canceled++
+		canceledAt, err := time.Parse(datetimeFormat, row[5].(string))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if canceledAt.Before(reservedAt) {
+			t.Errorf("reservation %d canceled_at %v is before reserved_at %v", row[0], canceledAt, reservedAt)
+		}
+		if canceledAt.Before(cfg.Since) || canceledAt.After(cfg.Until) {
+			t.Errorf("reservation %d canceled_at %v is out of [%v, %v]", row[0], canceledAt, cfg.Since, cfg.Until)
+		}
+	}
+	if canceled == 0 {
+		t.Error("no canceled reservations")
+	}
+}
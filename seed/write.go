@@ -0,0 +1,109 @@
+package seed
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"torb/fixture"
+)
+
+// rows per INSERT of WriteSQL
+const sqlBatchSize = 1000
+
+// WriteCSV writes <table>.csv of the tables into dir, which fixture.Load reads
+func WriteCSV(dir string, tables []*Table) error {
+	return writeFiles(dir, tables, ".csv", func(w *bufio.Writer, t *Table) error {
+		cw := csv.NewWriter(w)
+		if err := cw.Write(t.Columns); err != nil {
+			return err
+		}
+		record := make([]string, len(t.Columns))
+		for _, row := range t.Rows {
+			for i, v := range row {
+				if v == nil {
+					record[i] = fixture.Null
+				} else {
+					record[i] = fmt.Sprint(v)
+				}
+			}
+			if err := cw.Write(record); err != nil {
+				return err
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+	})
+}
+
+// WriteSQL writes <table>.sql of the tables into dir as multi-row INSERTs, which fixture.Load reads
+func WriteSQL(dir string, tables []*Table) error {
+	return writeFiles(dir, tables, ".sql", func(w *bufio.Writer, t *Table) error {
+		columns := make([]string, len(t.Columns))
+		for i, column := range t.Columns {
+			columns[i] = "`" + column + "`"
+		}
+		insert := fmt.Sprintf("INSERT INTO %s (%s) VALUES\n", t.Name, strings.Join(columns, ", "))
+
+		for start := 0; start < len(t.Rows); start += sqlBatchSize {
+			end := start + sqlBatchSize
+			if end > len(t.Rows) {
+				end = len(t.Rows)
+			}
+			w.WriteString(insert)
+			for i, row := range t.Rows[start:end] {
+				values := make([]string, len(row))
+				for j, v := range row {
+					values[j] = sqlValue(v)
+				}
+				w.WriteString("(" + strings.Join(values, ", ") + ")")
+				if start+i < end-1 {
+					w.WriteString(",\n")
+				} else {
+					w.WriteString(";\n")
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func sqlValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "NULL"
+	case int64:
+		return fmt.Sprint(v)
+	default:
+		// MySQLとSQLiteのどちらでも読めるように ' の重ね書きだけでエスケープする
+		return "'" + strings.Replace(fmt.Sprint(v), "'", "''", -1) + "'"
+	}
+}
+
+func writeFiles(dir string, tables []*Table, ext string, write func(*bufio.Writer, *Table) error) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, t := range tables {
+		f, err := os.Create(filepath.Join(dir, t.Name+ext))
+		if err != nil {
+			return err
+		}
+		w := bufio.NewWriter(f)
+		if err := write(w, t); err != nil {
+			f.Close()
+			return fmt.Errorf("seed: %s%s: %v", t.Name, ext, err)
+		}
+		if err := w.Flush(); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
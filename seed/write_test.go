@@ -0,0 +1,133 @@
+package seed
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"torb/dialect"
+	"torb/fixture"
+	"torb/migrate"
+)
+
+func TestWriteAndLoad(t *testing.T) {
+	cfg := testConfig()
+	cfg.Users = 10
+	cfg.Events = 5
+	tables, err := Generate(cfg, fixture.Embedded())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ' のエスケープも確かめる
+	users := tableOf(t, tables, "users")
+	users.Rows[0][1] = "O'Brien"
+
+	for format, write := range map[string]func(string, []*Table) error{
+		"csv": WriteCSV,
+		"sql": WriteSQL,
+	} {
+		t.Run(format, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := write(dir, tables); err != nil {
+				t.Fatal(err)
+			}
+			for _, table := range tables {
+				if _, err := os.Stat(filepath.Join(dir, table.Name+"."+format)); err != nil {
+					t.Error(err)
+				}
+			}
+
+			db := newSQLite(t)
+			if err := fixture.Load(db, os.DirFS(dir)); err != nil {
+				t.Fatal(err)
+			}
+			for _, table := range tables {
+				if got, want := selectAll(t, db, table), stringRows(table); !reflect.DeepEqual(got, want) {
+					t.Errorf("%s: loaded %d rows differ from the generated %d rows", table.Name, len(got), len(want))
+				}
+			}
+		})
+	}
+}
+
+func newSQLite(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "torb.sqlite3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	m, err := migrate.New(db, dialect.SQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// selectAll reads the columns of the table as strings ordered by the first column, nil is NULL
+func selectAll(t *testing.T, db *sql.DB, table *Table) [][]interface{} {
+	t.Helper()
+	columns := make([]string, len(table.Columns))
+	for i, column := range table.Columns {
+		columns[i] = "CAST(`" + column + "` AS TEXT)"
+	}
+	rows, err := db.Query(fmt.Sprintf("SELECT %s FROM %s ORDER BY `%s`", strings.Join(columns, ", "), table.Name, table.Columns[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var got [][]interface{}
+	for rows.Next() {
+		values := make([]sql.NullString, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			t.Fatal(err)
+		}
+		row := make([]interface{}, len(columns))
+		for i, v := range values {
+			if v.Valid {
+				row[i] = v.String
+			}
+		}
+		got = append(got, row)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+// stringRows returns the rows of the table as strings ordered by the first column like selectAll
+func stringRows(table *Table) [][]interface{} {
+	rows := make([][]interface{}, len(table.Rows))
+	for i, row := range table.Rows {
+		rows[i] = make([]interface{}, len(row))
+		for j, v := range row {
+			if v != nil {
+				rows[i][j] = fmt.Sprint(v)
+			}
+		}
+	}
+	// 埋め込みのCSVのIDは文字列なので数値として並べる
+	sort.SliceStable(rows, func(i, j int) bool {
+		a, _ := strconv.ParseInt(rows[i][0].(string), 10, 64)
+		b, _ := strconv.ParseInt(rows[j][0].(string), 10, 64)
+		return a < b
+	})
+	return rows
+}
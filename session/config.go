@@ -0,0 +1,166 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Config is the settings of the cookie session
+type Config struct {
+	// CookieName is the name of the session cookie
+	CookieName string
+	// KeyPairs are (authentication key, encryption key) pairs, newest first.
+	// New cookies are signed with the first pair, and older pairs are still accepted for rotation.
+	KeyPairs [][]byte
+
+	Path     string
+	Domain   string
+	MaxAge   int
+	Secure   bool
+	HttpOnly bool
+	SameSite http.SameSite
+
+	// Store is the server-side session store, "memory", "mysql" or "redis"
+	Store string
+	// RedisAddr is the address of redis for the "redis" store
+	RedisAddr string
+}
+
+// DefaultConfig returns the config compatible with the original cookie settings
+func DefaultConfig() *Config {
+	return &Config{
+		CookieName: "session",
+		KeyPairs:   [][]byte{[]byte("secret"), nil},
+		Path:       "/",
+		MaxAge:     3600,
+		HttpOnly:   true,
+		SameSite:   http.SameSiteLaxMode,
+		Store:      "memory",
+		RedisAddr:  "localhost:6379",
+	}
+}
+
+// LoadConfig loads the config from SESSION_* variables looked up by getenv (such as os.Getenv) on top of DefaultConfig
+//
+//	SESSION_KEYS      "auth1:enc1,auth2:enc2" (newest first, enc is optional and must be 16, 24 or 32 bytes)
+//	SESSION_COOKIE    cookie name
+//	SESSION_PATH, SESSION_DOMAIN, SESSION_MAX_AGE, SESSION_SECURE, SESSION_HTTP_ONLY
+//	SESSION_SAME_SITE "lax", "strict", "none" or "default"
+//	SESSION_STORE     "memory", "mysql" or "redis"
+//	SESSION_REDIS_ADDR
+func LoadConfig(getenv func(key string) string) (*Config, error) {
+	cfg := DefaultConfig()
+
+	if v := getenv("SESSION_KEYS"); v != "" {
+		cfg.KeyPairs = parseKeyPairs(v)
+	} else {
+		log.Printf("SESSION_KEYS is not set, using the insecure default key")
+	}
+	if v := getenv("SESSION_COOKIE"); v != "" {
+		cfg.CookieName = v
+	}
+	if v := getenv("SESSION_PATH"); v != "" {
+		cfg.Path = v
+	}
+	cfg.Domain = getenv("SESSION_DOMAIN")
+	if v := getenv("SESSION_MAX_AGE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("SESSION_MAX_AGE: %v", err)
+		}
+		cfg.MaxAge = n
+	}
+	if v := getenv("SESSION_SECURE"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("SESSION_SECURE: %v", err)
+		}
+		cfg.Secure = b
+	}
+	if v := getenv("SESSION_HTTP_ONLY"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("SESSION_HTTP_ONLY: %v", err)
+		}
+		cfg.HttpOnly = b
+	}
+	if v := getenv("SESSION_SAME_SITE"); v != "" {
+		sameSite, err := parseSameSite(v)
+		if err != nil {
+			return nil, err
+		}
+		cfg.SameSite = sameSite
+	}
+
+	if v := getenv("SESSION_STORE"); v != "" {
+		cfg.Store = v
+	}
+	if v := getenv("SESSION_REDIS_ADDR"); v != "" {
+		cfg.RedisAddr = v
+	}
+
+	return cfg, cfg.Validate()
+}
+
+// Validate checks the keys and cookie options
+func (cfg *Config) Validate() error {
+	if cfg.CookieName == "" {
+		return errors.New("session: cookie name is empty")
+	}
+	if len(cfg.KeyPairs) == 0 || len(cfg.KeyPairs)%2 != 0 {
+		return errors.New("session: keys must be given in (authentication, encryption) pairs")
+	}
+	for i := 0; i < len(cfg.KeyPairs); i += 2 {
+		if len(cfg.KeyPairs[i]) == 0 {
+			return errors.New("session: authentication key is empty")
+		}
+		switch len(cfg.KeyPairs[i+1]) {
+		case 0, 16, 24, 32:
+		default:
+			return errors.New("session: encryption key must be 16, 24 or 32 bytes")
+		}
+	}
+	if cfg.MaxAge <= 0 {
+		return errors.New("session: max age must be positive")
+	}
+	switch cfg.Store {
+	case "memory", "mysql", "redis":
+	default:
+		return fmt.Errorf("session: unknown store %q", cfg.Store)
+	}
+	if cfg.SameSite == http.SameSiteNoneMode && !cfg.Secure {
+		return errors.New("session: SameSite=None requires Secure")
+	}
+	return nil
+}
+
+func parseKeyPairs(v string) [][]byte {
+	var pairs [][]byte
+	for _, pair := range strings.Split(v, ",") {
+		keys := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		var enc []byte
+		if len(keys) == 2 && keys[1] != "" {
+			enc = []byte(keys[1])
+		}
+		pairs = append(pairs, []byte(keys[0]), enc)
+	}
+	return pairs
+}
+
+func parseSameSite(v string) (http.SameSite, error) {
+	switch strings.ToLower(v) {
+	case "default":
+		return http.SameSiteDefaultMode, nil
+	case "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	}
+	return 0, fmt.Errorf("SESSION_SAME_SITE: unknown value %q", v)
+}
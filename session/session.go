@@ -1,69 +1,200 @@
 package session
 
 import (
+	"log"
+	"time"
+
 	"github.com/gorilla/sessions"
 	"github.com/labstack/echo"
 	"github.com/labstack/echo-contrib/session"
+
+	"torb/clientip"
 )
 
-func SessUserID(c echo.Context) int64 {
-	sess, _ := session.Get("session", c)
-	var userID int64
-	if x, ok := sess.Values["user_id"]; ok {
-		userID, _ = x.(int64)
+// echo.Context key to cache the record during the request
+const contextKey = "session_record"
+
+// Manager reads and writes the login state.
+// The cookie only has the session ID, the state is kept in the Store so that it can be revoked.
+type Manager struct {
+	cfg     *Config
+	cookies *sessions.CookieStore
+	store   Store
+	ips     *clientip.Resolver
+}
+
+// New returns the manager for the config, ips tells the client address recorded in the sessions
+func New(cfg *Config, store Store, ips *clientip.Resolver) (*Manager, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
 	}
-	return userID
+	cookies := sessions.NewCookieStore(cfg.KeyPairs...)
+	cookies.Options = cfg.options()
+	cookies.MaxAge(cfg.MaxAge)
+	return &Manager{cfg: cfg, cookies: cookies, store: store, ips: ips}, nil
 }
 
-func SessSetUserID(c echo.Context, id int64) {
-	sess, _ := session.Get("session", c)
-	sess.Options = &sessions.Options{
-		Path:     "/",
-		MaxAge:   3600,
-		HttpOnly: true,
+// Middleware makes the session available to the handlers
+func (m *Manager) Middleware() echo.MiddlewareFunc {
+	return session.Middleware(m.cookies)
+}
+
+func (cfg *Config) options() *sessions.Options {
+	return &sessions.Options{
+		Path:     cfg.Path,
+		Domain:   cfg.Domain,
+		MaxAge:   cfg.MaxAge,
+		Secure:   cfg.Secure,
+		HttpOnly: cfg.HttpOnly,
+		SameSite: cfg.SameSite,
 	}
-	sess.Values["user_id"] = id
-	sess.Save(c.Request(), c.Response())
 }
 
-func SessDeleteUserID(c echo.Context) {
-	sess, _ := session.Get("session", c)
-	sess.Options = &sessions.Options{
-		Path:     "/",
-		MaxAge:   3600,
-		HttpOnly: true,
+func (m *Manager) get(c echo.Context) *sessions.Session {
+	// 復号できない（ローテーションで外れた鍵など）場合も新しいセッションが返る
+	sess, _ := session.Get(m.cfg.CookieName, c)
+	return sess
+}
+
+// record returns the server-side state of the request, nil if not logged in or revoked
+func (m *Manager) record(c echo.Context) *Record {
+	if r, ok := c.Get(contextKey).(*Record); ok {
+		return r
 	}
-	delete(sess.Values, "user_id")
-	sess.Save(c.Request(), c.Response())
+
+	var record *Record
+	if id, ok := m.get(c).Values["sid"].(string); ok && id != "" {
+		r, err := m.store.Get(id)
+		if err == nil {
+			record = r
+		} else if err != ErrNotFound {
+			log.Printf("session store: %v", err)
+		}
+	}
+	c.Set(contextKey, record)
+	return record
 }
 
-func SessAdministratorID(c echo.Context) int64 {
-	sess, _ := session.Get("session", c)
-	var administratorID int64
-	if x, ok := sess.Values["administrator_id"]; ok {
-		administratorID, _ = x.(int64)
+// update modifies the record and writes it to the store and the cookie.
+// rotate issues a new session ID to prevent session fixation on login.
+func (m *Manager) update(c echo.Context, rotate bool, modify func(r *Record)) error {
+	now := time.Now()
+	record := m.record(c)
+	if record == nil || rotate {
+		id, err := newSessionID()
+		if err != nil {
+			return err
+		}
+		next := &Record{ID: id, CreatedAt: now}
+		if record != nil {
+			if err := m.store.Delete(record.ID); err != nil {
+				return err
+			}
+			next.UserID = record.UserID
+			next.AdministratorID = record.AdministratorID
+			next.PendingAdministratorID = record.PendingAdministratorID
+		}
+		record = next
+	}
+
+	modify(record)
+	// c.RealIP() は誰の X-Forwarded-For でも信じるので、信頼するプロキシ経由のものだけ使う
+	record.IP = m.ips.IP(c.Request())
+	record.UserAgent = c.Request().UserAgent()
+	record.ExpiresAt = now.Add(time.Duration(m.cfg.MaxAge) * time.Second)
+
+	sess := m.get(c)
+	sess.Options = m.cfg.options()
+	if record.UserID == 0 && record.AdministratorID == 0 && record.PendingAdministratorID == 0 {
+		if err := m.store.Delete(record.ID); err != nil {
+			return err
+		}
+		delete(sess.Values, "sid")
+		c.Set(contextKey, (*Record)(nil))
+	} else {
+		if err := m.store.Save(record); err != nil {
+			return err
+		}
+		sess.Values["sid"] = record.ID
+		c.Set(contextKey, record)
 	}
-	return administratorID
+	return sess.Save(c.Request(), c.Response())
 }
 
-func SessSetAdministratorID(c echo.Context, id int64) {
-	sess, _ := session.Get("session", c)
-	sess.Options = &sessions.Options{
-		Path:     "/",
-		MaxAge:   3600,
-		HttpOnly: true,
+func (m *Manager) UserID(c echo.Context) int64 {
+	if r := m.record(c); r != nil {
+		return r.UserID
 	}
-	sess.Values["administrator_id"] = id
-	sess.Save(c.Request(), c.Response())
+	return 0
+}
+
+func (m *Manager) SetUserID(c echo.Context, id int64) error {
+	return m.update(c, true, func(r *Record) { r.UserID = id })
+}
+
+func (m *Manager) DeleteUserID(c echo.Context) error {
+	return m.update(c, false, func(r *Record) { r.UserID = 0 })
 }
 
-func SessDeleteAdministratorID(c echo.Context) {
-	sess, _ := session.Get("session", c)
-	sess.Options = &sessions.Options{
-		Path:     "/",
-		MaxAge:   3600,
-		HttpOnly: true,
+func (m *Manager) AdministratorID(c echo.Context) int64 {
+	if r := m.record(c); r != nil {
+		return r.AdministratorID
+	}
+	return 0
+}
+
+// SetAdministratorID marks the session as the administrator, the pending TOTP check is cleared
+func (m *Manager) SetAdministratorID(c echo.Context, id int64) error {
+	return m.update(c, true, func(r *Record) {
+		r.AdministratorID = id
+		r.PendingAdministratorID = 0
+	})
+}
+
+func (m *Manager) DeleteAdministratorID(c echo.Context) error {
+	return m.update(c, false, func(r *Record) {
+		r.AdministratorID = 0
+		r.PendingAdministratorID = 0
+	})
+}
+
+// PendingAdministratorID returns the administrator waiting for the TOTP check, 0 if none
+func (m *Manager) PendingAdministratorID(c echo.Context) int64 {
+	if r := m.record(c); r != nil {
+		return r.PendingAdministratorID
+	}
+	return 0
+}
+
+// SetPendingAdministratorID records that the administrator passed the password check.
+// The session is not an administrator until SetAdministratorID after the TOTP check.
+func (m *Manager) SetPendingAdministratorID(c echo.Context, id int64) error {
+	return m.update(c, true, func(r *Record) {
+		r.AdministratorID = 0
+		r.PendingAdministratorID = id
+	})
+}
+
+// UserSessions returns the active sessions of the user
+func (m *Manager) UserSessions(userID int64) ([]*Record, error) {
+	return m.store.ListByUser(userID)
+}
+
+// RevokeUserSessions force-logouts the user from every session
+func (m *Manager) RevokeUserSessions(userID int64) error {
+	return m.store.DeleteByUser(userID)
+}
+
+// RevokeUserSession force-logouts the session of the user identified by Record.PublicID
+func (m *Manager) RevokeUserSession(userID int64, publicID string) error {
+	records, err := m.store.ListByUser(userID)
+	if err != nil {
+		return err
+	}
+	for _, r := range records {
+		if r.PublicID() == publicID {
+			return m.store.Delete(r.ID)
+		}
 	}
-	delete(sess.Values, "administrator_id")
-	sess.Save(c.Request(), c.Response())
+	return ErrNotFound
 }
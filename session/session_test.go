@@ -0,0 +1,49 @@
+package session
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo"
+
+	"torb/clientip"
+)
+
+func TestRecordedIP(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	store := NewMemoryStore()
+	m, err := New(DefaultConfig(), store, clientip.New([]*net.IPNet{proxies}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := echo.New()
+	e.Use(m.Middleware())
+	e.POST("/login", func(c echo.Context) error {
+		return m.SetUserID(c, 1)
+	})
+
+	for _, tt := range []struct {
+		remoteAddr string
+		xff        string
+		want       string
+	}{
+		// 信頼していない接続元の X-Forwarded-For は偽装できるので使わない
+		{"192.0.2.1:1234", "198.51.100.1", "192.0.2.1"},
+		{"10.0.0.1:1234", "198.51.100.1", "198.51.100.1"},
+	} {
+		store.DeleteByUser(1)
+		req := httptest.NewRequest("POST", "/login", nil)
+		req.RemoteAddr = tt.remoteAddr
+		req.Header.Set("X-Forwarded-For", tt.xff)
+		e.ServeHTTP(httptest.NewRecorder(), req)
+
+		records, err := store.ListByUser(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != 1 || records[0].IP != tt.want {
+			t.Errorf("from %s with X-Forwarded-For %s: records %+v, want IP %s", tt.remoteAddr, tt.xff, records, tt.want)
+		}
+	}
+}
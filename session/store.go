@@ -0,0 +1,156 @@
+package session
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned when the session does not exist, is expired or revoked
+var ErrNotFound = errors.New("session not found")
+
+// Record is the server-side state of a session, the cookie only has its ID
+type Record struct {
+	ID              string `json:"-"`
+	UserID          int64  `json:"user_id,omitempty"`
+	AdministratorID int64  `json:"administrator_id,omitempty"`
+	// PendingAdministratorID is the administrator who passed the password check but not the TOTP check yet
+	PendingAdministratorID int64     `json:"pending_administrator_id,omitempty"`
+	IP                     string    `json:"ip"`
+	UserAgent              string    `json:"user_agent"`
+	CreatedAt              time.Time `json:"created_at"`
+	ExpiresAt              time.Time `json:"expires_at"`
+}
+
+// PublicID identifies the session in admin APIs without exposing the cookie value
+func (r *Record) PublicID() string {
+	sum := sha256.Sum256([]byte(r.ID))
+	return hex.EncodeToString(sum[:16])
+}
+
+func (r *Record) expired(now time.Time) bool {
+	return !r.ExpiresAt.After(now)
+}
+
+// Store keeps the session records
+type Store interface {
+	// Get returns ErrNotFound if the session does not exist or is expired
+	Get(id string) (*Record, error)
+	Save(r *Record) error
+	Delete(id string) error
+	// ListByUser returns the active sessions of the user
+	ListByUser(userID int64) ([]*Record, error)
+	// DeleteByUser revokes all the sessions of the user
+	DeleteByUser(userID int64) error
+}
+
+func newSessionID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// how often Save of MemoryStore drops the expired records
+const memorySweepInterval = time.Minute
+
+// MemoryStore keeps the sessions in the process, they are lost on restart.
+// The expired records are dropped by Save every memorySweepInterval.
+type MemoryStore struct {
+	mu        sync.RWMutex
+	sessions  map[string]*Record
+	lastSweep time.Time
+}
+
+// NewMemoryStore returns the instance
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{sessions: map[string]*Record{}}
+}
+
+// Get the record
+func (s *MemoryStore) Get(id string) (*Record, error) {
+	s.mu.RLock()
+	r, ok := s.sessions[id]
+	s.mu.RUnlock()
+	if !ok || r.expired(time.Now()) {
+		return nil, ErrNotFound
+	}
+	copied := *r
+	return &copied, nil
+}
+
+// Save the record
+func (s *MemoryStore) Save(r *Record) error {
+	copied := *r
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// ログインのたびに作られるので、期限切れのものを消さないと増え続ける
+	if now.Sub(s.lastSweep) >= memorySweepInterval {
+		s.deleteExpired(now)
+		s.lastSweep = now
+	}
+	s.sessions[r.ID] = &copied
+	return nil
+}
+
+// DeleteExpired removes the expired records
+func (s *MemoryStore) DeleteExpired() error {
+	s.mu.Lock()
+	s.deleteExpired(time.Now())
+	s.mu.Unlock()
+	return nil
+}
+
+// deleteExpired must be called with the lock
+func (s *MemoryStore) deleteExpired(now time.Time) {
+	for id, r := range s.sessions {
+		if r.expired(now) {
+			delete(s.sessions, id)
+		}
+	}
+}
+
+// Delete the record
+func (s *MemoryStore) Delete(id string) error {
+	s.mu.Lock()
+	delete(s.sessions, id)
+	s.mu.Unlock()
+	return nil
+}
+
+// ListByUser returns the active records of the user, expired ones are dropped
+func (s *MemoryStore) ListByUser(userID int64) ([]*Record, error) {
+	now := time.Now()
+	records := []*Record{}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, r := range s.sessions {
+		if r.expired(now) {
+			delete(s.sessions, id)
+			continue
+		}
+		if r.UserID == userID {
+			copied := *r
+			records = append(records, &copied)
+		}
+	}
+	return records, nil
+}
+
+// DeleteByUser deletes all the records of the user
+func (s *MemoryStore) DeleteByUser(userID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, r := range s.sessions {
+		if r.UserID == userID {
+			delete(s.sessions, id)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package session
+
+import (
+	"database/sql"
+	"time"
+)
+
+const mysqlSchema = "CREATE TABLE IF NOT EXISTS sessions (" +
+	"id VARCHAR(64) NOT NULL PRIMARY KEY," +
+	"user_id BIGINT NOT NULL DEFAULT 0," +
+	"administrator_id BIGINT NOT NULL DEFAULT 0," +
+	"pending_administrator_id BIGINT NOT NULL DEFAULT 0," +
+	"ip VARCHAR(64) NOT NULL DEFAULT ''," +
+	"user_agent VARCHAR(255) NOT NULL DEFAULT ''," +
+	"created_at DATETIME(6) NOT NULL," +
+	"expires_at DATETIME(6) NOT NULL," +
+	"KEY user_id (user_id)," +
+	"KEY expires_at (expires_at)" +
+	") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4"
+
+// MySQLStore keeps the sessions in the sessions table
+type MySQLStore struct {
+	db *sql.DB
+}
+
+// NewMySQLStore returns the instance, creating the sessions table if not exists
+func NewMySQLStore(db *sql.DB) (*MySQLStore, error) {
+	if _, err := db.Exec(mysqlSchema); err != nil {
+		return nil, err
+	}
+	s := &MySQLStore{db: db}
+	if err := s.DeleteExpired(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Get the record
+func (s *MySQLStore) Get(id string) (*Record, error) {
+	r := Record{ID: id}
+	err := s.db.QueryRow("SELECT user_id, administrator_id, pending_administrator_id, ip, user_agent, created_at, expires_at FROM sessions WHERE id = ? AND expires_at > ?", id, time.Now().UTC()).
+		Scan(&r.UserID, &r.AdministratorID, &r.PendingAdministratorID, &r.IP, &r.UserAgent, &r.CreatedAt, &r.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// Save the record
+func (s *MySQLStore) Save(r *Record) error {
+	_, err := s.db.Exec("INSERT INTO sessions (id, user_id, administrator_id, pending_administrator_id, ip, user_agent, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?) "+
+		"ON DUPLICATE KEY UPDATE user_id = VALUES(user_id), administrator_id = VALUES(administrator_id), pending_administrator_id = VALUES(pending_administrator_id), ip = VALUES(ip), user_agent = VALUES(user_agent), expires_at = VALUES(expires_at)",
+		r.ID, r.UserID, r.AdministratorID, r.PendingAdministratorID, r.IP, r.UserAgent, r.CreatedAt.UTC(), r.ExpiresAt.UTC())
+	return err
+}
+
+// Delete the record
+func (s *MySQLStore) Delete(id string) error {
+	_, err := s.db.Exec("DELETE FROM sessions WHERE id = ?", id)
+	return err
+}
+
+// ListByUser returns the active records of the user
+func (s *MySQLStore) ListByUser(userID int64) ([]*Record, error) {
+	rows, err := s.db.Query("SELECT id, user_id, administrator_id, pending_administrator_id, ip, user_agent, created_at, expires_at FROM sessions WHERE user_id = ? AND expires_at > ? ORDER BY created_at DESC", userID, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []*Record{}
+	for rows.Next() {
+		var r Record
+		if err := rows.Scan(&r.ID, &r.UserID, &r.AdministratorID, &r.PendingAdministratorID, &r.IP, &r.UserAgent, &r.CreatedAt, &r.ExpiresAt); err != nil {
+			return nil, err
+		}
+		records = append(records, &r)
+	}
+	return records, rows.Err()
+}
+
+// DeleteByUser deletes all the records of the user
+func (s *MySQLStore) DeleteByUser(userID int64) error {
+	_, err := s.db.Exec("DELETE FROM sessions WHERE user_id = ?", userID)
+	return err
+}
+
+// DeleteExpired removes the expired records
+func (s *MySQLStore) DeleteExpired() error {
+	_, err := s.db.Exec("DELETE FROM sessions WHERE expires_at <= ?", time.Now().UTC())
+	return err
+}
@@ -0,0 +1,124 @@
+package session
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/json-iterator/go"
+)
+
+var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+// RedisStore keeps the sessions as "session:<id>" with TTL,
+// and the IDs of each user in the set "user_sessions:<userID>"
+type RedisStore struct {
+	cli *redis.Client
+}
+
+// NewRedisStore returns the instance
+func NewRedisStore(cli *redis.Client) *RedisStore {
+	return &RedisStore{cli: cli}
+}
+
+func sessionKey(id string) string {
+	return "session:" + id
+}
+
+func userSessionsKey(userID int64) string {
+	return "user_sessions:" + strconv.FormatInt(userID, 10)
+}
+
+// Get the record
+func (s *RedisStore) Get(id string) (*Record, error) {
+	b, err := s.cli.Get(sessionKey(id)).Bytes()
+	if err == redis.Nil {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var r Record
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, err
+	}
+	r.ID = id
+	return &r, nil
+}
+
+// Save the record
+func (s *RedisStore) Save(r *Record) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	ttl := time.Until(r.ExpiresAt)
+	if ttl <= 0 {
+		return s.Delete(r.ID)
+	}
+
+	_, err = s.cli.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Set(sessionKey(r.ID), b, ttl)
+		if r.UserID != 0 {
+			pipe.SAdd(userSessionsKey(r.UserID), r.ID)
+		}
+		return nil
+	})
+	return err
+}
+
+// Delete the record
+func (s *RedisStore) Delete(id string) error {
+	r, err := s.Get(id)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = s.cli.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Del(sessionKey(id))
+		if r.UserID != 0 {
+			pipe.SRem(userSessionsKey(r.UserID), id)
+		}
+		return nil
+	})
+	return err
+}
+
+// ListByUser returns the active records of the user, expired IDs are removed from the set
+func (s *RedisStore) ListByUser(userID int64) ([]*Record, error) {
+	ids, err := s.cli.SMembers(userSessionsKey(userID)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	records := []*Record{}
+	for _, id := range ids {
+		r, err := s.Get(id)
+		if err == ErrNotFound || (err == nil && r.UserID != userID) {
+			s.cli.SRem(userSessionsKey(userID), id)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, nil
+}
+
+// DeleteByUser deletes all the records of the user
+func (s *RedisStore) DeleteByUser(userID int64) error {
+	ids, err := s.cli.SMembers(userSessionsKey(userID)).Result()
+	if err != nil {
+		return err
+	}
+
+	keys := []string{userSessionsKey(userID)}
+	for _, id := range ids {
+		keys = append(keys, sessionKey(id))
+	}
+	return s.cli.Del(keys...).Err()
+}
@@ -0,0 +1,70 @@
+package session
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreSweep(t *testing.T) {
+	s := NewMemoryStore()
+	now := time.Now()
+	if err := s.Save(&Record{ID: "expired", UserID: 1, ExpiresAt: now.Add(-time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(&Record{ID: "active", UserID: 1, ExpiresAt: now.Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get("expired"); err != ErrNotFound {
+		t.Errorf("Get expired: %v, want ErrNotFound", err)
+	}
+	// 前回の掃除から memorySweepInterval 経っていなければ消さない
+	if len(s.sessions) != 2 {
+		t.Errorf("%d records before the sweep interval, want 2", len(s.sessions))
+	}
+
+	s.lastSweep = now.Add(-memorySweepInterval)
+	if err := s.Save(&Record{ID: "new", UserID: 2, ExpiresAt: now.Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.sessions["expired"]; ok || len(s.sessions) != 2 {
+		t.Errorf("records after the sweep = %v, want active and new", s.sessions)
+	}
+
+	s.sessions["active"].ExpiresAt = now.Add(-time.Second)
+	if err := s.DeleteExpired(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.sessions["active"]; ok || len(s.sessions) != 1 {
+		t.Errorf("records after DeleteExpired = %v, want new", s.sessions)
+	}
+}
+
+func TestMemoryStoreListByUser(t *testing.T) {
+	s := NewMemoryStore()
+	now := time.Now()
+	for _, r := range []*Record{
+		{ID: "a", UserID: 1, ExpiresAt: now.Add(time.Hour)},
+		{ID: "b", UserID: 1, ExpiresAt: now.Add(-time.Second)},
+		{ID: "c", UserID: 2, ExpiresAt: now.Add(time.Hour)},
+	} {
+		if err := s.Save(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	records, err := s.ListByUser(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].ID != "a" {
+		t.Errorf("ListByUser = %v, want a", records)
+	}
+	if err := s.DeleteByUser(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get("a"); err != ErrNotFound {
+		t.Errorf("Get after DeleteByUser: %v, want ErrNotFound", err)
+	}
+	if _, err := s.Get("c"); err != nil {
+		t.Errorf("Get of another user: %v", err)
+	}
+}
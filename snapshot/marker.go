@@ -0,0 +1,47 @@
+package snapshot
+
+import (
+	"database/sql"
+	"time"
+
+	"torb/dialect"
+)
+
+const markerSchema = "CREATE TABLE IF NOT EXISTS data_changes (" +
+	"id INT NOT NULL PRIMARY KEY," +
+	"changed_at DATETIME(6) NOT NULL" +
+	") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4"
+
+// Marker records when the data was changed outside the running server (/initialize, seed, migrate),
+// a snapshot older than that does not match the DB
+type Marker struct {
+	db *sql.DB
+	d  dialect.Dialect
+}
+
+// NewMarker returns the instance, creating the table if not exists
+func NewMarker(db *sql.DB, d dialect.Dialect) (*Marker, error) {
+	for _, stmt := range d.Schema(markerSchema) {
+		if _, err := db.Exec(stmt); err != nil {
+			return nil, err
+		}
+	}
+	return &Marker{db: db, d: d}, nil
+}
+
+// Touch records that the data is changed now
+func (m *Marker) Touch() error {
+	_, err := m.db.Exec("INSERT INTO data_changes (id, changed_at) VALUES (1, ?) "+
+		m.d.OnDuplicateKeyUpdate("id", "changed_at = VALUES(changed_at)"), time.Now().UTC())
+	return err
+}
+
+// ChangedAt returns the last time recorded by Touch, zero if never
+func (m *Marker) ChangedAt() (time.Time, error) {
+	var changedAt time.Time
+	err := m.db.QueryRow("SELECT changed_at FROM data_changes WHERE id = 1").Scan(&changedAt)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	return changedAt, err
+}
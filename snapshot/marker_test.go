@@ -0,0 +1,45 @@
+package snapshot
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"torb/dialect"
+)
+
+func TestMarker(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "torb.sqlite3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	m, err := NewMarker(db, dialect.SQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if changedAt, err := m.ChangedAt(); err != nil || !changedAt.IsZero() {
+		t.Errorf("ChangedAt before Touch = %v, %v, want zero", changedAt, err)
+	}
+
+	// 2回目の Touch は上書きする
+	var last time.Time
+	for i := 0; i < 2; i++ {
+		before := time.Now()
+		if err := m.Touch(); err != nil {
+			t.Fatal(err)
+		}
+		changedAt, err := m.ChangedAt()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if changedAt.Before(before.Truncate(time.Microsecond)) || changedAt.After(time.Now()) || !changedAt.After(last) {
+			t.Errorf("Touch %d: ChangedAt = %v, want after %v and %v", i+1, changedAt, before, last)
+		}
+		last = changedAt
+	}
+}
@@ -0,0 +1,212 @@
+package snapshot
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	. "torb/structs"
+)
+
+// Version of the file format, bumped when the layout changes
+const Version = 1
+
+var magic = [8]byte{'T', 'O', 'R', 'B', 'S', 'N', 'A', 'P'}
+
+// ErrInvalid is returned when the file is not a snapshot, has another version or is broken
+var ErrInvalid = errors.New("snapshot: invalid file")
+
+// Snapshot is the state of the reservation caches
+type Snapshot struct {
+	CreatedAt time.Time
+	// ReservationUUID is the last issued reservation ID
+	ReservationUUID int64
+	// Reservations are the non-canceled reservations
+	Reservations []*Reservation
+	// Canceled are the canceled reservations
+	Canceled []*Reservation
+	// FreeSheets are the sheet IDs not reserved by event ID
+	FreeSheets map[int64][]int64
+}
+
+// WriteFile writes the snapshot to path, replacing the file atomically
+func (s *Snapshot) WriteFile(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := s.write(f); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// write encodes the snapshot in little endian:
+//
+//	magic "TORBSNAP", version uint32, created_at int64 (unix nano)
+//	reservation_uuid int64
+//	reservations: count uint32, then id, event_id, sheet_id, user_id, reserved_at, canceled_at (int64 each, 0 is NULL)
+//	canceled:     the same as reservations
+//	free sheets:  event count uint32, then event_id int64, count uint32, sheet_id int64...
+//	checksum uint32, CRC-32 (IEEE) of all the bytes above
+func (s *Snapshot) write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	h := crc32.NewIEEE()
+	out := io.MultiWriter(bw, h)
+
+	put := func(v interface{}) error { return binary.Write(out, binary.LittleEndian, v) }
+	if err := put(magic); err != nil {
+		return err
+	}
+	if err := put(uint32(Version)); err != nil {
+		return err
+	}
+	if err := put(s.CreatedAt.UnixNano()); err != nil {
+		return err
+	}
+	if err := put(s.ReservationUUID); err != nil {
+		return err
+	}
+	for _, reservations := range [][]*Reservation{s.Reservations, s.Canceled} {
+		if err := put(uint32(len(reservations))); err != nil {
+			return err
+		}
+		for _, r := range reservations {
+			record := [6]int64{r.ID, r.EventID, r.SheetID, r.UserID, unixNano(r.ReservedAt), unixNano(r.CanceledAt)}
+			if err := put(record); err != nil {
+				return err
+			}
+		}
+	}
+
+	eventIDs := make([]int64, 0, len(s.FreeSheets))
+	for eventID := range s.FreeSheets {
+		eventIDs = append(eventIDs, eventID)
+	}
+	sort.Slice(eventIDs, func(i, j int) bool { return eventIDs[i] < eventIDs[j] })
+	if err := put(uint32(len(eventIDs))); err != nil {
+		return err
+	}
+	for _, eventID := range eventIDs {
+		sheetIDs := s.FreeSheets[eventID]
+		if err := put(eventID); err != nil {
+			return err
+		}
+		if err := put(uint32(len(sheetIDs))); err != nil {
+			return err
+		}
+		if err := put(sheetIDs); err != nil {
+			return err
+		}
+	}
+
+	if err := binary.Write(bw, binary.LittleEndian, h.Sum32()); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func unixNano(t *time.Time) int64 {
+	if t == nil {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// ReadFile reads the snapshot written by WriteFile, verifying the version and the checksum
+func ReadFile(path string) (*Snapshot, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < len(magic)+4 || !bytes.Equal(b[:len(magic)], magic[:]) {
+		return nil, fmt.Errorf("%w: not a snapshot", ErrInvalid)
+	}
+	if version := binary.LittleEndian.Uint32(b[len(magic):]); version != Version {
+		return nil, fmt.Errorf("%w: version %d, want %d", ErrInvalid, version, Version)
+	}
+	body, sum := b[:len(b)-4], binary.LittleEndian.Uint32(b[len(b)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrInvalid)
+	}
+	s, err := read(bytes.NewReader(body[len(magic)+4:]))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	return s, nil
+}
+
+func read(r io.Reader) (*Snapshot, error) {
+	get := func(v interface{}) error { return binary.Read(r, binary.LittleEndian, v) }
+	s := &Snapshot{FreeSheets: map[int64][]int64{}}
+
+	var createdAt int64
+	if err := get(&createdAt); err != nil {
+		return nil, err
+	}
+	s.CreatedAt = time.Unix(0, createdAt).UTC()
+	if err := get(&s.ReservationUUID); err != nil {
+		return nil, err
+	}
+	for _, reservations := range []*[]*Reservation{&s.Reservations, &s.Canceled} {
+		var n uint32
+		if err := get(&n); err != nil {
+			return nil, err
+		}
+		*reservations = make([]*Reservation, 0, n)
+		for i := uint32(0); i < n; i++ {
+			var record [6]int64
+			if err := get(&record); err != nil {
+				return nil, err
+			}
+			r := &Reservation{ID: record[0], EventID: record[1], SheetID: record[2], UserID: record[3]}
+			if record[4] != 0 {
+				r.SetReservedAt(time.Unix(0, record[4]).UTC())
+			}
+			if record[5] != 0 {
+				r.SetCanceledAt(time.Unix(0, record[5]).UTC())
+			}
+			*reservations = append(*reservations, r)
+		}
+	}
+
+	var events uint32
+	if err := get(&events); err != nil {
+		return nil, err
+	}
+	for i := uint32(0); i < events; i++ {
+		var eventID int64
+		var n uint32
+		if err := get(&eventID); err != nil {
+			return nil, err
+		}
+		if err := get(&n); err != nil {
+			return nil, err
+		}
+		sheetIDs := make([]int64, n)
+		if err := get(sheetIDs); err != nil {
+			return nil, err
+		}
+		s.FreeSheets[eventID] = sheetIDs
+	}
+	return s, nil
+}
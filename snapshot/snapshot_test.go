@@ -0,0 +1,98 @@
+package snapshot
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	. "torb/structs"
+)
+
+func testSnapshot() *Snapshot {
+	reservedAt := time.Date(2024, 1, 1, 0, 0, 0, 123456000, time.UTC)
+	reserved := &Reservation{ID: 1, EventID: 1, SheetID: 3, UserID: 10}
+	reserved.SetReservedAt(reservedAt)
+	canceled := &Reservation{ID: 2, EventID: 2, SheetID: 5, UserID: 11}
+	canceled.SetReservedAt(reservedAt)
+	canceled.SetCanceledAt(reservedAt.Add(time.Minute))
+	return &Snapshot{
+		CreatedAt:       time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC),
+		ReservationUUID: 10000002,
+		Reservations:    []*Reservation{reserved},
+		Canceled:        []*Reservation{canceled},
+		FreeSheets:      map[int64][]int64{1: {1, 2, 4}, 2: {}},
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot", "torb.snapshot")
+	want := testSnapshot()
+	if err := want.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	// 一時ファイルは残さない
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("the temporary file is left: %v", err)
+	}
+
+	got, err := ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadFile = %+v, want %+v", got, want)
+	}
+
+	// 空のスナップショット
+	empty := &Snapshot{CreatedAt: want.CreatedAt, FreeSheets: map[int64][]int64{}}
+	if err := empty.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	got, err = ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.CreatedAt != empty.CreatedAt || len(got.Reservations) != 0 || len(got.Canceled) != 0 || len(got.FreeSheets) != 0 {
+		t.Errorf("ReadFile of the empty snapshot = %+v", got)
+	}
+
+	if _, err := ReadFile(filepath.Join(t.TempDir(), "missing")); !os.IsNotExist(err) {
+		t.Errorf("ReadFile of the missing file: %v, want not exist", err)
+	}
+}
+
+func TestReadInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "torb.snapshot")
+	if err := testSnapshot().WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, modify := range map[string]func(b []byte) []byte{
+		// 予約の途中の1ビットを反転させると CRC-32 が合わない
+		"corrupted":    func(b []byte) []byte { b[len(b)/2] ^= 1; return b },
+		"checksum":     func(b []byte) []byte { b[len(b)-1] ^= 1; return b },
+		"truncated":    func(b []byte) []byte { return b[:len(b)-10] },
+		"empty":        func(b []byte) []byte { return nil },
+		"magic":        func(b []byte) []byte { b[0] = 'X'; return b },
+		"version":      func(b []byte) []byte { binary.LittleEndian.PutUint32(b[len(magic):], Version+1); return b },
+		"appended":     func(b []byte) []byte { return append(b, 0) },
+		"short header": func(b []byte) []byte { return b[:len(magic)+2] },
+	} {
+		corrupted := modify(append([]byte(nil), b...))
+		if err := ioutil.WriteFile(path, corrupted, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if s, err := ReadFile(path); !errors.Is(err, ErrInvalid) {
+			t.Errorf("%s: ReadFile = %+v, %v, want ErrInvalid", name, s, err)
+		}
+	}
+}
@@ -7,6 +7,8 @@ type User struct {
 	Nickname  string `json:"nickname,omitempty"`
 	LoginName string `json:"login_name,omitempty"`
 	PassHash  string `json:"pass_hash,omitempty"`
+	// Deactivated is set by the repository from user_deactivations, it is not returned by the API
+	Deactivated bool `json:"-"`
 }
 
 type Event struct {
@@ -56,9 +58,46 @@ type Reservation struct {
 	CanceledAtUnix int64  `json:"canceled_at,omitempty"`
 }
 
+// ReportTimeFormat is the layout of sold_at/canceled_at in the sales reports (microsecond precision)
+const ReportTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+// ReportLocation is the time zone used to render sold_at/canceled_at
+var ReportLocation = time.UTC
+
+// SetReservedAt sets ReservedAt and ReservedAtUnix, truncated to the precision of MySQL DATETIME(6)
+func (r *Reservation) SetReservedAt(t time.Time) {
+	t = t.Truncate(time.Microsecond)
+	r.ReservedAt = &t
+	r.ReservedAtUnix = t.Unix()
+}
+
+// SetCanceledAt sets CanceledAt and CanceledAtUnix, truncated to the precision of MySQL DATETIME(6)
+func (r *Reservation) SetCanceledAt(t time.Time) {
+	t = t.Truncate(time.Microsecond)
+	r.CanceledAt = &t
+	r.CanceledAtUnix = t.Unix()
+}
+
+// SoldAt returns reserved_at formatted for the sales reports
+func (r *Reservation) SoldAt() string {
+	if r.ReservedAt == nil {
+		return ""
+	}
+	return r.ReservedAt.In(ReportLocation).Format(ReportTimeFormat)
+}
+
+// CanceledAtString returns canceled_at formatted for the sales reports, or "" if not canceled
+func (r *Reservation) CanceledAtString() string {
+	if r.CanceledAt == nil {
+		return ""
+	}
+	return r.CanceledAt.In(ReportLocation).Format(ReportTimeFormat)
+}
+
 type Administrator struct {
-	ID        int64  `json:"id,omitempty"`
-	Nickname  string `json:"nickname,omitempty"`
-	LoginName string `json:"login_name,omitempty"`
-	PassHash  string `json:"pass_hash,omitempty"`
+	ID        int64    `json:"id,omitempty"`
+	Nickname  string   `json:"nickname,omitempty"`
+	LoginName string   `json:"login_name,omitempty"`
+	PassHash  string   `json:"pass_hash,omitempty"`
+	Roles     []string `json:"roles,omitempty"`
 }
@@ -0,0 +1,195 @@
+package totp
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"torb/dialect"
+)
+
+var schemas = []string{
+	"CREATE TABLE IF NOT EXISTS administrator_totp (" +
+		"administrator_id BIGINT NOT NULL PRIMARY KEY," +
+		"secret VARCHAR(64) NOT NULL," +
+		"last_step BIGINT NOT NULL DEFAULT 0," +
+		"created_at DATETIME(6) NOT NULL," +
+		"enabled_at DATETIME(6) NULL" +
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4",
+	"CREATE TABLE IF NOT EXISTS administrator_recovery_codes (" +
+		"administrator_id BIGINT NOT NULL," +
+		"code_hash CHAR(64) NOT NULL," +
+		"used_at DATETIME(6) NULL," +
+		"PRIMARY KEY (administrator_id, code_hash)" +
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4",
+}
+
+const recoveryCodeCount = 10
+
+// ErrNotEnrolled is returned when the administrator has not started the enrollment
+var ErrNotEnrolled = errors.New("totp is not enrolled")
+
+// ErrAlreadyEnabled is returned by Enroll when TOTP is already enabled
+var ErrAlreadyEnabled = errors.New("totp is already enabled")
+
+// Store keeps the TOTP secrets and recovery codes of the administrators
+type Store struct {
+	db  *sql.DB
+	d   dialect.Dialect
+	now func() time.Time
+}
+
+// NewStore returns the instance, creating the tables if not exist
+func NewStore(db *sql.DB, d dialect.Dialect) (*Store, error) {
+	for _, schema := range schemas {
+		for _, stmt := range d.Schema(schema) {
+			if _, err := db.Exec(stmt); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &Store{db: db, d: d, now: time.Now}, nil
+}
+
+// Enabled returns whether the administrator has to pass the TOTP check on login
+func (s *Store) Enabled(administratorID int64) (bool, error) {
+	var enabledAt *time.Time
+	err := s.db.QueryRow("SELECT enabled_at FROM administrator_totp WHERE administrator_id = ?", administratorID).Scan(&enabledAt)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return enabledAt != nil, nil
+}
+
+// Enroll generates a new secret, it is not used on login until Enable.
+// ErrAlreadyEnabled is returned when enabled, Disable it first to re-enroll.
+func (s *Store) Enroll(administratorID int64) (string, error) {
+	enabled, err := s.Enabled(administratorID)
+	if err != nil {
+		return "", err
+	}
+	if enabled {
+		return "", ErrAlreadyEnabled
+	}
+
+	secret, err := GenerateSecret()
+	if err != nil {
+		return "", err
+	}
+	_, err = s.db.Exec("INSERT INTO administrator_totp (administrator_id, secret, created_at) VALUES (?, ?, ?) "+
+		s.d.OnDuplicateKeyUpdate("administrator_id", "secret = VALUES(secret), last_step = 0, created_at = VALUES(created_at), enabled_at = NULL"),
+		administratorID, secret, s.now().UTC())
+	return secret, err
+}
+
+// Enable verifies the code of the enrolled secret, turns on TOTP and returns new recovery codes
+func (s *Store) Enable(administratorID int64, passcode string) ([]string, bool, error) {
+	ok, err := s.verifyTOTP(administratorID, passcode)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	if _, err := s.db.Exec("UPDATE administrator_totp SET enabled_at = ? WHERE administrator_id = ?", s.now().UTC(), administratorID); err != nil {
+		return nil, false, err
+	}
+	codes, err := s.RegenerateRecoveryCodes(administratorID)
+	if err != nil {
+		return nil, false, err
+	}
+	return codes, true, nil
+}
+
+// Disable turns off TOTP and removes the recovery codes
+func (s *Store) Disable(administratorID int64) error {
+	if _, err := s.db.Exec("DELETE FROM administrator_totp WHERE administrator_id = ?", administratorID); err != nil {
+		return err
+	}
+	_, err := s.db.Exec("DELETE FROM administrator_recovery_codes WHERE administrator_id = ?", administratorID)
+	return err
+}
+
+// Verify checks a TOTP code or an unused recovery code of the enabled administrator
+func (s *Store) Verify(administratorID int64, passcode string) (bool, error) {
+	enabled, err := s.Enabled(administratorID)
+	if err != nil || !enabled {
+		return false, err
+	}
+	if ok, err := s.verifyTOTP(administratorID, passcode); err != nil || ok {
+		return ok, err
+	}
+	return s.useRecoveryCode(administratorID, passcode)
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes, only the hashes are stored
+func (s *Store) RegenerateRecoveryCodes(administratorID int64) ([]string, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("DELETE FROM administrator_recovery_codes WHERE administrator_id = ?", administratorID); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		h := hex.EncodeToString(b)
+		code := h[:5] + "-" + h[5:]
+		if _, err := tx.Exec("INSERT INTO administrator_recovery_codes (administrator_id, code_hash) VALUES (?, ?)", administratorID, hashRecoveryCode(code)); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, tx.Commit()
+}
+
+// verifyTOTP accepts each time step only once to prevent replay
+func (s *Store) verifyTOTP(administratorID int64, passcode string) (bool, error) {
+	var secret string
+	var lastStep uint64
+	err := s.db.QueryRow("SELECT secret, last_step FROM administrator_totp WHERE administrator_id = ?", administratorID).Scan(&secret, &lastStep)
+	if err == sql.ErrNoRows {
+		return false, ErrNotEnrolled
+	}
+	if err != nil {
+		return false, err
+	}
+
+	step, ok := Validate(secret, passcode, s.now())
+	if !ok || step <= lastStep {
+		return false, nil
+	}
+	res, err := s.db.Exec("UPDATE administrator_totp SET last_step = ? WHERE administrator_id = ? AND last_step < ?", step, administratorID, step)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (s *Store) useRecoveryCode(administratorID int64, code string) (bool, error) {
+	res, err := s.db.Exec("UPDATE administrator_recovery_codes SET used_at = ? WHERE administrator_id = ? AND code_hash = ? AND used_at IS NULL",
+		s.now().UTC(), administratorID, hashRecoveryCode(code))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(code))))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,164 @@
+package totp
+
+import (
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"torb/dialect"
+)
+
+// newStore returns the store on a new SQLite database with the clock moved by the returned function
+func newStore(t *testing.T) (*Store, func(d time.Duration)) {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "torb.sqlite3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	s, err := NewStore(db, dialect.SQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+	return s, func(d time.Duration) { now = now.Add(d) }
+}
+
+// enable enrolls the administrator and turns on TOTP, returning the secret and the recovery codes
+func enable(t *testing.T, s *Store, administratorID int64) (string, []string) {
+	t.Helper()
+	secret, err := s.Enroll(administratorID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes, ok, err := s.Enable(administratorID, currentCode(t, s, secret))
+	if err != nil || !ok {
+		t.Fatalf("Enable = %v, %v, want true", ok, err)
+	}
+	return secret, codes
+}
+
+func currentCode(t *testing.T, s *Store, secret string) string {
+	t.Helper()
+	code, err := Code(secret, s.now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func TestEnroll(t *testing.T) {
+	s, _ := newStore(t)
+	if ok, err := s.Verify(1, "000000"); ok || err != nil {
+		t.Errorf("Verify before Enroll = %v, %v, want false", ok, err)
+	}
+	if _, _, err := s.Enable(1, "000000"); err != ErrNotEnrolled {
+		t.Errorf("Enable before Enroll: %v, want ErrNotEnrolled", err)
+	}
+
+	secret, err := s.Enroll(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Enable するまではログインで使わない
+	if enabled, err := s.Enabled(1); enabled || err != nil {
+		t.Errorf("Enabled before Enable = %v, %v, want false", enabled, err)
+	}
+	if _, ok, err := s.Enable(1, "000000"); ok || err != nil {
+		t.Errorf("Enable with the wrong code = %v, %v, want false", ok, err)
+	}
+	codes, ok, err := s.Enable(1, currentCode(t, s, secret))
+	if err != nil || !ok {
+		t.Fatalf("Enable = %v, %v, want true", ok, err)
+	}
+	if len(codes) != recoveryCodeCount {
+		t.Errorf("%d recovery codes, want %d", len(codes), recoveryCodeCount)
+	}
+	if enabled, err := s.Enabled(1); !enabled || err != nil {
+		t.Errorf("Enabled after Enable = %v, %v, want true", enabled, err)
+	}
+	if _, err := s.Enroll(1); err != ErrAlreadyEnabled {
+		t.Errorf("Enroll after Enable: %v, want ErrAlreadyEnabled", err)
+	}
+
+	if err := s.Disable(1); err != nil {
+		t.Fatal(err)
+	}
+	if enabled, err := s.Enabled(1); enabled || err != nil {
+		t.Errorf("Enabled after Disable = %v, %v, want false", enabled, err)
+	}
+}
+
+func TestVerifyReplay(t *testing.T) {
+	s, advance := newStore(t)
+	secret, _ := enable(t, s, 1)
+
+	// Enable で使ったコードはもう使えない
+	if ok, err := s.Verify(1, currentCode(t, s, secret)); ok || err != nil {
+		t.Errorf("Verify with the code used by Enable = %v, %v, want false", ok, err)
+	}
+
+	advance(period * time.Second)
+	code := currentCode(t, s, secret)
+	if ok, err := s.Verify(1, code); !ok || err != nil {
+		t.Errorf("Verify = %v, %v, want true", ok, err)
+	}
+	if ok, err := s.Verify(1, code); ok || err != nil {
+		t.Errorf("Verify with the reused code = %v, %v, want false", ok, err)
+	}
+
+	// 前のステップのコードは許容範囲内でも、使ったステップより前なので受け付けない
+	advance(period * time.Second)
+	previous, err := Code(secret, s.now().Add(-2*period*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := s.Verify(1, previous); ok || err != nil {
+		t.Errorf("Verify with the code before the used step = %v, %v, want false", ok, err)
+	}
+	// 次のステップのコードは先に使える
+	next, err := Code(secret, s.now().Add(period*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := s.Verify(1, next); !ok || err != nil {
+		t.Errorf("Verify with the code of the next step = %v, %v, want true", ok, err)
+	}
+	advance(period * time.Second)
+	if ok, err := s.Verify(1, currentCode(t, s, secret)); ok || err != nil {
+		t.Errorf("Verify with the code of the step used in advance = %v, %v, want false", ok, err)
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	s, _ := newStore(t)
+	_, codes := enable(t, s, 1)
+
+	// 大文字・前後の空白は区別しない
+	if ok, err := s.Verify(1, " "+strings.ToUpper(codes[0])+" "); !ok || err != nil {
+		t.Errorf("Verify with the recovery code = %v, %v, want true", ok, err)
+	}
+	if ok, err := s.Verify(1, codes[0]); ok || err != nil {
+		t.Errorf("Verify with the used recovery code = %v, %v, want false", ok, err)
+	}
+	if ok, err := s.Verify(2, codes[1]); ok || err != nil {
+		t.Errorf("Verify with the recovery code of another administrator = %v, %v, want false", ok, err)
+	}
+
+	// 作り直すと前のコードは使えない
+	regenerated, err := s.RegenerateRecoveryCodes(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := s.Verify(1, codes[1]); ok || err != nil {
+		t.Errorf("Verify with the old recovery code = %v, %v, want false", ok, err)
+	}
+	if ok, err := s.Verify(1, regenerated[0]); !ok || err != nil {
+		t.Errorf("Verify with the new recovery code = %v, %v, want true", ok, err)
+	}
+}
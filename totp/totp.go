@@ -0,0 +1,86 @@
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// RFC 6238 の標準的なパラメータ（Google Authenticator 等が対応しているもの）
+const (
+	period = 30
+	digits = 6
+	// skew is the number of periods accepted before and after the current one
+	skew = 1
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret returns a random base32 secret
+func GenerateSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString(b), nil
+}
+
+// ProvisioningURI returns the otpauth:// URI to be shown as a QR code
+func ProvisioningURI(issuer, account, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(digits))
+	v.Set("period", fmt.Sprint(period))
+	label := url.PathEscape(issuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+// Code returns the code of the secret at t
+func Code(secret string, t time.Time) (string, error) {
+	key, err := encoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	return code(key, uint64(t.Unix()/period)), nil
+}
+
+// Validate checks the code against the periods around t and returns the matched time step
+func Validate(secret, passcode string, t time.Time) (uint64, bool) {
+	passcode = strings.TrimSpace(passcode)
+	if len(passcode) != digits {
+		return 0, false
+	}
+	key, err := encoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return 0, false
+	}
+
+	current := uint64(t.Unix() / period)
+	for i := -skew; i <= skew; i++ {
+		step := current + uint64(i)
+		if hmac.Equal([]byte(code(key, step)), []byte(passcode)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func code(key []byte, step uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], step)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	v := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", digits, v%1000000)
+}
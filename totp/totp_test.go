@@ -0,0 +1,83 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+// RFC 6238 Appendix B の SHA1 の鍵 "12345678901234567890" を base32 にしたもの
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCode(t *testing.T) {
+	// RFC 6238 の8桁のテストベクタの下6桁
+	for _, tt := range []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	} {
+		got, err := Code(rfcSecret, time.Unix(tt.unix, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("Code at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+
+	// 小文字の秘密鍵も受け付ける
+	if got, err := Code("gezdgnbvgy3tqojqgezdgnbvgy3tqojq", time.Unix(59, 0)); err != nil || got != "287082" {
+		t.Errorf("Code with the lower case secret = %s, %v, want 287082", got, err)
+	}
+	if _, err := Code("not base32!", time.Unix(59, 0)); err == nil {
+		t.Error("Code with the invalid secret = nil error, want error")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := uint64(now.Unix() / period)
+	codeAt := func(d time.Duration) string {
+		code, err := Code(rfcSecret, now.Add(d))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+
+	// 前後1ステップまでは受け付け、一致したステップを返す
+	for _, tt := range []struct {
+		d    time.Duration
+		step uint64
+		ok   bool
+	}{
+		{0, current, true},
+		{-period * time.Second, current - 1, true},
+		{period * time.Second, current + 1, true},
+		{-2 * period * time.Second, 0, false},
+		{2 * period * time.Second, 0, false},
+	} {
+		step, ok := Validate(rfcSecret, codeAt(tt.d), now)
+		if step != tt.step || ok != tt.ok {
+			t.Errorf("Validate the code at %v = %d, %v, want %d, %v", tt.d, step, ok, tt.step, tt.ok)
+		}
+	}
+
+	code := codeAt(0)
+	if _, ok := Validate(rfcSecret, " "+code+"\n", now); !ok {
+		t.Error("Validate with the spaces = false, want true")
+	}
+	for _, passcode := range []string{"", code[:5], code + "0", "abcdef"} {
+		if _, ok := Validate(rfcSecret, passcode, now); ok {
+			t.Errorf("Validate(%q) = true, want false", passcode)
+		}
+	}
+	if _, ok := Validate("not base32!", code, now); ok {
+		t.Error("Validate with the invalid secret = true, want false")
+	}
+}
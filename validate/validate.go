@@ -0,0 +1,141 @@
+package validate
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// FieldError is a rule the field of the request failed
+type FieldError struct {
+	Field string `json:"field"`
+	Rule  string `json:"rule"`
+	Param string `json:"param,omitempty"`
+}
+
+func (e FieldError) Error() string {
+	if e.Param == "" {
+		return fmt.Sprintf("%s: %s", e.Field, e.Rule)
+	}
+	return fmt.Sprintf("%s: %s=%s", e.Field, e.Rule, e.Param)
+}
+
+// Struct checks the fields of the struct by the `validate` tags and returns the failed rules.
+//
+// Rules are separated by ",":
+//
+//	required   not the zero value (not empty for strings and slices)
+//	min=N      at least N, the length for strings (in characters) and slices
+//	max=N      at most N, the length for strings (in characters) and slices
+//	maxbytes=N at most N bytes of the string in UTF-8, such as the 72 bytes limit of bcrypt
+//	oneof=a b  one of the space separated values
+//
+// Only the first failed rule of each field is reported, the field is named by the `json` tag.
+func Struct(v interface{}) []FieldError {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	if rv.Kind() != reflect.Struct {
+		panic("validate: not a struct")
+	}
+	rt := rv.Type()
+
+	var errs []FieldError
+	for i := 0; i < rt.NumField(); i++ {
+		f := rt.Field(i)
+		tag := f.Tag.Get("validate")
+		if tag == "" {
+			continue
+		}
+		if err, ok := field(fieldName(f), rv.Field(i), tag); !ok {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+func fieldName(f reflect.StructField) string {
+	if name := strings.Split(f.Tag.Get("json"), ",")[0]; name != "" && name != "-" {
+		return name
+	}
+	return f.Name
+}
+
+func field(name string, v reflect.Value, tag string) (FieldError, bool) {
+	for _, rule := range strings.Split(tag, ",") {
+		param := ""
+		if i := strings.Index(rule, "="); i >= 0 {
+			rule, param = rule[:i], rule[i+1:]
+		}
+		if !check(v, rule, param) {
+			return FieldError{Field: name, Rule: rule, Param: param}, false
+		}
+	}
+	return FieldError{}, true
+}
+
+func check(v reflect.Value, rule, param string) bool {
+	switch rule {
+	case "required":
+		return !isZero(v)
+	case "min", "max":
+		// 空の文字列や配列は任意項目として通す（必須なら required を付ける）。数値は0も範囲を見る
+		switch v.Kind() {
+		case reflect.String, reflect.Slice, reflect.Map:
+			if v.Len() == 0 {
+				return true
+			}
+		}
+		n, err := strconv.ParseInt(param, 10, 64)
+		if err != nil {
+			panic("validate: invalid " + rule + " " + param)
+		}
+		size := measure(v)
+		if rule == "min" {
+			return size >= n
+		}
+		return size <= n
+	case "maxbytes":
+		n, err := strconv.Atoi(param)
+		if err != nil || v.Kind() != reflect.String {
+			panic("validate: invalid maxbytes " + param)
+		}
+		return len(v.String()) <= n
+	case "oneof":
+		if isZero(v) {
+			return true
+		}
+		s := fmt.Sprint(v.Interface())
+		for _, p := range strings.Fields(param) {
+			if s == p {
+				return true
+			}
+		}
+		return false
+	}
+	panic("validate: unknown rule " + rule)
+}
+
+func isZero(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	}
+	return v.Interface() == reflect.Zero(v.Type()).Interface()
+}
+
+func measure(v reflect.Value) int64 {
+	switch v.Kind() {
+	case reflect.String:
+		return int64(utf8.RuneCountInString(v.String()))
+	case reflect.Slice, reflect.Map:
+		return int64(v.Len())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(v.Uint())
+	}
+	panic("validate: min/max is not supported for " + v.Kind().String())
+}
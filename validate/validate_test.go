@@ -0,0 +1,95 @@
+package validate
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type params struct {
+	Nickname string   `json:"nickname" validate:"required,max=4"`
+	Password string   `json:"password" validate:"required,maxbytes=72"`
+	Rank     string   `json:"sheet_rank" validate:"oneof=S A B C"`
+	Price    int      `json:"price" validate:"min=0,max=100"`
+	Name     string   `validate:"min=2"`
+	Roles    []string `json:"roles,omitempty" validate:"max=2"`
+	Memo     string   `json:"memo"`
+}
+
+func valid() params {
+	return params{Nickname: "ユーザー", Password: "password", Rank: "S", Price: 100, Name: "ab", Roles: []string{"a", "b"}}
+}
+
+func TestStruct(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		modify func(p *params)
+		want   []FieldError
+	}{
+		{"valid", func(p *params) {}, nil},
+		{"required", func(p *params) { p.Nickname = "" }, []FieldError{{Field: "nickname", Rule: "required"}}},
+		// max は文字数で数える
+		{"max characters", func(p *params) { p.Nickname = "ユーザー1" }, []FieldError{{Field: "nickname", Rule: "max", Param: "4"}}},
+		{"password of 72 bytes", func(p *params) { p.Password = strings.Repeat("a", 72) }, nil},
+		{"password over 72 bytes", func(p *params) { p.Password = strings.Repeat("a", 73) }, []FieldError{{Field: "password", Rule: "maxbytes", Param: "72"}}},
+		// maxbytes は文字数ではなくバイト数で数える
+		{"password of multibyte characters", func(p *params) { p.Password = strings.Repeat("あ", 25) }, []FieldError{{Field: "password", Rule: "maxbytes", Param: "72"}}},
+		{"required before maxbytes", func(p *params) { p.Password = "" }, []FieldError{{Field: "password", Rule: "required"}}},
+		{"sheet_rank", func(p *params) { p.Rank = "D" }, []FieldError{{Field: "sheet_rank", Rule: "oneof", Param: "S A B C"}}},
+		{"sheet_rank is case sensitive", func(p *params) { p.Rank = "s" }, []FieldError{{Field: "sheet_rank", Rule: "oneof", Param: "S A B C"}}},
+		{"oneof without required", func(p *params) { p.Rank = "" }, nil},
+		{"min number", func(p *params) { p.Price = -1 }, []FieldError{{Field: "price", Rule: "min", Param: "0"}}},
+		{"max number", func(p *params) { p.Price = 101 }, []FieldError{{Field: "price", Rule: "max", Param: "100"}}},
+		{"zero number", func(p *params) { p.Price = 0 }, nil},
+		// json タグがなければフィールド名
+		{"min length", func(p *params) { p.Name = "a" }, []FieldError{{Field: "Name", Rule: "min", Param: "2"}}},
+		{"min without required", func(p *params) { p.Name = "" }, nil},
+		{"max slice", func(p *params) { p.Roles = []string{"a", "b", "c"} }, []FieldError{{Field: "roles", Rule: "max", Param: "2"}}},
+		{"all fields", func(p *params) {
+			*p = params{Price: -1}
+		}, []FieldError{
+			{Field: "nickname", Rule: "required"},
+			{Field: "password", Rule: "required"},
+			{Field: "price", Rule: "min", Param: "0"},
+		}},
+	} {
+		p := valid()
+		tt.modify(&p)
+		if got := Struct(&p); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Struct = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestStructPanics(t *testing.T) {
+	for name, v := range map[string]interface{}{
+		"not a struct": "string",
+		"unknown rule": &struct {
+			A string `validate:"email"`
+		}{},
+		"invalid param": &struct {
+			A string `validate:"max=x"`
+		}{A: "a"},
+		"maxbytes of number": &struct {
+			A int `validate:"maxbytes=1"`
+		}{},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: Struct did not panic", name)
+				}
+			}()
+			Struct(v)
+		}()
+	}
+}
+
+func TestFieldError(t *testing.T) {
+	if got := (FieldError{Field: "nickname", Rule: "required"}).Error(); got != "nickname: required" {
+		t.Errorf("Error = %q", got)
+	}
+	if got := (FieldError{Field: "nickname", Rule: "max", Param: "128"}).Error(); got != "nickname: max=128" {
+		t.Errorf("Error = %q", got)
+	}
+}